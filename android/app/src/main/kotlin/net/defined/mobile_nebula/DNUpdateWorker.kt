@@ -122,7 +122,9 @@ class DNSiteUpdater(
         }
 
         if (newSiteJson != null) {
-            saveSite(context, newSiteJson, existingSite = site)
+            // The update replaces rawConfig wholesale, carry the user's pinned remotes over
+            val keptSiteJson = mobileNebula.MobileNebula.keepPinnedRemotes(newSiteJson, site.rawConfig)
+            saveSite(context, keptSiteJson, existingSite = site)
             Log.d(TAG, "Updated site ${site.id}: ${site.name}")
             return Result.CONFIG_UPDATED
         }
@@ -627,6 +627,8 @@ class MainActivity: FlutterActivity() {
             when (msg.what) {
                 NebulaVpnService.MSG_IS_RUNNING -> isRunning(site, msg)
                 NebulaVpnService.MSG_EXIT -> serviceExited(site, msg)
+                // The site detail screen refreshes the hostmap on every change
+                NebulaVpnService.MSG_EVENT -> site.updater.notifyChanged()
                 else -> super.handleMessage(msg)
             }
         }
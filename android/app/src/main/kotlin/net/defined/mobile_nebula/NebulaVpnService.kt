@@ -16,6 +16,8 @@ import java.io.File
 import java.net.Inet4Address
 import java.net.Inet6Address
 import java.net.InetAddress
+import org.json.JSONArray
+import org.json.JSONObject
 
 
 class NebulaVpnService : VpnService() {
@@ -36,6 +38,7 @@ class NebulaVpnService : VpnService() {
         const val MSG_SET_REMOTE_FOR_TUNNEL = 7
         const val MSG_CLOSE_TUNNEL = 8
         const val MSG_EXIT = 9
+        const val MSG_EVENT = 11
 
         val ALWAYS_EXCLUDED_APPS = listOf(
             "com.google.android.projection.gearhead",  // Android Auto
@@ -192,11 +195,28 @@ class NebulaVpnService : VpnService() {
             disallowApp(builder, packageName)
         }
 
+        // With the site's DNS responder on the OS asks it everything, it is
+        // answered inside the tun and forwards what isn't an overlay name to
+        // the site's resolvers
+        val dnsResolver = try {
+            JSONObject(mobileNebula.MobileNebula.dnsSettings(site!!.config)).optString("resolver")
+        } catch (err: Exception) {
+            Log.e(TAG, "Got an error reading the dns settings $err")
+            ""
+        }
+
         var hasDnsResolvers = false
-        site!!.dnsResolvers.forEach {
+        if (dnsResolver.isNotEmpty()) {
             hasDnsResolvers = true
-            builder.addDnsServer(it)
-            Log.i(TAG, "Adding dns resolver: $it")
+            builder.addRoute(dnsResolver, if (dnsResolver.contains(':')) 128 else 32)
+            builder.addDnsServer(dnsResolver)
+            Log.i(TAG, "Adding the site dns responder: $dnsResolver")
+        } else {
+            site!!.dnsResolvers.forEach {
+                hasDnsResolvers = true
+                builder.addDnsServer(it)
+                Log.i(TAG, "Adding dns resolver: $it")
+            }
         }
 
         if (isChromeOs() && !hasDnsResolvers) {
@@ -213,7 +233,7 @@ class NebulaVpnService : VpnService() {
         try {
             vpnInterface = builder.establish()
             nebula = mobileNebula.MobileNebula.newNebula(site!!.config, site!!.getKey(this), site!!.logFile, vpnInterface!!.detachFd().toLong())
-            nebula!!.start(exitCallbackFor(nebula!!))
+            nebula!!.start(exitCallbackFor(nebula!!), eventCallbackFor(nebula!!))
 
         } catch (e: Exception) {
             Log.e(TAG, "Got an error $e")
@@ -266,15 +286,57 @@ class NebulaVpnService : VpnService() {
         // by the same network event, so no !! here
         override fun onAvailable(network: Network) {
             super.onAvailable(network)
-            nebula?.rebind("network change")
+            rebindNetwork()
+        }
+
+        override fun onLinkPropertiesChanged(network: Network, linkProperties: LinkProperties) {
+            super.onLinkPropertiesChanged(network, linkProperties)
+            rebindNetwork()
         }
 
         override fun onLost(network: Network) {
             super.onLost(network)
+            rebindNetwork()
+        }
+    }
+
+    // Describes the network we moved to, nebula skips the rebind when nothing
+    // that matters to the underlay changed and prefers the lan while on wifi
+    private fun rebindNetwork() {
+        try {
+            nebula?.rebindNetwork(networkInfo().toString())
+        } catch (e: Exception) {
+            Log.e(TAG, "Failed to rebind for the network change: ${e.message}")
             nebula?.rebind("network change")
         }
     }
 
+    private fun networkInfo(): JSONObject {
+        val connectivityManager = getSystemService(Context.CONNECTIVITY_SERVICE) as ConnectivityManager
+        val network = connectivityManager.activeNetwork
+        val caps = network?.let { connectivityManager.getNetworkCapabilities(it) }
+        val link = network?.let { connectivityManager.getLinkProperties(it) }
+        // Link local addresses carry a scope nebula doesn't bind to
+        val addrs = link?.linkAddresses?.filter { !it.address.isLinkLocalAddress } ?: emptyList()
+
+        val type = when {
+            caps == null -> "none"
+            caps.hasTransport(NetworkCapabilities.TRANSPORT_WIFI) -> "wifi"
+            caps.hasTransport(NetworkCapabilities.TRANSPORT_CELLULAR) -> "cellular"
+            caps.hasTransport(NetworkCapabilities.TRANSPORT_ETHERNET) -> "ethernet"
+            else -> "other"
+        }
+
+        return JSONObject()
+            .put("type", type)
+            .put("metered", caps != null && !caps.hasCapability(NetworkCapabilities.NET_CAPABILITY_NOT_METERED))
+            .put("ipv4", addrs.any { it.address is Inet4Address })
+            .put("ipv6", addrs.any { it.address is Inet6Address })
+            .put("localAddrs", JSONArray(addrs.map { it.address.hostAddress }))
+            .put("localNetworks", JSONArray(addrs.map { "${it.address.hostAddress}/${it.prefixLength}" }))
+            .put("dnsServers", JSONArray(link?.dnsServers?.mapNotNull { it.hostAddress } ?: emptyList<String>()))
+    }
+
 
     private fun registerSleep() {
         val receiver: BroadcastReceiver = object : BroadcastReceiver() {
@@ -288,6 +350,9 @@ class NebulaVpnService : VpnService() {
                     didSleep = true
                 } else {
                     nebula!!.rebind("android wake")
+                    if (didSleep) {
+                        nebula!!.wake()
+                    }
                     didSleep = false
                 }
             }
@@ -306,7 +371,36 @@ class NebulaVpnService : VpnService() {
 
     private fun reload() {
         site = Site(this, File(path!!))
-        nebula?.reload(site!!.config, site!!.getKey(this))
+        val report = try {
+            // A config nebula can't apply is rolled back, the tunnel keeps running on the old one
+            JSONObject(nebula?.reload(site!!.config, site!!.getKey(this)) ?: return)
+        } catch (err: Exception) {
+            Log.e(TAG, "Got an error while reloading nebula $err")
+            return
+        }
+
+        // Some changes only take effect on a fresh connect, the report says which
+        if (report.optBoolean("applied") && report.optBoolean("reconnect")) {
+            val restartRequired = report.optJSONArray("restartRequired")
+            val sections = (0 until (restartRequired?.length() ?: 0)).map { restartRequired!!.getJSONObject(it).optString("section") }
+            Log.i(TAG, "Reconnecting to apply: $sections")
+            reconnect()
+        }
+    }
+
+    // Replaces the running nebula with one built from the current site, the
+    // interface is established again so tun and dns changes land too
+    private fun reconnect() {
+        unregisterNetworkCallback()
+        unregisterReloadReceiver()
+        try {
+            nebula?.stop()
+        } catch (e: Exception) {
+            Log.e(TAG, "Nebula did not stop cleanly: ${e.message}")
+        }
+        nebula = null
+        running = false
+        startVpn()
     }
 
     private fun stopVpn(error: String? = null) {
@@ -316,11 +410,17 @@ class NebulaVpnService : VpnService() {
 
         unregisterNetworkCallback()
         unregisterReloadReceiver()
-        // stop() blocks until the packet readers have drained and nebula has fully stopped
-        nebula?.stop()
+        // stop() blocks until the packet readers have drained and nebula has fully stopped,
+        // it throws when mobile_nebula.stop_timeout passed first and the tunnel was forced closed
+        val stopError = try {
+            nebula?.stop()
+            null
+        } catch (e: Exception) {
+            e.message ?: e.toString()
+        }
         nebula = null
         running = false
-        announceExit(site?.id, error)
+        announceExit(site?.id, error ?: stopError)
         stopSelf()
     }
 
@@ -342,6 +442,21 @@ class NebulaVpnService : VpnService() {
         }
     }
 
+    private fun eventCallbackFor(sessionNebula: mobileNebula.Nebula): mobileNebula.EventCallback {
+        return object : mobileNebula.EventCallback {
+            override fun onEvent(event: String?) {
+                Handler(Looper.getMainLooper()).post {
+                    // A late event from a stopped session must not reach the next one
+                    if (nebula === sessionNebula) {
+                        val msg = Message.obtain(null, MSG_EVENT)
+                        msg.data.putString("event", event)
+                        send(msg)
+                    }
+                }
+            }
+        }
+    }
+
     override fun onRevoke()  {
         stopVpn()
         super.onRevoke()
@@ -32,7 +32,6 @@ class PacketTunnelProvider: NEPacketTunnelProvider {
   private var nebula: MobileNebulaNebula?
   private var dnUpdater = DNUpdater()
   private var didSleep = false
-  private var cachedRouteDescription: String?
 
   // A stopTunnel can race an in-flight start() before self.nebula exists, in
   // which case its nebula?.stop() is a silent no-op. Latch the stop here so
@@ -122,8 +121,6 @@ class PacketTunnelProvider: NEPacketTunnelProvider {
     defer { endStart() }
 
     var manager: NETunnelProviderManager?
-    var config: Data
-    var key: String
 
     do {
       // Cannot use NETunnelProviderManager.loadAllFromPreferences() in earlier versions of iOS
@@ -141,15 +138,26 @@ class PacketTunnelProvider: NEPacketTunnelProvider {
         // vpn profile name when updates happen (rare).
         self.site = try Site(proto: self.protocolConfiguration as! NETunnelProviderProtocol)
       }
-      config = self.site!.getConfig()
     } catch {
       //TODO: need a way to notify the app
       self.log.error("Failed to render config from vpn object")
       throw error
     }
 
+    try await bringUp()
+
+    // Skips the monitor and DN updater if a stopTunnel raced us, the tunnel
+    // is coming down and nothing would ever cancel them
+    startPostStartWork()
+  }
+
+  // bringUp hands the site's network settings to the system and starts a
+  // nebula on the tun, start runs it once and reconnect again for the changes
+  // a running nebula can't pick up
+  private func bringUp() async throws {
     let _site = self.site!
-    key = try _site.getKey()
+    let config = _site.getConfig()
+    let key = try _site.getKey()
 
     // This is set to 127.0.0.1 because it has to be something..
     let tunnelNetworkSettings = NEPacketTunnelNetworkSettings(tunnelRemoteAddress: "127.0.0.1")
@@ -160,7 +168,37 @@ class PacketTunnelProvider: NEPacketTunnelProvider {
       unsafeRoutes: _site.unsafeRoutes
     )
 
-    if !_site.dnsResolvers.isEmpty {
+    // With the site's DNS responder on the system asks it, it is answered
+    // inside the tun. It forwards what isn't an overlay name to the site's
+    // resolvers, without any the system only asks it for the overlay domain.
+    var dnsErr: NSError?
+    let responder = JSON(
+      parseJSON: MobileNebulaDnsSettings(String(data: config, encoding: .utf8), &dnsErr))
+    let dnsResolver = responder["resolver"].stringValue
+    if dnsErr != nil {
+      self.log.error("Failed to read the dns settings: \(dnsErr, privacy: .public)")
+    }
+
+    if dnsErr == nil && !dnsResolver.isEmpty {
+      self.log.info("Assigning the site dns responder: \(dnsResolver, privacy: .public)")
+      let responderSettings = NEDNSSettings(servers: [dnsResolver])
+      if _site.dnsResolvers.isEmpty {
+        responderSettings.matchDomains = [responder["domain"].stringValue]
+      } else if _site.matchDomains.isEmpty {
+        responderSettings.matchDomains = [""]
+      } else {
+        responderSettings.matchDomains = _site.matchDomains + [responder["domain"].stringValue]
+      }
+      tunnelNetworkSettings.dnsSettings = responderSettings
+
+      if dnsResolver.contains(":") {
+        v6Settings.includedRoutes?.append(
+          NEIPv6Route(destinationAddress: dnsResolver, networkPrefixLength: 128))
+      } else {
+        v4Settings.includedRoutes?.append(
+          NEIPv4Route(destinationAddress: dnsResolver, subnetMask: "255.255.255.255"))
+      }
+    } else if !_site.dnsResolvers.isEmpty {
       self.log.info("Assigning dns resolvers: \(_site.dnsResolvers, privacy: .public)")
       let dnsSettings = NEDNSSettings(servers: _site.dnsResolvers)
       if _site.matchDomains.isEmpty {
@@ -216,14 +254,54 @@ class PacketTunnelProvider: NEPacketTunnelProvider {
     // A stopTunnel that raced us before self.nebula existed had nothing to
     // stop, apply it to this instance so start(self) tears it back down
     if isStopped() {
-      self.nebula?.stop()
+      stopNebula()
     }
 
-    try self.nebula!.start(self)
+    try self.nebula!.start(self, events: self)
+  }
 
-    // Skips the monitor and DN updater if a stopTunnel raced us, the tunnel
-    // is coming down and nothing would ever cancel them
-    startPostStartWork()
+  // beginReconnect reports whether this caller owns the reconnect, it shares
+  // the in flight flag with start so the two never build a nebula at once.
+  // The old nebula is dropped here, a start landing meanwhile would otherwise
+  // take the tunnel for up.
+  private func beginReconnect() -> MobileNebulaNebula? {
+    stoppedLock.lock()
+    defer { stoppedLock.unlock() }
+    if stopped || starting || nebula == nil {
+      return nil
+    }
+    starting = true
+    let old = nebula
+    nebula = nil
+    return old
+  }
+
+  // reconnect replaces the running nebula with a fresh one on the same tun,
+  // the network monitor and DN updater carry on
+  private func reconnect() async {
+    guard let old = beginReconnect() else {
+      return
+    }
+    defer { endStart() }
+
+    self.reasserting = true
+    defer { self.reasserting = false }
+
+    do {
+      try old.stop()
+    } catch {
+      log.error("Nebula did not stop cleanly: \(error, privacy: .public)")
+    }
+
+    do {
+      try await bringUp()
+    } catch {
+      if isStopped() {
+        return
+      }
+      log.error("Failed to reconnect: \(error.localizedDescription, privacy: .public)")
+      cancelTunnelWithError(error)
+    }
   }
 
   private func getNetworkAddressesAndRoutes(networks: [String], unsafeRoutes: [UnsafeRoute]) throws
@@ -300,9 +378,20 @@ class PacketTunnelProvider: NEPacketTunnelProvider {
   private func handleDNUpdate(newSite: Site) {
     do {
       self.site = newSite
-      try self.nebula?.reload(
-        String(data: newSite.getConfig(), encoding: .utf8), key: newSite.getKey())
+      guard
+        let res = try self.nebula?.reload(
+          String(data: newSite.getConfig(), encoding: .utf8), key: newSite.getKey())
+      else {
+        return
+      }
 
+      // Some changes only take effect on a fresh connect, the report says which
+      let report = JSON(parseJSON: res)
+      if report["applied"].boolValue && report["reconnect"].boolValue {
+        let sections = report["restartRequired"].arrayValue.map { $0["section"].stringValue }
+        log.info("Reconnecting to apply: \(sections, privacy: .public)")
+        Task { await self.reconnect() }
+      }
     } catch {
       log.error(
         "Got an error while updating nebula \(error.localizedDescription, privacy: .public)")
@@ -354,38 +443,100 @@ class PacketTunnelProvider: NEPacketTunnelProvider {
     with reason: NEProviderStopReason, completionHandler: @escaping () -> Void
   ) {
     _ = latchStopped()
-
-    // stop() blocks until the packet readers have drained and nebula has fully stopped
-    nebula?.stop()
+    stopNebula()
     completionHandler()
   }
 
+  // stop() blocks until the packet readers have drained and nebula has fully
+  // stopped, it throws when mobile_nebula.stop_timeout passed first and the
+  // tunnel was forced closed with nebula still winding down
+  private func stopNebula() {
+    do {
+      try nebula?.stop()
+    } catch {
+      log.error("Nebula did not stop cleanly: \(error, privacy: .public)")
+    }
+  }
+
+  // Describes the network we moved to, nebula skips the rebind when nothing
+  // that matters to the underlay changed and prefers the lan while on wifi
   private func pathUpdate(path: Network.NWPath) {
-    let routeDescription = collectAddresses(endpoints: path.gateways)
-    if routeDescription != cachedRouteDescription {
-      // Don't bother to rebind if we don't have any gateways
-      if routeDescription != "" {
-        nebula?.rebind(
-          "network change to: \(routeDescription); from: \(cachedRouteDescription ?? "none")")
-      }
-      cachedRouteDescription = routeDescription
+    let iface = path.availableInterfaces.first
+    var type = "none"
+    switch iface?.type {
+    case .wifi: type = "wifi"
+    case .cellular: type = "cellular"
+    case .wiredEthernet: type = "ethernet"
+    case .some: type = "other"
+    case .none: break
+    }
+
+    let networks = iface.map { interfaceNetworks(name: $0.name) } ?? []
+    let info = JSON([
+      "type": type,
+      "metered": path.isExpensive,
+      "ipv4": path.status == .satisfied && path.supportsIPv4,
+      "ipv6": path.status == .satisfied && path.supportsIPv6,
+      "localAddrs": networks.map { $0.addr },
+      "localNetworks": networks.map { "\($0.addr)/\($0.bits)" },
+    ])
+
+    do {
+      try nebula?.rebindNetwork(info.rawString())
+    } catch {
+      log.error("Failed to rebind for the network change: \(error.localizedDescription, privacy: .public)")
+      nebula?.rebind("network change")
     }
   }
 
-  private func collectAddresses(endpoints: [Network.NWEndpoint]) -> String {
-    var str: [String] = []
-    endpoints.forEach { endpoint in
-      switch endpoint {
-      case .hostPort(.ipv6(let host), let port):
-        str.append("[\(host)]:\(port)")
-      case .hostPort(.ipv4(let host), let port):
-        str.append("\(host):\(port)")
+  // interfaceNetworks returns the addresses on the interface name with their
+  // prefix length, link local ones carry a scope nebula doesn't bind to
+  private func interfaceNetworks(name: String) -> [(addr: String, bits: Int)] {
+    var ifaddr: UnsafeMutablePointer<ifaddrs>?
+    guard getifaddrs(&ifaddr) == 0 else {
+      return []
+    }
+    defer { freeifaddrs(ifaddr) }
+
+    var networks: [(addr: String, bits: Int)] = []
+    var cursor = ifaddr
+    while let cur = cursor {
+      cursor = cur.pointee.ifa_next
+      guard String(cString: cur.pointee.ifa_name) == name,
+        let addr = cur.pointee.ifa_addr, let mask = cur.pointee.ifa_netmask
+      else {
+        continue
+      }
+
+      var bits = 0
+      switch Int32(addr.pointee.sa_family) {
+      case AF_INET:
+        bits = mask.withMemoryRebound(to: sockaddr_in.self, capacity: 1) {
+          $0.pointee.sin_addr.s_addr.nonzeroBitCount
+        }
+      case AF_INET6:
+        bits = mask.withMemoryRebound(to: sockaddr_in6.self, capacity: 1) {
+          withUnsafeBytes(of: $0.pointee.sin6_addr) { $0.reduce(0) { $0 + $1.nonzeroBitCount } }
+        }
       default:
-        return
+        continue
       }
-    }
 
-    return str.sorted().joined(separator: ", ")
+      var host = [CChar](repeating: 0, count: Int(NI_MAXHOST))
+      guard
+        getnameinfo(
+          addr, socklen_t(addr.pointee.sa_len), &host, socklen_t(host.count), nil, 0,
+          NI_NUMERICHOST) == 0
+      else {
+        continue
+      }
+      let str = String(cString: host)
+      if str.lowercased().hasPrefix("fe80") {
+        continue
+      }
+      networks.append((addr: str, bits: bits))
+    }
+    return networks
   }
 
   override func handleAppMessage(_ data: Data) async -> Data? {
@@ -534,3 +685,17 @@ extension PacketTunnelProvider: MobileNebulaExitCallbackProtocol {
         userInfo: [NSLocalizedDescriptionKey: error]))
   }
 }
+
+extension PacketTunnelProvider: MobileNebulaEventCallbackProtocol {
+  // Called from a Go thread for every tunnel event, the app only needs to know
+  // something changed so it can refresh what it shows
+  func onEvent(_ event: String?) {
+    guard let id = site?.id else {
+      return
+    }
+
+    CFNotificationCenterPostNotification(
+      CFNotificationCenterGetDarwinNotifyCenter(),
+      CFNotificationName(tunnelEventNotification(siteID: id) as CFString), nil, nil, true)
+  }
+}
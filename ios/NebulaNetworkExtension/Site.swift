@@ -5,6 +5,12 @@ import os.log
 
 let log = Logger(subsystem: "net.defined.mobileNebula", category: "Site")
 
+/// The darwin notification the network extension posts for every tunnel event
+/// nebula reports for the site, the app refreshes the site on it
+func tunnelEventNotification(siteID: String) -> String {
+  return "net.defined.mobileNebula.tunnelEvent.\(siteID)"
+}
+
 enum SiteError: Error {
   case nonConforming(site: [String: Any]?)
   case noCertificate
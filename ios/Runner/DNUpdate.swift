@@ -71,7 +71,15 @@ class DNUpdater {
         return
       }
 
-      if let newSiteJson = newSiteJson {
+      if var newSiteJson = newSiteJson {
+        // The update replaces rawConfig wholesale, carry the user's pinned remotes over
+        var err: NSError?
+        let keptSiteJson = MobileNebulaKeepPinnedRemotes(newSiteJson, site.rawConfig, &err)
+        if let err = err {
+          throw err
+        }
+        newSiteJson = keptSiteJson
+
         let siteManager = site.manager
         let shouldSaveToManager =
           siteManager != nil
@@ -142,10 +142,28 @@ class SiteUpdater: NSObject, FlutterStreamHandler {
       NotificationCenter.default.addObserver(
         self, selector: #selector(onNotification), name: NSNotification.Name.NEVPNStatusDidChange,
         object: site.manager!.connection)
+
+      // Darwin notifications carry no payload, the observer pointer gets us back to self
+      CFNotificationCenterAddObserver(
+        CFNotificationCenterGetDarwinNotifyCenter(), Unmanaged.passUnretained(self).toOpaque(),
+        { _, observer, _, _, _ in
+          guard let observer = observer else {
+            return
+          }
+          let updater = Unmanaged<SiteUpdater>.fromOpaque(observer).takeUnretainedValue()
+          DispatchQueue.main.async { updater.onTunnelEvent() }
+        }, tunnelEventNotification(siteID: site.id) as CFString, nil, .deliverImmediately)
     #endif
     return nil
   }
 
+  /// onTunnelEvent resends the site so the UI refreshes the hostmap when a tunnel changes
+  func onTunnelEvent() {
+    if self.site.connected == true {
+      self.update(connected: true)
+    }
+  }
+
   @objc func onNotification(n: Notification) {
     let oldConnected = self.site.connected
 
@@ -168,9 +186,17 @@ class SiteUpdater: NSObject, FlutterStreamHandler {
       self, name: NSNotification.Name.NEVPNConfigurationChange, object: nil)
     NotificationCenter.default.removeObserver(
       self, name: NSNotification.Name.NEVPNStatusDidChange, object: nil)
+    CFNotificationCenterRemoveEveryObserver(
+      CFNotificationCenterGetDarwinNotifyCenter(), Unmanaged.passUnretained(self).toOpaque())
     return nil
   }
 
+  deinit {
+    // The darwin center holds an unretained pointer to us
+    CFNotificationCenterRemoveEveryObserver(
+      CFNotificationCenterGetDarwinNotifyCenter(), Unmanaged.passUnretained(self).toOpaque())
+  }
+
   /// update is a way to send information to the flutter listener and generally should not be used directly
   func update(connected: Bool, replaceSite: Site? = nil) {
     if replaceSite != nil {
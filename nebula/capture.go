@@ -0,0 +1,237 @@
+package mobileNebula
+
+import (
+	"bufio"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"net/netip"
+	"os"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	pcapHeaderLen       = 24
+	pcapRecordHeaderLen = 16
+	// pcapLinkTypeRaw says every record is a bare ip packet, which is what
+	// crosses the tun device
+	pcapLinkTypeRaw = 101
+	pcapSnapLen     = 65535
+)
+
+// captureQueueSize bounds the packets waiting on the capture file, packets
+// past it are dropped rather than stalling nebula's packet path
+const captureQueueSize = 1024
+
+// packetCapture writes the inside packets crossing the tun device to a pcap
+// file. The packet path only copies a packet onto records, a writer goroutine
+// puts them in the file, the file is only flushed when the capture ends.
+type packetCapture struct {
+	dev *tunDevice
+	// peer limits the capture to traffic with one peer when valid
+	peer netip.Addr
+
+	records chan captureRecord
+	// done is closed once the writer finished the file
+	done    chan struct{}
+	dropped atomic.Uint64
+
+	lock     sync.Mutex
+	f        *os.File
+	w        *bufio.Writer
+	written  int64
+	maxBytes int64
+	timer    *time.Timer
+	err      error
+	closed   bool
+}
+
+type captureRecord struct {
+	time time.Time
+	p    []byte
+}
+
+// StartCapture writes the unencrypted packets exchanged with peers to a pcap
+// file at path, until StopCapture, durationMs passes or the file would grow
+// past maxBytes, whichever comes first. vpnIp limits the capture to one peer,
+// traffic to an unsafe route counts for the peer routing it, empty captures
+// every peer. Only one capture runs at a time.
+func (n *Nebula) StartCapture(path string, maxBytes int, durationMs int, vpnIp string) error {
+	if maxBytes <= pcapHeaderLen {
+		return fmt.Errorf("maxBytes must be larger than %d", pcapHeaderLen)
+	}
+
+	if durationMs < 1 {
+		return errors.New("duration must be positive")
+	}
+
+	var peer netip.Addr
+	if vpnIp != "" {
+		var err error
+		peer, err = netip.ParseAddr(vpnIp)
+		if err != nil {
+			return errors.New("could not parse vpnIp")
+		}
+		peer = peer.Unmap()
+	}
+
+	if n.dev.capture.Load() != nil {
+		return errors.New("a capture is already running")
+	}
+
+	f, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0644)
+	if err != nil {
+		return err
+	}
+
+	c := &packetCapture{
+		dev:      n.dev,
+		peer:     peer,
+		records:  make(chan captureRecord, captureQueueSize),
+		done:     make(chan struct{}),
+		f:        f,
+		w:        bufio.NewWriterSize(f, 64*1024),
+		maxBytes: int64(maxBytes),
+	}
+
+	hdr := make([]byte, pcapHeaderLen)
+	binary.LittleEndian.PutUint32(hdr[0:4], 0xa1b2c3d4)
+	binary.LittleEndian.PutUint16(hdr[4:6], 2)
+	binary.LittleEndian.PutUint16(hdr[6:8], 4)
+	binary.LittleEndian.PutUint32(hdr[16:20], pcapSnapLen)
+	binary.LittleEndian.PutUint32(hdr[20:24], pcapLinkTypeRaw)
+	if _, err := c.w.Write(hdr); err != nil {
+		f.Close()
+		return err
+	}
+	c.written = pcapHeaderLen
+
+	if !n.dev.capture.CompareAndSwap(nil, c) {
+		f.Close()
+		return errors.New("a capture is already running")
+	}
+	n.dev.lastCapture.Store(c)
+
+	go c.run()
+
+	c.lock.Lock()
+	c.timer = time.AfterFunc(time.Duration(durationMs)*time.Millisecond, c.finish)
+	c.lock.Unlock()
+
+	n.l.Info("Started packet capture", "path", path, "maxBytes", maxBytes, "durationMs", durationMs, "vpnIp", vpnIp)
+	return nil
+}
+
+// StopCapture ends the running capture, if any, and returns whatever error the
+// capture ran into writing the file. A capture that already ended on its own
+// reports its error to the first StopCapture after it. Packets that came
+// faster than the file could take them were left out, the log counts them.
+func (n *Nebula) StopCapture() error {
+	c := n.dev.lastCapture.Swap(nil)
+	if c == nil {
+		return nil
+	}
+
+	err := c.close()
+	n.l.Info("Stopped packet capture", "dropped", c.dropped.Load(), "error", err)
+	return err
+}
+
+// write queues p, a packet exchanged with peer, for the writer
+func (c *packetCapture) write(peer netip.Addr, p []byte, now time.Time) {
+	if c.peer.IsValid() && peer != c.peer {
+		return
+	}
+
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	if c.closed {
+		return
+	}
+
+	size := pcapRecordHeaderLen + int64(len(p))
+	if c.written+size > c.maxBytes {
+		c.finishLocked()
+		return
+	}
+
+	select {
+	case c.records <- captureRecord{time: now, p: append([]byte(nil), p...)}:
+		c.written += size
+	default:
+		c.dropped.Add(1)
+	}
+}
+
+// run writes the queued records to the file until the capture finishes, then
+// flushes and closes it
+func (c *packetCapture) run() {
+	defer close(c.done)
+
+	var err error
+	for r := range c.records {
+		if err != nil {
+			continue
+		}
+
+		var hdr [pcapRecordHeaderLen]byte
+		binary.LittleEndian.PutUint32(hdr[0:4], uint32(r.time.Unix()))
+		binary.LittleEndian.PutUint32(hdr[4:8], uint32(r.time.Nanosecond()/1000))
+		binary.LittleEndian.PutUint32(hdr[8:12], uint32(len(r.p)))
+		binary.LittleEndian.PutUint32(hdr[12:16], uint32(len(r.p)))
+
+		_, err = c.w.Write(hdr[:])
+		if err == nil {
+			_, err = c.w.Write(r.p)
+		}
+		if err != nil {
+			// Drain what is queued, the capture is over
+			c.finish()
+		}
+	}
+
+	if ferr := c.w.Flush(); err == nil {
+		err = ferr
+	}
+	if cerr := c.f.Close(); err == nil {
+		err = cerr
+	}
+
+	c.lock.Lock()
+	c.err = err
+	c.lock.Unlock()
+}
+
+// finish detaches the capture from the device and tells the writer to wrap up
+// the file without waiting for it, it is safe to call more than once
+func (c *packetCapture) finish() {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	c.finishLocked()
+}
+
+func (c *packetCapture) finishLocked() {
+	c.dev.capture.CompareAndSwap(c, nil)
+	if c.closed {
+		return
+	}
+	c.closed = true
+
+	if c.timer != nil {
+		c.timer.Stop()
+	}
+	close(c.records)
+}
+
+// close finishes the capture and waits for the writer to be done with the
+// file, it is safe to call more than once
+func (c *packetCapture) close() error {
+	c.finish()
+	<-c.done
+
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	return c.err
+}
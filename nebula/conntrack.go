@@ -0,0 +1,499 @@
+package mobileNebula
+
+import (
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"net/netip"
+	"slices"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/slackhq/nebula/cert"
+	nc "github.com/slackhq/nebula/config"
+	"github.com/slackhq/nebula/firewall"
+)
+
+// maxFlows bounds the flow table, a flow that doesn't fit while every tracked
+// one is still live goes uncounted
+const maxFlows = 4096
+
+// flowTable tracks the flows crossing the tun device keyed the way nebula's
+// conntrack keys them, with the same timeouts. nebula's own conntrack isn't
+// reachable from the binding so this mirrors it from the inside packets, and
+// attributes every flow to the firewall rule that let it start.
+//
+// Tracking costs a lock and a map lookup per packet, so it is off unless
+// someone is looking, see StartFirewallTracking.
+//
+// Inbound packets reach the tun device only once nebula's firewall allowed
+// them. Outbound packets are seen before nebula checks them, an outbound flow
+// without a rule is one nebula drops and isn't tracked.
+type flowTable struct {
+	// enabled is checked on the packet path before anything else
+	enabled atomic.Bool
+
+	lock     sync.Mutex
+	flows    map[firewall.Packet]*flow
+	overflow uint64
+	timer    *time.Timer
+
+	tcpTimeout     time.Duration
+	udpTimeout     time.Duration
+	defaultTimeout time.Duration
+
+	policy  *firewallPolicy
+	certFor func(netip.Addr) cert.Certificate
+}
+
+type flow struct {
+	peer netip.Addr
+	// incoming is the direction of the packet that started the flow, it picks
+	// the rule table
+	incoming  bool
+	txPackets uint64
+	rxPackets uint64
+	lastSeen  time.Time
+
+	// rule let the flow start under policy, a reload re-attributes it
+	policy *firewallPolicy
+	rule   *firewallRule
+	// hadCert is set once the flow was matched knowing the peer cert
+	hadCert bool
+}
+
+func newFlowTable() *flowTable {
+	return &flowTable{
+		flows:          map[firewall.Packet]*flow{},
+		tcpTimeout:     12 * time.Minute,
+		udpTimeout:     3 * time.Minute,
+		defaultTimeout: 10 * time.Minute,
+	}
+}
+
+// configure picks up the conntrack timeouts, it is a reload callback
+func (t *flowTable) configure(c *nc.C) {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+	t.tcpTimeout = c.GetDuration("firewall.conntrack.tcp_timeout", 12*time.Minute)
+	t.udpTimeout = c.GetDuration("firewall.conntrack.udp_timeout", 3*time.Minute)
+	t.defaultTimeout = c.GetDuration("firewall.conntrack.default_timeout", 10*time.Minute)
+}
+
+// setPolicy swaps the rules flows are attributed to, certFor looks up the
+// cert of a peer by vpn addr
+func (t *flowTable) setPolicy(p *firewallPolicy, certFor func(netip.Addr) cert.Certificate) {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+	t.policy = p
+	t.certFor = certFor
+}
+
+func (t *flowTable) timeout(proto uint8) time.Duration {
+	switch proto {
+	case firewall.ProtoTCP:
+		return t.tcpTimeout
+	case firewall.ProtoUDP:
+		return t.udpTimeout
+	default:
+		return t.defaultTimeout
+	}
+}
+
+// seen counts the raw ip packet p exchanged with peer, incoming when the peer
+// sent it
+func (t *flowTable) seen(p []byte, incoming bool, peer netip.Addr, now time.Time) {
+	fp, ok := parseFlow(p, incoming)
+	if !ok {
+		return
+	}
+
+	t.lock.Lock()
+	defer t.lock.Unlock()
+
+	f := t.flows[fp]
+	if f == nil {
+		if len(t.flows) >= maxFlows {
+			t.evict(now)
+		}
+
+		f = &flow{peer: peer, incoming: incoming}
+		t.attributeIfStale(fp, f)
+		if f.rejected() {
+			return
+		}
+
+		if len(t.flows) >= maxFlows {
+			t.overflow++
+			return
+		}
+		t.flows[fp] = f
+
+	} else {
+		t.attributeIfStale(fp, f)
+		if f.rejected() {
+			delete(t.flows, fp)
+			return
+		}
+	}
+
+	if incoming {
+		f.rxPackets++
+	} else {
+		f.txPackets++
+	}
+	f.lastSeen = now
+}
+
+// start drops what was tracked before and tracks flows for d, rule hits count
+// from now on
+func (t *flowTable) start(d time.Duration) {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+
+	clear(t.flows)
+	t.overflow = 0
+	if t.policy != nil {
+		t.policy.resetHits()
+	}
+
+	if t.timer != nil {
+		t.timer.Stop()
+	}
+	t.timer = time.AfterFunc(d, t.stop)
+	t.enabled.Store(true)
+}
+
+// stop ends tracking and forgets the flows
+func (t *flowTable) stop() {
+	t.enabled.Store(false)
+
+	t.lock.Lock()
+	defer t.lock.Unlock()
+
+	clear(t.flows)
+	if t.timer != nil {
+		t.timer.Stop()
+		t.timer = nil
+	}
+}
+
+// rejected reports an outbound flow nebula's firewall drops, the peer cert was
+// known and still no rule allows it. A flow to a peer we have no tunnel with
+// yet isn't rejected, nor accepted until the cert is known.
+func (f *flow) rejected() bool {
+	return !f.incoming && f.rule == nil && f.hadCert
+}
+
+// accepted reports a flow nebula's firewall let through
+func (f *flow) accepted() bool {
+	return f.incoming || f.rule != nil
+}
+
+// attributeIfStale matches f against the current policy unless it already
+// was. A flow to a peer we have no tunnel with yet can't be matched against
+// cert rules, it is tried again until the cert is known. The lock must be
+// held.
+func (t *flowTable) attributeIfStale(fp firewall.Packet, f *flow) {
+	if t.policy != nil && (f.policy != t.policy || (f.rule == nil && !f.hadCert)) {
+		t.attribute(fp, f)
+	}
+}
+
+// attribute matches f against the current policy, the lock must be held
+func (t *flowTable) attribute(fp firewall.Packet, f *flow) {
+	var peer cert.Certificate
+	if t.certFor != nil {
+		peer = t.certFor(f.peer)
+	}
+
+	f.policy = t.policy
+	f.hadCert = peer != nil
+	f.rule = t.policy.match(fp, f.incoming, peer)
+	if f.rule != nil {
+		f.rule.hits.Add(1)
+	}
+}
+
+// evict drops the expired flows, the lock must be held
+func (t *flowTable) evict(now time.Time) {
+	for fp, f := range t.flows {
+		if now.Sub(f.lastSeen) > t.timeout(fp.Protocol) {
+			delete(t.flows, fp)
+		}
+	}
+}
+
+// parseFlow pulls the conntrack tuple out of a raw ip packet the way nebula
+// does, oriented from our side. Trailing fragments carry no ports and aren't
+// tracked, nor are ipv6 packets with extension headers.
+func parseFlow(p []byte, incoming bool) (firewall.Packet, bool) {
+	var fp firewall.Packet
+	var src, dst netip.Addr
+	var l4 []byte
+
+	if len(p) < 1 {
+		return fp, false
+	}
+
+	switch p[0] >> 4 {
+	case 4:
+		if len(p) < 20 {
+			return fp, false
+		}
+		ihl := int(p[0]&0x0f) << 2
+		if ihl < 20 || len(p) < ihl || binary.BigEndian.Uint16(p[6:8])&0x1fff != 0 {
+			return fp, false
+		}
+		fp.Protocol = p[9]
+		src, dst = netip.AddrFrom4([4]byte(p[12:16])), netip.AddrFrom4([4]byte(p[16:20]))
+		l4 = p[ihl:]
+
+	case 6:
+		if len(p) < 40 {
+			return fp, false
+		}
+		fp.Protocol = p[6]
+		src, dst = netip.AddrFrom16([16]byte(p[8:24])), netip.AddrFrom16([16]byte(p[24:40]))
+		l4 = p[40:]
+
+	default:
+		return fp, false
+	}
+
+	fp.LocalAddr, fp.RemoteAddr = src, dst
+	if incoming {
+		fp.LocalAddr, fp.RemoteAddr = dst, src
+	}
+
+	switch fp.Protocol {
+	case firewall.ProtoTCP, firewall.ProtoUDP:
+		if len(l4) < 4 {
+			return fp, false
+		}
+		srcPort, dstPort := binary.BigEndian.Uint16(l4[0:2]), binary.BigEndian.Uint16(l4[2:4])
+		fp.LocalPort, fp.RemotePort = srcPort, dstPort
+		if incoming {
+			fp.LocalPort, fp.RemotePort = dstPort, srcPort
+		}
+
+	case firewall.ProtoICMP, firewall.ProtoICMPv6:
+		// nebula tracks echoes by their identifier, either direction
+		if len(l4) < 6 {
+			return fp, false
+		}
+		fp.RemotePort = binary.BigEndian.Uint16(l4[4:6])
+
+	case 0, 43, 44, 50, 51, 60:
+		// ipv6 extension headers, nebula walks them and we don't
+		if p[0]>>4 == 6 {
+			return fp, false
+		}
+	}
+
+	return fp, true
+}
+
+type observedFlow struct {
+	Proto      string     `json:"proto"`
+	LocalAddr  netip.Addr `json:"localAddr"`
+	LocalPort  uint16     `json:"localPort"`
+	RemoteAddr netip.Addr `json:"remoteAddr"`
+	RemotePort uint16     `json:"remotePort"`
+	Peer       netip.Addr `json:"peer"`
+	Incoming   bool       `json:"incoming"`
+	TxPackets  uint64     `json:"txPackets"`
+	RxPackets  uint64     `json:"rxPackets"`
+	// ExpiresInMs is when the flow times out unless more traffic arrives
+	ExpiresInMs int64 `json:"expiresInMs"`
+	// Rule is the index of the rule that let the flow start in the inbound or
+	// outbound list, -1 when no rule does
+	Rule int `json:"rule"`
+}
+
+type firewallRuleState struct {
+	*firewallRule
+	// Hits counts the observed flows attributed to the rule since tracking
+	// started or the rules were last loaded, Active those still tracked.
+	// nebula keeps no per rule counters of its own.
+	Hits   uint64 `json:"hits"`
+	Active int    `json:"active"`
+}
+
+type firewallDropCounters struct {
+	LocalAddr  uint64 `json:"localAddr"`
+	RemoteAddr uint64 `json:"remoteAddr"`
+	NoRule     uint64 `json:"noRule"`
+}
+
+// firewallState is what the binding observed of the firewall, it is not
+// nebula's conntrack and can disagree with it. Only flows that started while
+// tracking was on are listed, and their rule is the binding's own attribution.
+type firewallState struct {
+	// Source is always "observed", so a reader of the JSON can't take the
+	// flows for nebula's conntrack table
+	Source string `json:"source"`
+	// Tracking is unset when no flows are tracked, ObservedFlows is then empty
+	// and rules have no hits
+	Tracking      bool           `json:"tracking"`
+	ObservedFlows []observedFlow `json:"observedFlows"`
+	// Untracked counts the flows that didn't fit in the table
+	Untracked uint64              `json:"untracked"`
+	Inbound   []firewallRuleState `json:"inbound"`
+	Outbound  []firewallRuleState `json:"outbound"`
+	// Drops are nebula's own counters. A drop is a packet no rule matched so
+	// there is no rule to count it against, nebula only counts it by reason.
+	Drops struct {
+		Incoming firewallDropCounters `json:"incoming"`
+		Outgoing firewallDropCounters `json:"outgoing"`
+	} `json:"drops"`
+}
+
+// StartFirewallTracking tracks the flows through the tunnel for FirewallState
+// until StopFirewallTracking or durationMs passes. Starting again restarts
+// the clock and forgets the flows and rule hits seen so far.
+func (n *Nebula) StartFirewallTracking(durationMs int) error {
+	if durationMs < 1 {
+		return errors.New("duration must be positive")
+	}
+
+	n.dev.flows.start(time.Duration(durationMs) * time.Millisecond)
+	n.l.Info("Started firewall flow tracking", "durationMs", durationMs)
+	return nil
+}
+
+// StopFirewallTracking stops tracking flows, if we were
+func (n *Nebula) StopFirewallTracking() {
+	if !n.dev.flows.enabled.Load() {
+		return
+	}
+
+	n.dev.flows.stop()
+	n.l.Info("Stopped firewall flow tracking")
+}
+
+// FirewallState returns a JSON snapshot of the flows the binding observed
+// through the tunnel and the firewall rules they hit, while
+// StartFirewallTracking is on. It is not a view of nebula's conntrack, which
+// the binding can't reach: flows are followed from the inside packets with
+// nebula's conntrack timeouts and attributed to the first rule in config order
+// that allows them. Flows nebula remembers from before tracking started and
+// outbound flows the firewall drops aren't listed. Only the drop counters are
+// nebula's own.
+func (n *Nebula) FirewallState() (string, error) {
+	state := n.dev.flows.state(time.Now())
+	state.Drops.Incoming = readFirewallDrops("incoming")
+	state.Drops.Outgoing = readFirewallDrops("outgoing")
+
+	b, err := json.Marshal(state)
+	if err != nil {
+		return "", err
+	}
+
+	return string(b), nil
+}
+
+// loadFirewall is a reload callback picking up the rules and conntrack
+// timeouts flows are tracked with
+func (n *Nebula) loadFirewall(c *nc.C) {
+	n.dev.flows.configure(c)
+
+	cfg, _ := normalizeYamlValue(c.Settings).(map[string]any)
+	p, err := newFirewallPolicy(cfg)
+	if err != nil {
+		// nebula refuses the same rules and keeps the ones it had, so do we
+		n.l.Warn("Failed to load firewall rules for flow tracking", "error", err)
+		return
+	}
+	n.dev.flows.setPolicy(p, n.c.GetCertByVpnIp)
+}
+
+func (t *flowTable) state(now time.Time) firewallState {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+
+	t.evict(now)
+
+	state := firewallState{
+		Source:        "observed",
+		Tracking:      t.enabled.Load(),
+		ObservedFlows: []observedFlow{},
+		Untracked:     t.overflow,
+		Inbound:       []firewallRuleState{},
+		Outbound:      []firewallRuleState{},
+	}
+
+	active := map[*firewallRule]int{}
+	for fp, f := range t.flows {
+		t.attributeIfStale(fp, f)
+		if f.rejected() {
+			delete(t.flows, fp)
+			continue
+		}
+		if !f.accepted() {
+			continue
+		}
+
+		e := observedFlow{
+			Proto:       protoName(fp.Protocol),
+			LocalAddr:   fp.LocalAddr,
+			LocalPort:   fp.LocalPort,
+			RemoteAddr:  fp.RemoteAddr,
+			RemotePort:  fp.RemotePort,
+			Peer:        f.peer,
+			Incoming:    f.incoming,
+			TxPackets:   f.txPackets,
+			RxPackets:   f.rxPackets,
+			ExpiresInMs: f.lastSeen.Add(t.timeout(fp.Protocol)).Sub(now).Milliseconds(),
+			Rule:        -1,
+		}
+		if f.rule != nil {
+			e.Rule = f.rule.Index
+			active[f.rule]++
+		}
+		state.ObservedFlows = append(state.ObservedFlows, e)
+	}
+
+	slices.SortFunc(state.ObservedFlows, func(a, b observedFlow) int {
+		if c := a.RemoteAddr.Compare(b.RemoteAddr); c != 0 {
+			return c
+		}
+		return int(a.LocalPort) - int(b.LocalPort)
+	})
+
+	if t.policy != nil {
+		for _, r := range t.policy.inbound {
+			state.Inbound = append(state.Inbound, firewallRuleState{firewallRule: r, Hits: r.hits.Load(), Active: active[r]})
+		}
+		for _, r := range t.policy.outbound {
+			state.Outbound = append(state.Outbound, firewallRuleState{firewallRule: r, Hits: r.hits.Load(), Active: active[r]})
+		}
+	}
+
+	return state
+}
+
+func readFirewallDrops(direction string) firewallDropCounters {
+	return firewallDropCounters{
+		LocalAddr:  sumCounters("firewall." + direction + ".dropped.local_addr"),
+		RemoteAddr: sumCounters("firewall." + direction + ".dropped.remote_addr"),
+		NoRule:     sumCounters("firewall." + direction + ".dropped.no_rule"),
+	}
+}
+
+func protoName(proto uint8) string {
+	switch proto {
+	case firewall.ProtoTCP:
+		return "tcp"
+	case firewall.ProtoUDP:
+		return "udp"
+	case firewall.ProtoICMP:
+		return "icmp"
+	case firewall.ProtoICMPv6:
+		return "icmpv6"
+	default:
+		return strconv.Itoa(int(proto))
+	}
+}
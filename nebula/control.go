@@ -10,6 +10,7 @@ import (
 	"runtime"
 	"runtime/debug"
 	"sync"
+	"time"
 
 	"github.com/slackhq/nebula"
 	nc "github.com/slackhq/nebula/config"
@@ -33,16 +34,70 @@ type Nebula struct {
 	c      *nebula.Control
 	l      *slog.Logger
 	config *nc.C
+	dev    *tunDevice
 
-	logFile      *os.File
+	// yamlConfig is the rendered config nebula is running, Reload diffs
+	// against it
+	yamlConfig string
+
+	tap    *logTap
+	logs   *logRing
+	events *eventSink
+	pins   *remotePins
+	dns    *dnsResponder
+	names  *lighthouseNames
+	relays *relayOverrides
+	trace  *startupTrace
+	stats  metricsSampler
+
+	handshakes *handshakeHistory
+
+	logFile      *rotatingFile
 	closeLogOnce sync.Once
 
+	// network is the last network RebindNetwork was told about
+	networkLock sync.Mutex
+	network     *networkInfo
+
+	// localRanges are the networks the current network has us prefer,
+	// addedRanges those of them we added to preferred_ranges. Both are
+	// guarded by lifecycle.
+	localRanges []netip.Prefix
+	addedRanges []netip.Prefix
+
+	// wakePeers are the peers Sleep closed tunnels to that Wake reopens
+	wakeLock  sync.Mutex
+	wakePeers []netip.Addr
+
 	// lifecycle serializes Stop and Reload so a reload cannot fire config
 	// callbacks, which reach raw fds via setsockopt and sendto, into an
 	// interface a platform stop has torn down
 	lifecycle sync.Mutex
+
+	// stopped is closed once nebula has fully stopped, the first Stop sets it.
+	// stopErr records that a Stop gave up waiting on it.
+	stopped chan struct{}
+	stopErr error
+
+	// cpuProfile is the file a cpu profile started from DebugCommand writes to
+	debugLock  sync.Mutex
+	cpuProfile *os.File
 }
 
+const (
+	defaultWakePeers  = 10
+	defaultWakeWindow = 10 * time.Minute
+	// maxWakePeers caps mobile_nebula.wake.max_peers, Wake handshakes with
+	// all of them at once
+	maxWakePeers = 100
+
+	// defaultStopTimeout bounds how long Stop waits on nebula, Android kills
+	// a VPN service whose thread hangs much longer
+	defaultStopTimeout = 5 * time.Second
+	// maxStackDump bounds the goroutine dump a stuck Stop logs
+	maxStackDump = 4 << 20
+)
+
 func init() {
 	// Reduces memory utilization according to https://twitter.com/felixge/status/1355846360562589696?s=20
 	runtime.MemProfileRate = 0
@@ -64,12 +119,15 @@ func NewNebula(configData string, key string, logFile string, tunFd int) (_ *Neb
 		}
 	}()
 
+	trace := newStartupTrace(time.Now())
 	yamlConfig, err := RenderConfig(configData, key)
 	if err != nil {
 		return nil, err
 	}
+	trace.since(phaseRenderConfig, trace.begin)
 
-	f, err := os.OpenFile(logFile, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0644)
+	phaseBegin := time.Now()
+	f, err := openRotatingFile(logFile)
 	if err != nil {
 		return nil, err
 	}
@@ -82,13 +140,21 @@ func NewNebula(configData string, key string, logFile string, tunFd int) (_ *Neb
 		}
 	}()
 
-	l := logging.NewLogger(f)
+	tap := newLogTap(logging.NewHandler(f))
+	logs := newLogRing()
+	tap.addObserver(logs.observe)
+	l := slog.New(tap)
+	trace.since(phaseLogging, phaseBegin)
 
+	phaseBegin = time.Now()
 	c := nc.NewC(l)
 	err = c.LoadString(yamlConfig)
 	if err != nil {
 		return nil, fmt.Errorf("failed to load config: %s", err)
 	}
+	trace.since(phaseConfigLoad, phaseBegin)
+
+	phaseBegin = time.Now()
 
 	// nebula.Main does not configure the logger from config, so apply
 	// logging.level/format ourselves and keep it in sync on reload.
@@ -101,21 +167,47 @@ func NewNebula(configData string, key string, logFile string, tunFd int) (_ *Neb
 		}
 	})
 
+	// The log file carries earlier connects too, mark where this one starts
+	// even when the level keeps info out of it
+	f.configure(c)
+	c.RegisterReloadCallback(f.configure)
+	trace.since(phaseLogging, phaseBegin)
+	tap.logAlways("Starting new session", slog.Int("pid", os.Getpid()))
+
+	var dev *tunDevice
 	devFactory := overlay.NewFdDeviceFromConfig(&tunFd)
 	wrappedFactory := func(c *nc.C, l *slog.Logger, vpnNetworks []netip.Prefix, routines int) (overlay.Device, error) {
 		// nebula owns the fd from here, even on failure it closes it along with
 		// the udp sockets it bound
 		fdHandedOff = true
-		return devFactory(c, l, vpnNetworks, routines)
+		begin := time.Now()
+		d, err := devFactory(c, l, vpnNetworks, routines)
+		if err != nil {
+			return nil, err
+		}
+
+		dev = newTunDevice(d)
+		trace.deviceCreated(begin)
+		return dev, nil
 	}
 
+	// The phases inside Main are told apart by what it logs at info, whatever
+	// the configured level
+	removeTrace := tap.addObserverAt(trace.observeMain, slog.LevelInfo)
+	phaseBegin = time.Now()
 	//TODO: inject our version
 	ctrl, err := nebula.Main(c, false, "", l, wrappedFactory)
+	removeTrace()
+	trace.mainReturned(phaseBegin, time.Now())
 	if err != nil {
+		trace.log(l, "Startup phases before failing")
 		return nil, logAndUnwrap("Failed to start", err, l)
 	}
 
-	return &Nebula{c: ctrl, l: l, config: c, logFile: f}, nil
+	n := &Nebula{c: ctrl, l: l, config: c, dev: dev, yamlConfig: yamlConfig, tap: tap, logs: logs, pins: newRemotePins(l), names: newLighthouseNames(dev.exchangeOverlayDNS), relays: newRelayOverrides(), trace: trace, handshakes: newHandshakeHistory(), logFile: f}
+	n.dns = newDNSResponder(l, dev, n.resolveCertName, n.networkDNSServers)
+	dev.setOutboundFilter(n.dns.intercept)
+	return n, nil
 }
 
 // logAndUnwrap logs err with its context fields attached and returns the inner
@@ -131,11 +223,75 @@ func logAndUnwrap(msg string, err error, l *slog.Logger) error {
 }
 
 // Start brings the tunnel up. A Nebula is single use, a Start after a Stop
-// returns an error, both platforms build a fresh instance per connect.
-func (n *Nebula) Start(cb ExitCallback) error {
+// returns an error, both platforms build a fresh instance per connect. events
+// is optional, when given it learns about tunnel lifecycle changes until the
+// instance stops.
+func (n *Nebula) Start(cb ExitCallback, events EventCallback) error {
+	if events != nil {
+		// Hook up before starting so the lighthouse handshakes nebula kicks off
+		// right away are reported, the sink winds down with nebula's context
+		n.events = newEventSink(events)
+		n.events.loadLighthouses(n.config)
+		n.config.RegisterReloadCallback(n.events.loadLighthouses)
+		n.tap.addObserverAt(n.events.observe, slog.LevelInfo)
+		go n.events.run(n.c.Context())
+	}
+
+	// Pins apply to tunnels as they come up, including the lighthouse tunnels
+	// nebula starts right away
+	n.pins.watch(n.tap)
+	n.pins.load(n.config)
+	n.config.RegisterReloadCallback(n.pins.load)
+	go n.pins.run(n.c.Context(), n.applyPin)
+
+	// nebula only logs a firewall drop at debug, behind a check that is only
+	// true for a forced observer when the configured level is higher
+	n.tap.addObserverAt(n.dev.traffic.observe, slog.LevelDebug)
+
+	n.handshakes.load(n.config)
+	n.config.RegisterReloadCallback(n.handshakes.load)
+	n.tap.addObserverAt(n.handshakes.observe, slog.LevelInfo)
+	go n.handshakes.run(n.c.Context(), n.relayOf)
+
+	// Flows are attributed to the firewall rule letting them through as they
+	// start
+	n.loadFirewall(n.config)
+	n.config.RegisterReloadCallback(n.loadFirewall)
+
+	// nebula starts handshaking with the lighthouses as it activates
+	if n.trace.awaitLighthouse(n.config) {
+		removeTrace := n.tap.addObserverAt(n.trace.observeHandshakes, slog.LevelInfo)
+		go func() {
+			select {
+			case <-n.trace.handshakeDone:
+				n.trace.log(n.l, "Startup phases through the first lighthouse handshake")
+			case <-n.c.Context().Done():
+			}
+			removeTrace()
+		}()
+	}
+
+	activateBegin := time.Now()
 	if err := n.c.Start(); err != nil {
 		return logAndUnwrap("Failed to start nebula", err, n.l)
 	}
+	n.trace.since(phaseActivate, activateBegin)
+
+	n.names.load(n.config)
+	n.config.RegisterReloadCallback(n.names.load)
+
+	// Local stats sample until nebula's context ends
+	n.stats.configure(n.c.Context(), n.config)
+	n.config.RegisterReloadCallback(func(c *nc.C) {
+		n.stats.configure(n.c.Context(), c)
+	})
+
+	// Queries reach the responder as nebula reads the tun, a config it can't
+	// use leaves DNS to the OS rather than failing the tunnel
+	n.configureDNS(n.config)
+	n.config.RegisterReloadCallback(n.configureDNS)
+
+	n.trace.log(n.l, "Startup phases")
 
 	// A fatal packet reader error stops nebula internally, tell the platform
 	// side so it can tear the tunnel down instead of blackholing traffic. A
@@ -157,12 +313,56 @@ func (n *Nebula) Start(cb ExitCallback) error {
 // when it returns the tunnel is fully stopped. Safe to call at any point in
 // the lifecycle, a Stop that lands before Start poisons the instance and that
 // Start will refuse to run.
-func (n *Nebula) Stop() {
+//
+// The wait is bounded by mobile_nebula.stop_timeout. Past it the goroutines
+// are dumped to the log, the tun device is closed under nebula and Stop
+// returns an error with nebula still winding down in the background, the
+// platform also gets an EventStopTimeout. A later Stop doesn't wait again, it
+// returns the same error until nebula is done.
+func (n *Nebula) Stop() error {
+	timedOut, err := n.stop()
+	if timedOut != nil {
+		// Platform code runs on this call, keep it clear of lifecycle
+		n.events.deliver(*timedOut)
+	}
+	return err
+}
+
+// stop is Stop under lifecycle, it returns the event to deliver when this
+// call is the one that gave up waiting
+func (n *Nebula) stop() (*event, error) {
 	n.lifecycle.Lock()
 	defer n.lifecycle.Unlock()
 
-	n.c.Stop()
-	_ = n.c.Wait()
+	if n.stopped == nil {
+		n.stopped = runInBackground(func() {
+			n.c.Stop()
+			_ = n.c.Wait()
+		})
+	}
+
+	// A stop that already timed out isn't waited on again
+	var timedOut *event
+	if n.stopErr == nil {
+		timeout := n.config.GetDuration("mobile_nebula.stop_timeout", defaultStopTimeout)
+		if timeout <= 0 {
+			timeout = defaultStopTimeout
+		}
+
+		select {
+		case <-n.stopped:
+		case <-time.After(timeout):
+			n.stopErr = fmt.Errorf("nebula did not stop within %s, the tunnel was forced closed", timeout)
+			n.forceStop(timeout)
+			timedOut = &event{Type: EventStopTimeout, Reason: n.stopErr.Error()}
+		}
+	}
+
+	// A running capture would otherwise hold its file open until it times out
+	if n.dev != nil {
+		_ = n.StopCapture()
+	}
+	n.stopCPUProfile()
 
 	// The instance is single use and fully stopped, release the log file
 	// deterministically instead of leaving it to a GC finalizer, the Android
@@ -170,6 +370,57 @@ func (n *Nebula) Stop() {
 	n.closeLogOnce.Do(func() {
 		_ = n.logFile.Close()
 	})
+
+	if n.stopErr != nil {
+		select {
+		case <-n.stopped:
+		default:
+			return timedOut, n.stopErr
+		}
+	}
+	return timedOut, nil
+}
+
+// forceStop handles a Stop that outlived timeout, most likely a packet reader
+// wedged somewhere closing the tun didn't reach. What we can reach is closed,
+// the udp sockets belong to nebula and stay open until its stop completes.
+func (n *Nebula) forceStop(timeout time.Duration) {
+	n.l.Error("Nebula did not stop in time, forcing the tunnel closed", "timeout", timeout, "goroutines", goroutineStacks())
+
+	// Both are safe to close twice, nebula may still get to them
+	if n.dev != nil {
+		_ = n.dev.Close()
+	}
+}
+
+// running reports whether nebula is started and no Stop has begun, callers
+// hold lifecycle. A Stop that timed out leaves nebula's own state locked up,
+// it is not asked.
+func (n *Nebula) running() bool {
+	return n.stopped == nil && n.c.State() == nebula.StateStarted
+}
+
+// runInBackground runs f on its own goroutine, the returned channel is closed
+// once it returns
+func runInBackground(f func()) chan struct{} {
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		f()
+	}()
+	return done
+}
+
+// goroutineStacks returns the stacks of every goroutine, up to maxStackDump
+func goroutineStacks() string {
+	buf := make([]byte, 64<<10)
+	for {
+		n := runtime.Stack(buf, true)
+		if n < len(buf) || len(buf) >= maxStackDump {
+			return string(buf[:n])
+		}
+		buf = make([]byte, 2*len(buf))
+	}
 }
 
 func (n *Nebula) Rebind(reason string) {
@@ -177,27 +428,64 @@ func (n *Nebula) Rebind(reason string) {
 	// call from a network change handler racing a stop
 	n.l.Debug("Rebinding UDP listener and updating lighthouses", "reason", reason)
 	n.c.RebindUDPServer()
+	n.events.emit(event{Type: EventRebind, Reason: reason})
 }
 
-func (n *Nebula) Reload(configData string, key string) error {
+// Reload applies a new site config to the running tunnel and returns a JSON
+// report of the config sections that changed. Some changes only take effect
+// on a fresh connect, the report lists them and the platform decides whether
+// to reconnect. A config nebula can't fully apply is rolled back and returned
+// as an error.
+func (n *Nebula) Reload(configData string, key string) (string, error) {
 	yamlConfig, err := RenderConfig(configData, key)
 	if err != nil {
-		return err
+		return "", err
 	}
 
 	n.lifecycle.Lock()
 	defer n.lifecycle.Unlock()
 
+	// Tunnels forced onto a relay stay there
+	yamlConfig, commitRelays, err := n.relays.apply(yamlConfig)
+	if err != nil {
+		return "", err
+	}
+
+	// So do the local networks the current network prefers
+	yamlConfig, addedRanges, err := editPreferredRanges(yamlConfig, nil, n.localRanges)
+	if err != nil {
+		return "", err
+	}
+
+	report, err := diffConfigs(n.yamlConfig, yamlConfig)
+	if err != nil {
+		return "", fmt.Errorf("failed to compare configs: %s", err)
+	}
+
 	// Don't fire reload callbacks into an interface that is coming down, the
 	// iOS DN updater timer can land a reload around a stop. The lock makes the
 	// check atomic with a platform stop, a nebula internal fatal stop can still
 	// slip a reload into its teardown but those callbacks only see closed fds.
-	if n.c.State() != nebula.StateStarted {
-		return nil
+	if n.running() {
+		n.l.Info("Reloading Nebula", "changed", report.Changed, "reconnect", report.Reconnect)
+		if err := n.applyReload(yamlConfig); err != nil {
+			return "", err
+		}
+		commitRelays()
+		n.addedRanges = addedRanges
+
+		report.Applied = true
+		for _, r := range report.RestartRequired {
+			n.l.Warn("Config change needs a reconnect to take effect", "section", r.Section, "reason", r.Reason)
+		}
+	}
+
+	b, err := json.Marshal(report)
+	if err != nil {
+		return "", err
 	}
 
-	n.l.Info("Reloading Nebula")
-	return n.config.ReloadConfigString(yamlConfig)
+	return string(b), nil
 }
 
 func (n *Nebula) ListHostmap(pending bool) (string, error) {
@@ -240,7 +528,21 @@ func (n *Nebula) CloseTunnel(vpnIp string) bool {
 		return false
 	}
 
-	return n.c.CloseTunnel(netVpnIp, false)
+	// Grab the cert name while the tunnel still exists, nebula doesn't log a
+	// tunnel closed from here
+	var certName string
+	if n.events != nil {
+		if c := n.c.GetCertByVpnIp(netVpnIp); c != nil {
+			certName = c.Name()
+		}
+	}
+
+	if !n.c.CloseTunnel(netVpnIp, false) {
+		return false
+	}
+
+	n.events.tunnelDown([]netip.Addr{netVpnIp}, certName, "closed")
+	return true
 }
 
 func (n *Nebula) SetRemoteForTunnel(vpnIp string, addr string) (string, error) {
@@ -262,8 +564,86 @@ func (n *Nebula) SetRemoteForTunnel(vpnIp string, addr string) (string, error) {
 	return string(b), nil
 }
 
+// Sleep closes every tunnel except the ones to lighthouses, remembering the
+// peers that carried traffic recently so Wake can bring them back. The peers
+// remembered are set under mobile_nebula.wake, max_peers bounds how many and
+// recent_traffic how far back traffic counts.
 func (n *Nebula) Sleep() {
+	// nebula doesn't say which tunnels it closed, remember them up front
+	hosts := n.c.ListHostmapHosts(false)
+	n.rememberForWake(hosts)
+
 	if closed := n.c.CloseAllTunnels(true); closed > 0 {
 		n.l.Info("Sleep called, closed non lighthouse tunnels", "tunnels", closed)
 	}
+
+	if n.events == nil {
+		return
+	}
+
+	for _, h := range hosts {
+		if n.events.isLighthouse(h.VpnAddrs) {
+			continue
+		}
+
+		var certName string
+		if h.Cert != nil {
+			certName = h.Cert.Name()
+		}
+		n.events.tunnelDown(h.VpnAddrs, certName, "sleep")
+	}
+}
+
+// Wake handshakes again with the peers Sleep remembered, so the first packet
+// to them after wake doesn't wait on a handshake. Peers that already have a
+// tunnel again are left alone.
+func (n *Nebula) Wake() {
+	n.wakeLock.Lock()
+	peers := n.wakePeers
+	n.wakePeers = nil
+	n.wakeLock.Unlock()
+
+	var started []netip.Addr
+	for _, addr := range peers {
+		if n.c.GetHostInfoByVpnAddr(addr, false) != nil {
+			continue
+		}
+		n.c.CreateTunnel(addr)
+		started = append(started, addr)
+	}
+
+	if len(started) > 0 {
+		n.l.Info("Wake called, handshaking recently used tunnels", "vpnAddrs", started)
+	}
+}
+
+// rememberForWake keeps the peers among hosts that saw recent traffic
+func (n *Nebula) rememberForWake(hosts []nebula.ControlHostInfo) {
+	limit := min(n.config.GetInt("mobile_nebula.wake.max_peers", defaultWakePeers), maxWakePeers)
+	window := n.config.GetDuration("mobile_nebula.wake.recent_traffic", defaultWakeWindow)
+
+	var peers []netip.Addr
+	if limit > 0 && n.dev != nil {
+		tunnels := map[netip.Addr]struct{}{}
+		for _, h := range hosts {
+			for _, addr := range h.VpnAddrs {
+				tunnels[addr] = struct{}{}
+			}
+		}
+
+		// Traffic behind an unsafe route counts for its gateway, anything not
+		// matching a tunnel never reached a peer
+		for _, addr := range n.dev.traffic.recentPeers(window) {
+			if len(peers) == limit {
+				break
+			}
+			if _, ok := tunnels[addr]; ok {
+				peers = append(peers, addr)
+			}
+		}
+	}
+
+	n.wakeLock.Lock()
+	n.wakePeers = peers
+	n.wakeLock.Unlock()
 }
@@ -0,0 +1,768 @@
+package mobileNebula
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"net/netip"
+	"os"
+	"path/filepath"
+	"runtime"
+	"runtime/pprof"
+	"slices"
+	"strconv"
+	"strings"
+
+	"github.com/anmitsu/go-shlex"
+	"github.com/slackhq/nebula"
+	"github.com/slackhq/nebula/cert"
+	"github.com/slackhq/nebula/logging"
+	"github.com/slackhq/nebula/sshd"
+)
+
+// DebugCommand runs one of nebula's sshd debug commands in-process and
+// returns what it printed, so the app's console doesn't need sshd listening
+// on the phone. cmdline is split like a shell would, an empty one or help
+// lists the commands and -h shows the flags of one. Problems a command
+// reports about its arguments are part of its output, an error means the
+// command couldn't run at all.
+func (n *Nebula) DebugCommand(cmdline string) (string, error) {
+	if n.c.State() != nebula.StateStarted {
+		return "", errors.New("nebula is not running")
+	}
+
+	return runDebugCommand(n.debugCommands(), cmdline)
+}
+
+func runDebugCommand(commands []*sshd.Command, cmdline string) (string, error) {
+	args, err := shlex.Split(cmdline, true)
+	if err != nil {
+		return "", fmt.Errorf("failed to parse command: %w", err)
+	}
+
+	var buf bytes.Buffer
+	w := &debugWriter{w: &buf}
+
+	if len(args) == 0 || args[0] == "help" {
+		err := debugHelp(commands, args, w)
+		return buf.String(), err
+	}
+
+	i := slices.IndexFunc(commands, func(c *sshd.Command) bool { return c.Name == args[0] })
+	if i < 0 {
+		return "", fmt.Errorf("unknown command %s, run help for the list", args[0])
+	}
+	c := commands[i]
+
+	if slices.Contains(args[1:], "-h") || slices.Contains(args[1:], "-help") {
+		err := debugHelp(commands, []string{"help", c.Name}, w)
+		return buf.String(), err
+	}
+
+	var fs any
+	args = args[1:]
+	if c.Flags != nil {
+		var fl *flag.FlagSet
+		fl, fs = c.Flags()
+		fl.SetOutput(w.GetWriter())
+		if err := fl.Parse(args); err != nil {
+			// The flag set printed what was wrong along with the usage
+			return "", fmt.Errorf("%s: %s", err, strings.TrimSpace(buf.String()))
+		}
+		args = fl.Args()
+	}
+
+	if err := c.Callback(fs, args, w); err != nil {
+		return buf.String(), err
+	}
+	return buf.String(), nil
+}
+
+// debugHelp prints the command list, or the help of args[1] when given,
+// the way nebula's sshd does
+func debugHelp(commands []*sshd.Command, args []string, w sshd.StringWriter) error {
+	if len(args) < 2 {
+		lines := make([]string, 0, len(commands))
+		for _, c := range commands {
+			lines = append(lines, fmt.Sprintf("%s - %s", c.Name, c.ShortDescription))
+		}
+		slices.Sort(lines)
+		return w.Write("Available commands:\n" + strings.Join(lines, "\n") + "\n")
+	}
+
+	i := slices.IndexFunc(commands, func(c *sshd.Command) bool { return c.Name == args[1] })
+	if i < 0 {
+		return w.WriteLine("Command not available " + args[1])
+	}
+
+	c := commands[i]
+	if err := w.WriteLine(fmt.Sprintf("%s - %s", c.Name, c.ShortDescription)); err != nil {
+		return err
+	}
+	if c.Help != "" {
+		if err := w.WriteLine("  " + c.Help); err != nil {
+			return err
+		}
+	}
+	if c.Flags != nil {
+		fl, _ := c.Flags()
+		fl.SetOutput(w.GetWriter())
+		fl.PrintDefaults()
+	}
+	return nil
+}
+
+type debugWriter struct {
+	w io.Writer
+}
+
+func (w *debugWriter) WriteLine(s string) error {
+	return w.Write(s + "\n")
+}
+
+func (w *debugWriter) Write(s string) error {
+	_, err := io.WriteString(w.w, s)
+	return err
+}
+
+func (w *debugWriter) WriteBytes(b []byte) error {
+	_, err := w.w.Write(b)
+	return err
+}
+
+func (w *debugWriter) GetWriter() io.Writer {
+	return w.w
+}
+
+type debugHostmapFlags struct {
+	json    bool
+	pretty  bool
+	byIndex bool
+}
+
+// debugOutputFlags are the output flags of the print commands, each only
+// registers the ones it supports
+type debugOutputFlags struct {
+	json   bool
+	pretty bool
+	raw    bool
+}
+
+type debugChangeRemoteFlags struct {
+	address string
+}
+
+type debugCloseTunnelFlags struct {
+	localOnly bool
+}
+
+// debugCommands is nebula's sshd command set rebuilt on the Control API,
+// nebula binds its own to the unexported Interface. Names, flags and output
+// match sshd so its docs apply.
+func (n *Nebula) debugCommands() []*sshd.Command {
+	hostmapFlags := func() (*flag.FlagSet, any) {
+		fl := flag.NewFlagSet("", flag.ContinueOnError)
+		s := debugHostmapFlags{}
+		fl.BoolVar(&s.json, "json", false, "outputs as json with more information")
+		fl.BoolVar(&s.pretty, "pretty", false, "pretty prints json, assumes -json")
+		fl.BoolVar(&s.byIndex, "by-index", false, "gets all hosts in the hostmap from the index table")
+		return fl, &s
+	}
+	prettyFlags := func() (*flag.FlagSet, any) {
+		fl := flag.NewFlagSet("", flag.ContinueOnError)
+		s := debugOutputFlags{}
+		fl.BoolVar(&s.pretty, "pretty", false, "pretty prints json")
+		return fl, &s
+	}
+
+	return []*sshd.Command{
+		{
+			Name:             "list-hostmap",
+			ShortDescription: "List all known previously connected hosts",
+			Flags:            hostmapFlags,
+			Callback: func(fs any, a []string, w sshd.StringWriter) error {
+				return n.debugListHostmap(false, fs.(*debugHostmapFlags), w)
+			},
+		},
+		{
+			Name:             "list-pending-hostmap",
+			ShortDescription: "List all handshaking hosts",
+			Flags:            hostmapFlags,
+			Callback: func(fs any, a []string, w sshd.StringWriter) error {
+				return n.debugListHostmap(true, fs.(*debugHostmapFlags), w)
+			},
+		},
+		{
+			Name:             "list-lighthouse-addrmap",
+			ShortDescription: "List all lighthouse map entries",
+			Help:             "Lists the entries of the hosts in the hostmaps, lighthouse.hosts and static_host_map. The lighthouses are queried for those without one, like query-lighthouse.",
+			Flags: func() (*flag.FlagSet, any) {
+				fl := flag.NewFlagSet("", flag.ContinueOnError)
+				s := debugOutputFlags{}
+				fl.BoolVar(&s.json, "json", false, "outputs as json with more information")
+				fl.BoolVar(&s.pretty, "pretty", false, "pretty prints json, assumes -json")
+				return fl, &s
+			},
+			Callback: func(fs any, a []string, w sshd.StringWriter) error {
+				return n.debugListLighthouseMap(fs.(*debugOutputFlags), w)
+			},
+		},
+		{
+			Name:             "reload",
+			ShortDescription: "Reapplies the running config, undoing changes made from the console",
+			Callback: func(fs any, a []string, w sshd.StringWriter) error {
+				return n.debugReload(w)
+			},
+		},
+		{
+			Name:             "start-cpu-profile",
+			ShortDescription: "Starts a cpu profile and write output to the provided file, ex: `cpu-profile.pb.gz`",
+			Callback: func(fs any, a []string, w sshd.StringWriter) error {
+				return n.debugStartCPUProfile(a, w)
+			},
+		},
+		{
+			Name:             "stop-cpu-profile",
+			ShortDescription: "Stops a cpu profile and writes output to the previously provided file",
+			Callback: func(fs any, a []string, w sshd.StringWriter) error {
+				n.stopCPUProfile()
+				return w.WriteLine("If a CPU profile was running it is now stopped")
+			},
+		},
+		{
+			Name:             "save-heap-profile",
+			ShortDescription: "Saves a heap profile to the provided path, ex: `heap-profile.pb.gz`",
+			Help:             "Heap sampling is off to keep memory down, the profile only has what a raised runtime.MemProfileRate sampled.",
+			Callback: func(fs any, a []string, w sshd.StringWriter) error {
+				return n.debugSaveProfile("heap", a, w)
+			},
+		},
+		{
+			Name:             "mutex-profile-fraction",
+			ShortDescription: "Gets or sets runtime.SetMutexProfileFraction",
+			Callback: func(fs any, a []string, w sshd.StringWriter) error {
+				if len(a) == 0 {
+					return w.WriteLine(fmt.Sprintf("Current value: %d", runtime.SetMutexProfileFraction(-1)))
+				}
+				rate, err := strconv.Atoi(a[0])
+				if err != nil {
+					return w.WriteLine(fmt.Sprintf("Invalid argument: %s", a[0]))
+				}
+				old := runtime.SetMutexProfileFraction(rate)
+				return w.WriteLine(fmt.Sprintf("New value: %d. Old value: %d", rate, old))
+			},
+		},
+		{
+			Name:             "save-mutex-profile",
+			ShortDescription: "Saves a mutex profile to the provided path, ex: `mutex-profile.pb.gz`",
+			Callback: func(fs any, a []string, w sshd.StringWriter) error {
+				return n.debugSaveProfile("mutex", a, w)
+			},
+		},
+		{
+			Name:             "log-level",
+			ShortDescription: "Gets or sets the current log level",
+			Callback: func(fs any, a []string, w sshd.StringWriter) error {
+				if len(a) > 0 {
+					level, err := logging.ParseLevel(strings.ToLower(a[0]))
+					if err != nil {
+						return w.WriteLine(fmt.Sprintf("Unknown log level %s. Possible log levels: trace, debug, info, warn, error", a[0]))
+					}
+					n.tap.SetLevel(level)
+				}
+				return w.WriteLine(fmt.Sprintf("Log level is: %s", logging.LevelName(n.tap.GetLevel())))
+			},
+		},
+		{
+			Name:             "log-format",
+			ShortDescription: "Gets or sets the current log format",
+			Callback: func(fs any, a []string, w sshd.StringWriter) error {
+				if len(a) > 0 {
+					if err := n.tap.SetFormat(strings.ToLower(a[0])); err != nil {
+						return w.WriteLine(err.Error())
+					}
+				}
+				return w.WriteLine(fmt.Sprintf("Log format is: %s", n.tap.GetFormat()))
+			},
+		},
+		{
+			Name:             "version",
+			ShortDescription: "Prints the currently running version of nebula",
+			Callback: func(fs any, a []string, w sshd.StringWriter) error {
+				return w.WriteLine(buildInfo().NebulaVersion)
+			},
+		},
+		{
+			Name:             "device-info",
+			ShortDescription: "Prints information about the network device.",
+			Flags: func() (*flag.FlagSet, any) {
+				fl := flag.NewFlagSet("", flag.ContinueOnError)
+				s := debugOutputFlags{}
+				fl.BoolVar(&s.json, "json", false, "outputs as json with more information")
+				fl.BoolVar(&s.pretty, "pretty", false, "pretty prints json, assumes -json")
+				return fl, &s
+			},
+			Callback: func(fs any, a []string, w sshd.StringWriter) error {
+				return n.debugDeviceInfo(fs.(*debugOutputFlags), w)
+			},
+		},
+		{
+			Name:             "print-cert",
+			ShortDescription: "Prints the current certificate being used or the certificate for the provided vpn addr",
+			Flags: func() (*flag.FlagSet, any) {
+				fl := flag.NewFlagSet("", flag.ContinueOnError)
+				s := debugOutputFlags{}
+				fl.BoolVar(&s.json, "json", false, "outputs as json")
+				fl.BoolVar(&s.pretty, "pretty", false, "pretty prints json, assumes -json")
+				fl.BoolVar(&s.raw, "raw", false, "raw prints the PEM encoded certificate, not compatible with -json or -pretty")
+				return fl, &s
+			},
+			Callback: func(fs any, a []string, w sshd.StringWriter) error {
+				return n.debugPrintCert(fs.(*debugOutputFlags), a, w)
+			},
+		},
+		{
+			Name:             "print-tunnel",
+			ShortDescription: "Prints json details about a tunnel for the provided vpn addr",
+			Flags:            prettyFlags,
+			Callback: func(fs any, a []string, w sshd.StringWriter) error {
+				vpnAddr, ok := debugVpnAddr(a, w)
+				if !ok {
+					return nil
+				}
+				hi := n.c.PrintTunnel(vpnAddr)
+				if hi == nil {
+					return w.WriteLine(fmt.Sprintf("Could not find tunnel for vpn addr: %v", a[0]))
+				}
+				return debugJSON(hi, fs.(*debugOutputFlags).pretty, w)
+			},
+		},
+		{
+			Name:             "print-relays",
+			ShortDescription: "Prints json details about all relay info",
+			Help:             "Relay indexes and states aren't reachable in-process, only the peers each relay carries are printed.",
+			Flags:            prettyFlags,
+			Callback: func(fs any, a []string, w sshd.StringWriter) error {
+				return debugJSON(debugRelays(n.c.ListHostmapHosts(false)), fs.(*debugOutputFlags).pretty, w)
+			},
+		},
+		{
+			Name:             "change-remote",
+			ShortDescription: "Changes the remote address used in the tunnel for the provided vpn addr",
+			Flags: func() (*flag.FlagSet, any) {
+				fl := flag.NewFlagSet("", flag.ContinueOnError)
+				s := debugChangeRemoteFlags{}
+				fl.StringVar(&s.address, "address", "", "The new remote address, ip:port")
+				return fl, &s
+			},
+			Callback: func(fs any, a []string, w sshd.StringWriter) error {
+				vpnAddr, ok := debugVpnAddr(a, w)
+				if !ok {
+					return nil
+				}
+				address := fs.(*debugChangeRemoteFlags).address
+				if address == "" {
+					return w.WriteLine("No address was provided")
+				}
+				addr, err := netip.ParseAddrPort(address)
+				if err != nil {
+					return w.WriteLine("Address could not be parsed")
+				}
+				if n.c.SetRemoteForTunnel(vpnAddr, addr) == nil {
+					return w.WriteLine(fmt.Sprintf("Could not find tunnel for vpn address: %v", a[0]))
+				}
+				return w.WriteLine("Changed")
+			},
+		},
+		{
+			Name:             "close-tunnel",
+			ShortDescription: "Closes a tunnel for the provided vpn addr",
+			Flags: func() (*flag.FlagSet, any) {
+				fl := flag.NewFlagSet("", flag.ContinueOnError)
+				s := debugCloseTunnelFlags{}
+				fl.BoolVar(&s.localOnly, "local-only", false, "Disables notifying the remote that the tunnel is shutting down")
+				return fl, &s
+			},
+			Callback: func(fs any, a []string, w sshd.StringWriter) error {
+				vpnAddr, ok := debugVpnAddr(a, w)
+				if !ok {
+					return nil
+				}
+				if !n.c.CloseTunnel(vpnAddr, fs.(*debugCloseTunnelFlags).localOnly) {
+					return w.WriteLine(fmt.Sprintf("Could not find tunnel for vpn address: %v", a[0]))
+				}
+				return w.WriteLine("Closed")
+			},
+		},
+		{
+			Name:             "create-tunnel",
+			ShortDescription: "Creates a tunnel for the provided vpn address",
+			Help:             "The lighthouses will be queried for real addresses, pin a remote to handshake on a known one.",
+			Callback: func(fs any, a []string, w sshd.StringWriter) error {
+				vpnAddr, ok := debugVpnAddr(a, w)
+				if !ok {
+					return nil
+				}
+				if n.c.GetHostInfoByVpnAddr(vpnAddr, false) != nil {
+					return w.WriteLine("Tunnel already exists")
+				}
+				if n.c.GetHostInfoByVpnAddr(vpnAddr, true) != nil {
+					return w.WriteLine("Tunnel already handshaking")
+				}
+				n.c.CreateTunnel(vpnAddr)
+				return w.WriteLine("Created")
+			},
+		},
+		{
+			Name:             "query-lighthouse",
+			ShortDescription: "Query the lighthouses for the provided vpn address",
+			Help:             "This command is asynchronous. Only currently known udp addresses will be printed.",
+			Callback: func(fs any, a []string, w sshd.StringWriter) error {
+				vpnAddr, ok := debugVpnAddr(a, w)
+				if !ok {
+					return nil
+				}
+				return json.NewEncoder(w.GetWriter()).Encode(n.c.QueryLighthouse(vpnAddr))
+			},
+		},
+	}
+}
+
+// debugVpnAddr parses the vpn addr a command takes as its first argument,
+// telling the user when it can't
+func debugVpnAddr(a []string, w sshd.StringWriter) (netip.Addr, bool) {
+	if len(a) == 0 {
+		_ = w.WriteLine("No vpn address was provided")
+		return netip.Addr{}, false
+	}
+
+	addr, err := netip.ParseAddr(a[0])
+	if err != nil {
+		_ = w.WriteLine(fmt.Sprintf("The provided vpn address could not be parsed: %s", a[0]))
+		return netip.Addr{}, false
+	}
+	return addr.Unmap(), true
+}
+
+func debugJSON(v any, pretty bool, w sshd.StringWriter) error {
+	enc := json.NewEncoder(w.GetWriter())
+	if pretty {
+		enc.SetIndent("", "    ")
+	}
+	return enc.Encode(v)
+}
+
+func (n *Nebula) debugListHostmap(pending bool, fs *debugHostmapFlags, w sshd.StringWriter) error {
+	var hosts []nebula.ControlHostInfo
+	if fs.byIndex {
+		hosts = n.c.ListHostmapIndexes(pending)
+	} else {
+		hosts = n.c.ListHostmapHosts(pending)
+	}
+	slices.SortFunc(hosts, func(a, b nebula.ControlHostInfo) int {
+		return firstAddr(a.VpnAddrs).Compare(firstAddr(b.VpnAddrs))
+	})
+
+	if fs.json || fs.pretty {
+		return debugJSON(hosts, fs.pretty, w)
+	}
+
+	for _, h := range hosts {
+		if err := w.WriteLine(fmt.Sprintf("%s: %s", h.VpnAddrs, h.RemoteAddrs)); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+type debugLighthouseEntry struct {
+	VpnAddr string           `json:"vpnAddr"`
+	Addrs   *nebula.CacheMap `json:"addrs"`
+}
+
+// debugListLighthouseMap prints the lighthouse cache of every host we know
+// of. nebula doesn't expose its address map, so it is read one host at a time.
+func (n *Nebula) debugListLighthouseMap(fs *debugOutputFlags, w sshd.StringWriter) error {
+	entries := lighthouseMapEntries(n.knownVpnAddrs(), n.c.QueryLighthouse)
+
+	if fs.json || fs.pretty {
+		return debugJSON(entries, fs.pretty, w)
+	}
+
+	for _, e := range entries {
+		b, err := json.Marshal(e.Addrs)
+		if err != nil {
+			return err
+		}
+		if err := w.WriteLine(fmt.Sprintf("%s: %s", e.VpnAddr, b)); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// knownVpnAddrs returns the vpn addrs of the hosts in the hostmaps and those
+// the config names
+func (n *Nebula) knownVpnAddrs() []netip.Addr {
+	var addrs []netip.Addr
+	for _, pending := range []bool{false, true} {
+		for _, h := range n.c.ListHostmapHosts(pending) {
+			addrs = append(addrs, h.VpnAddrs...)
+		}
+	}
+
+	addrs = append(addrs, configuredAddrs(n.config, "lighthouse.hosts")...)
+	for k := range n.config.GetMap("static_host_map", map[string]any{}) {
+		if addr, err := netip.ParseAddr(fmt.Sprint(k)); err == nil {
+			addrs = append(addrs, addr.Unmap())
+		}
+	}
+	return addrs
+}
+
+// lighthouseMapEntries looks up each of addrs once, those query has nothing
+// for are left out. Entries are sorted like nebula sorts its address map.
+func lighthouseMapEntries(addrs []netip.Addr, query func(netip.Addr) *nebula.CacheMap) []debugLighthouseEntry {
+	entries := []debugLighthouseEntry{}
+	seen := map[netip.Addr]bool{}
+	for _, addr := range addrs {
+		if seen[addr] {
+			continue
+		}
+		seen[addr] = true
+
+		if cm := query(addr); cm != nil {
+			entries = append(entries, debugLighthouseEntry{VpnAddr: addr.String(), Addrs: cm})
+		}
+	}
+
+	slices.SortFunc(entries, func(a, b debugLighthouseEntry) int {
+		return strings.Compare(a.VpnAddr, b.VpnAddr)
+	})
+	return entries
+}
+
+type debugRelayFor struct {
+	Type           string
+	PeerAddr       netip.Addr
+	RelayedThrough []netip.Addr
+}
+
+type debugRelayOutput struct {
+	NebulaAddr    netip.Addr
+	RelayForAddrs []debugRelayFor
+}
+
+type debugRelaysOutput struct {
+	Relays []*debugRelayOutput
+}
+
+// debugRelays rebuilds nebula's print-relays output from the hostmap. A host
+// relaying for peers is a relay, the peer is reached through it when the
+// peer's tunnel lists it, otherwise we forward for the peer.
+func debugRelays(hosts []nebula.ControlHostInfo) debugRelaysOutput {
+	byAddr := map[netip.Addr]nebula.ControlHostInfo{}
+	for _, h := range hosts {
+		for _, addr := range h.VpnAddrs {
+			byAddr[addr] = h
+		}
+	}
+
+	var out debugRelaysOutput
+	for _, h := range hosts {
+		if len(h.CurrentRelaysThroughMe) == 0 || len(h.VpnAddrs) == 0 {
+			continue
+		}
+
+		ro := &debugRelayOutput{NebulaAddr: h.VpnAddrs[0]}
+		for _, peer := range h.CurrentRelaysThroughMe {
+			rf := debugRelayFor{Type: "forwarding", PeerAddr: peer}
+			if p, ok := byAddr[peer]; ok {
+				rf.RelayedThrough = p.CurrentRelaysToMe
+				if slices.Contains(p.CurrentRelaysToMe, h.VpnAddrs[0]) {
+					rf.Type = "terminal"
+				}
+			}
+			ro.RelayForAddrs = append(ro.RelayForAddrs, rf)
+		}
+		out.Relays = append(out.Relays, ro)
+	}
+
+	slices.SortFunc(out.Relays, func(a, b *debugRelayOutput) int {
+		return a.NebulaAddr.Compare(b.NebulaAddr)
+	})
+	return out
+}
+
+// debugReload reapplies the config nebula is running, there is no file to
+// read it from again
+func (n *Nebula) debugReload(w sshd.StringWriter) error {
+	if err := w.WriteLine("Reloading config"); err != nil {
+		return err
+	}
+
+	n.lifecycle.Lock()
+	defer n.lifecycle.Unlock()
+	if !n.running() {
+		return errors.New("nebula is not running")
+	}
+	return n.applyReload(n.yamlConfig)
+}
+
+func (n *Nebula) debugDeviceInfo(fs *debugOutputFlags, w sshd.StringWriter) error {
+	data := struct {
+		Name string         `json:"name"`
+		Cidr []netip.Prefix `json:"cidr"`
+	}{
+		Name: n.dev.Name(),
+		Cidr: slices.Clone(n.dev.Networks()),
+	}
+
+	if fs.json || fs.pretty {
+		return debugJSON(data, fs.pretty, w)
+	}
+	return w.WriteLine(fmt.Sprintf("name=%v cidr=%v", data.Name, data.Cidr))
+}
+
+func (n *Nebula) debugPrintCert(fs *debugOutputFlags, a []string, w sshd.StringWriter) error {
+	var c cert.Certificate
+	if len(a) == 0 {
+		if networks := n.dev.Networks(); len(networks) > 0 {
+			c = n.c.GetCertByVpnIp(networks[0].Addr())
+		}
+		if c == nil {
+			return errors.New("no certificate is loaded")
+		}
+	} else {
+		vpnAddr, ok := debugVpnAddr(a, w)
+		if !ok {
+			return nil
+		}
+		hi := n.c.GetHostInfoByVpnAddr(vpnAddr, false)
+		if hi == nil || hi.Cert == nil {
+			return w.WriteLine(fmt.Sprintf("Could not find tunnel for vpn addr: %v", a[0]))
+		}
+		c = hi.Cert
+	}
+
+	switch {
+	case fs.json || fs.pretty:
+		b, err := c.MarshalJSON()
+		if err != nil {
+			return err
+		}
+		if fs.pretty {
+			var buf bytes.Buffer
+			if err := json.Indent(&buf, b, "", "    "); err != nil {
+				return err
+			}
+			b = buf.Bytes()
+		}
+		return w.WriteBytes(b)
+	case fs.raw:
+		b, err := c.MarshalPEM()
+		if err != nil {
+			return err
+		}
+		return w.WriteBytes(b)
+	default:
+		return w.WriteLine(c.String())
+	}
+}
+
+// debugFilePath resolves where a command writes a file. Like sshd, paths are
+// kept inside sshd.sandbox_dir, which defaults to a dir next to the log file
+// since the app can't write to the OS temp dir everywhere.
+func (n *Nebula) debugFilePath(name string) (string, error) {
+	dir := n.config.GetString("sshd.sandbox_dir", filepath.Join(filepath.Dir(n.logFile.path), "nebula-debug"))
+	if dir == "" {
+		return name, nil
+	}
+
+	path := name
+	if !filepath.IsAbs(path) {
+		path = filepath.Join(dir, path)
+	}
+	path = filepath.Clean(path)
+	if !strings.HasPrefix(path, filepath.Clean(dir)+string(filepath.Separator)) {
+		return "", fmt.Errorf("path %q is outside the sandbox directory %q", name, dir)
+	}
+
+	if err := os.MkdirAll(dir, 0o755); err != nil {
+		return "", err
+	}
+	return path, nil
+}
+
+func (n *Nebula) debugStartCPUProfile(a []string, w sshd.StringWriter) error {
+	if len(a) == 0 {
+		return w.WriteLine("No path to write profile provided")
+	}
+
+	path, err := n.debugFilePath(a[0])
+	if err != nil {
+		return w.WriteLine(err.Error())
+	}
+
+	n.debugLock.Lock()
+	defer n.debugLock.Unlock()
+	if n.cpuProfile != nil {
+		return w.WriteLine("A cpu profile is already running, issue stop-cpu-profile first")
+	}
+
+	f, err := os.Create(path)
+	if err != nil {
+		return w.WriteLine(fmt.Sprintf("Unable to create profile file: %s", err))
+	}
+	if err := pprof.StartCPUProfile(f); err != nil {
+		_ = f.Close()
+		return w.WriteLine(fmt.Sprintf("Unable to start cpu profile: %s", err))
+	}
+
+	n.cpuProfile = f
+	return w.WriteLine(fmt.Sprintf("Started cpu profile, issue stop-cpu-profile to write the output to %s", path))
+}
+
+// stopCPUProfile finishes a cpu profile started from the console, if any
+func (n *Nebula) stopCPUProfile() {
+	n.debugLock.Lock()
+	defer n.debugLock.Unlock()
+	if n.cpuProfile == nil {
+		return
+	}
+
+	pprof.StopCPUProfile()
+	_ = n.cpuProfile.Close()
+	n.cpuProfile = nil
+}
+
+// debugSaveProfile writes the named runtime/pprof profile to the file a[0]
+func (n *Nebula) debugSaveProfile(name string, a []string, w sshd.StringWriter) error {
+	if len(a) == 0 {
+		return w.WriteLine("No path to write profile provided")
+	}
+
+	path, err := n.debugFilePath(a[0])
+	if err != nil {
+		return w.WriteLine(err.Error())
+	}
+
+	p := pprof.Lookup(name)
+	if p == nil {
+		return w.WriteLine(fmt.Sprintf("Unable to get pprof.Lookup(%q)", name))
+	}
+
+	f, err := os.Create(path)
+	if err != nil {
+		return w.WriteLine(fmt.Sprintf("Unable to create profile file: %s", err))
+	}
+	defer f.Close()
+
+	if err := p.WriteTo(f, 0); err != nil {
+		return w.WriteLine(fmt.Sprintf("Unable to write profile: %s", err))
+	}
+	return w.WriteLine(fmt.Sprintf("Profile created at %s", path))
+}
@@ -0,0 +1,351 @@
+package mobileNebula
+
+import (
+	"io"
+	"net/netip"
+	"os"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/slackhq/nebula/overlay"
+)
+
+// injectQueueSize bounds the packets the binding can have waiting for nebula
+const injectQueueSize = 64
+
+// tunDevice wraps the platform tun device so the binding sees every inside
+// packet crossing it. Reads are packets the OS hands nebula to send to a peer,
+// writes are packets nebula decrypted from a peer for the OS. The hooks run on
+// nebula's packet path, keep them cheap.
+//
+// The binding can also originate its own inside packets, see inject. A read
+// on the platform fd can't be interrupted, so reads happen on a pump goroutine
+// and Read picks between what it read and what was injected.
+type tunDevice struct {
+	overlay.Device
+	traffic *trafficStats
+	flows   *flowTable
+
+	reads    chan tunRead
+	injected chan []byte
+	bufs     sync.Pool
+	pumpOnce sync.Once
+
+	closed    chan struct{}
+	closeOnce sync.Once
+
+	filterLock sync.Mutex
+	filters    atomic.Pointer[[]*inboundFilter]
+	intercept  atomic.Pointer[outboundFilter]
+
+	capture atomic.Pointer[packetCapture]
+	// lastCapture is the capture StopCapture reports on, it outlives a capture
+	// that ended on its own until StopCapture picks up its error
+	lastCapture atomic.Pointer[packetCapture]
+}
+
+// tunRead is a packet, or the error that ended them, read by the pump
+type tunRead struct {
+	buf *[]byte
+	n   int
+	err error
+}
+
+// inboundFilter sees every packet nebula is about to hand the OS, returning
+// true consumes it and the OS never sees it. Used to catch the answers to
+// packets the binding injected.
+type inboundFilter func(p []byte) bool
+
+// outboundFilter sees every packet the OS hands nebula, returning true
+// consumes it and nebula never sees it. Used to answer the packets the OS
+// sends the binding itself.
+type outboundFilter func(p []byte) bool
+
+func newTunDevice(d overlay.Device) *tunDevice {
+	return &tunDevice{
+		Device:   d,
+		traffic:  newTrafficStats(),
+		flows:    newFlowTable(),
+		reads:    make(chan tunRead),
+		injected: make(chan []byte, injectQueueSize),
+		closed:   make(chan struct{}),
+	}
+}
+
+func (d *tunDevice) Read(p []byte) (int, error) {
+	// nebula always reads with the same buffer size, size the pump buffers off
+	// the first one
+	d.pumpOnce.Do(func() {
+		size := len(p)
+		d.bufs.New = func() any {
+			b := make([]byte, size)
+			return &b
+		}
+		go d.pump()
+	})
+
+	for {
+		select {
+		case r := <-d.reads:
+			n := copy(p, (*r.buf)[:r.n])
+			d.bufs.Put(r.buf)
+			if r.err == nil && d.intercepted(p[:n]) {
+				continue
+			}
+			if n > 0 {
+				d.outbound(p[:n])
+			}
+			return n, r.err
+
+		case pkt := <-d.injected:
+			n := copy(p, pkt)
+			d.outbound(p[:n])
+			return n, nil
+
+		case <-d.closed:
+			return 0, os.ErrClosed
+		}
+	}
+}
+
+// pump reads from the platform device until it errors, closing the device
+// unblocks it
+func (d *tunDevice) pump() {
+	for {
+		buf := d.bufs.Get().(*[]byte)
+		n, err := d.Device.Read(*buf)
+
+		select {
+		case d.reads <- tunRead{buf: buf, n: n, err: err}:
+		case <-d.closed:
+			return
+		}
+
+		if err != nil {
+			return
+		}
+	}
+}
+
+func (d *tunDevice) Write(p []byte) (int, error) {
+	if d.filter(p) {
+		d.inbound(p)
+		return len(p), nil
+	}
+
+	n, err := d.Device.Write(p)
+	if n > 0 {
+		d.inbound(p[:n])
+	}
+	return n, err
+}
+
+func (d *tunDevice) Close() error {
+	d.closeOnce.Do(func() {
+		close(d.closed)
+	})
+	return d.Device.Close()
+}
+
+func (d *tunDevice) NewMultiQueueReader() (io.ReadWriteCloser, error) {
+	q, err := d.Device.NewMultiQueueReader()
+	if err != nil {
+		return nil, err
+	}
+	return &tunQueue{ReadWriteCloser: q, d: d}, nil
+}
+
+// inject hands nebula an inside packet as if the OS had sent it, nebula routes
+// it like any other, handshaking with the peer first if it has to
+func (d *tunDevice) inject(p []byte) error {
+	select {
+	case d.injected <- p:
+		return nil
+	case <-d.closed:
+		return os.ErrClosed
+	}
+}
+
+// addInboundFilter registers f until the returned func is called
+func (d *tunDevice) addInboundFilter(f inboundFilter) func() {
+	fp := &f
+
+	d.filterLock.Lock()
+	defer d.filterLock.Unlock()
+
+	var filters []*inboundFilter
+	if cur := d.filters.Load(); cur != nil {
+		filters = append(filters, *cur...)
+	}
+	filters = append(filters, fp)
+	d.filters.Store(&filters)
+
+	return func() {
+		d.filterLock.Lock()
+		defer d.filterLock.Unlock()
+
+		var remaining []*inboundFilter
+		for _, o := range *d.filters.Load() {
+			if o != fp {
+				remaining = append(remaining, o)
+			}
+		}
+		d.filters.Store(&remaining)
+	}
+}
+
+// setOutboundFilter makes f see every packet the OS hands nebula from now on
+func (d *tunDevice) setOutboundFilter(f outboundFilter) {
+	d.intercept.Store(&f)
+}
+
+// intercepted reports whether the outbound filter consumed p
+func (d *tunDevice) intercepted(p []byte) bool {
+	f := d.intercept.Load()
+	return f != nil && len(p) > 0 && (*f)(p)
+}
+
+// filter reports whether an inbound filter consumed p
+func (d *tunDevice) filter(p []byte) bool {
+	filters := d.filters.Load()
+	if filters == nil {
+		return false
+	}
+
+	for _, f := range *filters {
+		if (*f)(p) {
+			return true
+		}
+	}
+	return false
+}
+
+// outbound sees a packet headed out to a peer
+func (d *tunDevice) outbound(p []byte) {
+	_, dst, ok := packetAddrs(p)
+	if !ok {
+		return
+	}
+
+	now := time.Now()
+	peer := d.peerFor(dst)
+	d.traffic.offered(peer, len(p), now)
+	if d.flows.enabled.Load() {
+		d.flows.seen(p, false, peer, now)
+	}
+	if c := d.capture.Load(); c != nil {
+		c.write(peer, p, now)
+	}
+}
+
+// inbound sees a packet a peer sent us
+func (d *tunDevice) inbound(p []byte) {
+	src, _, ok := packetAddrs(p)
+	if !ok {
+		return
+	}
+
+	now := time.Now()
+	peer := d.peerFor(src)
+	d.traffic.received(peer, len(p), now)
+	if d.flows.enabled.Load() {
+		d.flows.seen(p, true, peer, now)
+	}
+	if c := d.capture.Load(); c != nil {
+		c.write(peer, p, now)
+	}
+}
+
+// peerFor maps an inside address to the vpn addr of the peer carrying it, an
+// address in one of our networks is the peer itself and one behind an unsafe
+// route belongs to its gateway. Anything else is carried by no peer and maps
+// to the zero addr.
+func (d *tunDevice) peerFor(addr netip.Addr) netip.Addr {
+	for _, n := range d.Networks() {
+		if n.Contains(addr) {
+			return addr
+		}
+	}
+
+	if gateways := d.RoutesFor(addr); len(gateways) > 0 {
+		return gateways[0].Addr()
+	}
+	return netip.Addr{}
+}
+
+// overlayRoutes reports whether the OS sends traffic to addr into the tun,
+// it is in one of our networks or behind an unsafe route
+func (d *tunDevice) overlayRoutes(addr netip.Addr) bool {
+	for _, n := range d.Networks() {
+		if n.Contains(addr) {
+			return true
+		}
+	}
+	return len(d.RoutesFor(addr)) > 0
+}
+
+// localAddrFor returns our vpn addr in the same family as addr
+func (d *tunDevice) localAddrFor(addr netip.Addr) (netip.Addr, bool) {
+	for _, n := range d.Networks() {
+		if n.Addr().Is4() == addr.Is4() {
+			return n.Addr(), true
+		}
+	}
+	return netip.Addr{}, false
+}
+
+// tunQueue is a multiqueue reader of a tunDevice, it feeds the same hooks but
+// never carries injected packets
+type tunQueue struct {
+	io.ReadWriteCloser
+	d *tunDevice
+}
+
+func (q *tunQueue) Read(p []byte) (int, error) {
+	for {
+		n, err := q.ReadWriteCloser.Read(p)
+		if err == nil && q.d.intercepted(p[:n]) {
+			continue
+		}
+		if n > 0 {
+			q.d.outbound(p[:n])
+		}
+		return n, err
+	}
+}
+
+func (q *tunQueue) Write(p []byte) (int, error) {
+	if q.d.filter(p) {
+		q.d.inbound(p)
+		return len(p), nil
+	}
+
+	n, err := q.ReadWriteCloser.Write(p)
+	if n > 0 {
+		q.d.inbound(p[:n])
+	}
+	return n, err
+}
+
+// packetAddrs pulls the source and destination out of a raw ip packet
+func packetAddrs(p []byte) (src netip.Addr, dst netip.Addr, ok bool) {
+	if len(p) < 1 {
+		return src, dst, false
+	}
+
+	switch p[0] >> 4 {
+	case 4:
+		if len(p) < 20 {
+			return src, dst, false
+		}
+		return netip.AddrFrom4([4]byte(p[12:16])), netip.AddrFrom4([4]byte(p[16:20])), true
+	case 6:
+		if len(p) < 40 {
+			return src, dst, false
+		}
+		return netip.AddrFrom16([16]byte(p[8:24])), netip.AddrFrom16([16]byte(p[24:40])), true
+	default:
+		return src, dst, false
+	}
+}
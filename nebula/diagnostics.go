@@ -0,0 +1,253 @@
+package mobileNebula
+
+import (
+	"archive/zip"
+	"encoding/json"
+	"fmt"
+	"os"
+	"runtime"
+	"runtime/debug"
+	"strings"
+	"time"
+
+	"gopkg.in/yaml.v2"
+)
+
+const redacted = "[redacted]"
+
+// DiagnosticBundle writes a zip support bundle for a site that isn't running
+// to outPath. It holds the rendered config and site with private keys
+// redacted, the site certs, the log files and build info. configData is the
+// site JSON RenderConfig takes and logFile the path handed to NewNebula.
+func DiagnosticBundle(configData string, logFile string, outPath string) error {
+	return writeBundle(outPath, func(b *bundle) {
+		b.addSite(configData)
+		b.addLogFiles(logFile)
+	})
+}
+
+// DiagnosticBundle writes a zip support bundle for the running site to
+// outPath. On top of the rendered config, certs, logs and build info the
+// stopped bundle has it carries the hostmaps, indexes, traffic stats and the
+// recent log records kept in memory. The site JSON isn't known here, use the
+// package level DiagnosticBundle from a stopped site for that.
+func (n *Nebula) DiagnosticBundle(outPath string) error {
+	n.lifecycle.Lock()
+	yamlConfig := n.yamlConfig
+	n.lifecycle.Unlock()
+
+	return writeBundle(outPath, func(b *bundle) {
+		b.addConfig(yamlConfig)
+
+		b.addJSON("hostmap.json", n.c.ListHostmapHosts(false))
+		b.addJSON("hostmap-pending.json", n.c.ListHostmapHosts(true))
+		b.addJSON("indexes.json", n.c.ListHostmapIndexes(false))
+		b.addJSON("indexes-pending.json", n.c.ListHostmapIndexes(true))
+		b.addResult("tunnel-stats.json", n.TunnelStats)
+		b.addResult("recent-logs.json", func() (string, error) {
+			return n.RecentLogs(0, "", 0)
+		})
+
+		b.addLogFiles(n.logFile.path)
+	})
+}
+
+// bundle collects the files of a support bundle. A piece that can't be
+// gathered is noted in errors.txt instead of failing the whole bundle, a
+// partial bundle is still more than the helpdesk would have otherwise.
+type bundle struct {
+	zw   *zip.Writer
+	errs []string
+	err  error
+}
+
+func writeBundle(outPath string, fill func(b *bundle)) (reterr error) {
+	f, err := os.Create(outPath)
+	if err != nil {
+		return err
+	}
+
+	defer func() {
+		if err := f.Close(); err != nil && reterr == nil {
+			reterr = err
+		}
+		if reterr != nil {
+			_ = os.Remove(outPath)
+		}
+	}()
+
+	b := &bundle{zw: zip.NewWriter(f)}
+	b.addJSON("build.json", buildInfo())
+	fill(b)
+
+	if len(b.errs) > 0 {
+		b.add("errors.txt", []byte(strings.Join(b.errs, "\n")+"\n"))
+	}
+
+	if b.err != nil {
+		return fmt.Errorf("failed to write bundle: %s", b.err)
+	}
+	return b.zw.Close()
+}
+
+func (b *bundle) add(name string, data []byte) {
+	if b.err != nil {
+		return
+	}
+
+	w, err := b.zw.CreateHeader(&zip.FileHeader{Name: name, Method: zip.Deflate, Modified: time.Now()})
+	if err != nil {
+		b.err = err
+		return
+	}
+	_, b.err = w.Write(data)
+}
+
+func (b *bundle) fail(name string, err error) {
+	b.errs = append(b.errs, fmt.Sprintf("%s: %s", name, err))
+}
+
+func (b *bundle) addJSON(name string, v any) {
+	data, err := json.MarshalIndent(v, "", "  ")
+	if err != nil {
+		b.fail(name, err)
+		return
+	}
+	b.add(name, data)
+}
+
+func (b *bundle) addResult(name string, f func() (string, error)) {
+	s, err := f()
+	if err != nil {
+		b.fail(name, err)
+		return
+	}
+	b.add(name, []byte(s))
+}
+
+// addSite adds the redacted site JSON along with everything addConfig adds
+func (b *bundle) addSite(configData string) {
+	var s map[string]any
+	if err := json.Unmarshal([]byte(configData), &s); err != nil {
+		b.fail("site.json", err)
+		return
+	}
+
+	if _, ok := s["key"]; ok {
+		s["key"] = redacted
+	}
+	if creds, ok := s["dnCredentials"].(map[string]any); ok {
+		creds["privateKey"] = redacted
+	}
+	// config.yaml carries the raw config, rendered and redacted
+	delete(s, "rawConfig")
+	b.addJSON("site.json", s)
+
+	yamlConfig, err := RenderConfig(configData, redacted)
+	if err != nil {
+		b.fail("config.yaml", err)
+		return
+	}
+	b.addConfig(yamlConfig)
+}
+
+// addConfig adds the redacted config and the certs it carries
+func (b *bundle) addConfig(yamlConfig string) {
+	cfg, err := yamlToJSONMap([]byte(yamlConfig))
+	if err != nil {
+		b.fail("config.yaml", err)
+		return
+	}
+
+	out, err := yaml.Marshal(redactConfig(cfg))
+	if err != nil {
+		b.fail("config.yaml", err)
+	} else {
+		b.add("config.yaml", out)
+	}
+
+	pki, _ := cfg["pki"].(map[string]any)
+	for _, k := range []string{"cert", "ca"} {
+		name := fmt.Sprintf("pki-%s.json", k)
+		raw, _ := pki[k].(string)
+		if raw == "" {
+			b.fail(name, fmt.Errorf("no pki.%s in config", k))
+			continue
+		}
+		b.addResult(name, func() (string, error) {
+			return ParseCerts(raw)
+		})
+	}
+}
+
+// addLogFiles adds the log file and every rotated one next to it
+func (b *bundle) addLogFiles(logFile string) {
+	for i := 0; ; i++ {
+		path := logFile
+		if i > 0 {
+			path = fmt.Sprintf("%s.%d", logFile, i)
+		}
+
+		data, err := os.ReadFile(path)
+		if os.IsNotExist(err) {
+			if i == 0 {
+				b.fail("log", err)
+			}
+			return
+		}
+		if err != nil {
+			b.fail(path, err)
+			return
+		}
+
+		name := "log"
+		if i > 0 {
+			name = fmt.Sprintf("log.%d", i)
+		}
+		b.add(name, data)
+	}
+}
+
+// redactConfig blanks the private keys out of a nebula config map
+func redactConfig(cfg map[string]any) map[string]any {
+	if pki, ok := cfg["pki"].(map[string]any); ok {
+		if _, ok := pki["key"]; ok {
+			pki["key"] = redacted
+		}
+	}
+	if sshd, ok := cfg["sshd"].(map[string]any); ok {
+		if _, ok := sshd["host_key"]; ok {
+			sshd["host_key"] = redacted
+		}
+	}
+	return cfg
+}
+
+type bundleBuildInfo struct {
+	Time          time.Time `json:"time"`
+	GoVersion     string    `json:"goVersion"`
+	OS            string    `json:"os"`
+	Arch          string    `json:"arch"`
+	NebulaVersion string    `json:"nebulaVersion"`
+	Modules       []string  `json:"modules"`
+}
+
+func buildInfo() bundleBuildInfo {
+	bi := bundleBuildInfo{
+		Time:      time.Now(),
+		GoVersion: runtime.Version(),
+		OS:        runtime.GOOS,
+		Arch:      runtime.GOARCH,
+		Modules:   []string{},
+	}
+
+	if info, ok := debug.ReadBuildInfo(); ok {
+		for _, dep := range info.Deps {
+			if dep.Path == "github.com/slackhq/nebula" {
+				bi.NebulaVersion = dep.Version
+			}
+			bi.Modules = append(bi.Modules, dep.Path+" "+dep.Version)
+		}
+	}
+	return bi
+}
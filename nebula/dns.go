@@ -0,0 +1,360 @@
+package mobileNebula
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net"
+	"net/netip"
+	"slices"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"github.com/miekg/dns"
+	nc "github.com/slackhq/nebula/config"
+)
+
+const (
+	// dnsAnswerTTL keeps OS caches short, a peer can renew its cert with new
+	// addresses at any time
+	dnsAnswerTTL = 30
+	// dnsUpstreamTimeout bounds each upstream a forwarded query is tried on
+	dnsUpstreamTimeout = 2 * time.Second
+	// defaultDNSResolver is the address the OS is handed as its resolver.
+	// Nothing listens on it, it is routed into the tun and answered there.
+	// Link local so it can't collide with a vpn network or an unsafe route.
+	defaultDNSResolver = "169.254.53.53"
+	// dnsQueriesInFlight bounds the queries being answered at once, a query
+	// past it is dropped and the OS asks again
+	dnsQueriesInFlight = 64
+)
+
+// dnsResponderConfig is mobile_nebula.dns, an invalid resolver means disabled
+type dnsResponderConfig struct {
+	resolver netip.Addr
+	// domain is the fqdn answered locally, names under it are cert names
+	domain string
+	// upstreams are the site's resolvers, the underlay's are used without them
+	upstreams []netip.AddrPort
+}
+
+// dnsResponder is a split dns server on a virtual resolver addr. It answers A
+// and AAAA queries for <cert name>.<domain> and forwards every other query to
+// the upstreams. The OS only ever asks port 53, which the app can't bind, so
+// rather than listen the responder picks the queries off the tun before nebula
+// sees them and writes the answers back to the OS. It only serves udp, like
+// nebula's own lighthouse responder.
+type dnsResponder struct {
+	l   *slog.Logger
+	dev *tunDevice
+	// resolve returns the vpn addrs of the host holding the cert name,
+	// errNameNotFound when there is no such host
+	resolve func(name string) ([]netip.Addr, error)
+	// fallback returns the underlay's resolvers, for sites without upstreams
+	fallback func() []netip.AddrPort
+	client   *dns.Client
+	cfg      atomic.Pointer[dnsResponderConfig]
+	inFlight chan struct{}
+}
+
+func newDNSResponder(l *slog.Logger, dev *tunDevice, resolve func(name string) ([]netip.Addr, error), fallback func() []netip.AddrPort) *dnsResponder {
+	return &dnsResponder{
+		l:        l,
+		dev:      dev,
+		resolve:  resolve,
+		fallback: fallback,
+		client:   &dns.Client{Net: "udp", Timeout: dnsUpstreamTimeout},
+		inFlight: make(chan struct{}, dnsQueriesInFlight),
+	}
+}
+
+// configureDNS is a reload callback picking up mobile_nebula.dns. A config it
+// can't use leaves the responder as it was, its error log fails the reload.
+func (n *Nebula) configureDNS(c *nc.C) {
+	cfg, err := loadDNSConfig(c)
+	if err != nil {
+		n.l.Error("Failed to configure the DNS responder", "error", err)
+		return
+	}
+	n.dns.apply(cfg)
+}
+
+// loadDNSConfig reads mobile_nebula.dns. Without upstreams of its own the
+// responder forwards to dns_resolvers, the site's resolvers for the OS.
+func loadDNSConfig(c *nc.C) (dnsResponderConfig, error) {
+	if !c.GetBool("mobile_nebula.dns.enabled", false) {
+		return dnsResponderConfig{}, nil
+	}
+
+	resolver, err := netip.ParseAddr(c.GetString("mobile_nebula.dns.resolver", defaultDNSResolver))
+	if err != nil {
+		return dnsResponderConfig{}, fmt.Errorf("mobile_nebula.dns.resolver: %w", err)
+	}
+	resolver = resolver.Unmap()
+
+	var upstreams []netip.AddrPort
+	for _, u := range c.GetStringSlice("mobile_nebula.dns.upstreams", c.GetStringSlice("mobile_nebula.dns_resolvers", []string{})) {
+		ap, err := netip.ParseAddrPort(u)
+		if err != nil {
+			addr, aerr := netip.ParseAddr(u)
+			if aerr != nil {
+				return dnsResponderConfig{}, fmt.Errorf("mobile_nebula.dns.upstreams: %w", err)
+			}
+			ap = netip.AddrPortFrom(addr, 53)
+		}
+		ap = netip.AddrPortFrom(ap.Addr().Unmap(), ap.Port())
+		if ap.Addr() != resolver {
+			upstreams = append(upstreams, ap)
+		}
+	}
+
+	return dnsResponderConfig{
+		resolver:  resolver,
+		domain:    dns.Fqdn(strings.ToLower(strings.Trim(c.GetString("mobile_nebula.dns.domain", "nebula"), "."))),
+		upstreams: upstreams,
+	}, nil
+}
+
+// apply swaps in cfg, queries already being answered finish on the old one
+func (r *dnsResponder) apply(cfg dnsResponderConfig) {
+	old := r.cfg.Swap(&cfg)
+	switch {
+	case cfg.resolver.IsValid() && (old == nil || old.resolver != cfg.resolver || old.domain != cfg.domain):
+		r.l.Info("Started DNS responder", "resolver", cfg.resolver, "domain", cfg.domain)
+	case !cfg.resolver.IsValid() && old != nil && old.resolver.IsValid():
+		r.l.Info("Stopped DNS responder")
+	}
+}
+
+// intercept is the tun's outboundFilter, it takes the packets the OS sends
+// the resolver addr. Queries are answered on their own goroutine, anything
+// else sent there is dropped, nebula has nowhere to send it.
+func (r *dnsResponder) intercept(p []byte) bool {
+	cfg := r.cfg.Load()
+	if cfg == nil || !cfg.resolver.IsValid() {
+		return false
+	}
+
+	if _, dst, ok := packetAddrs(p); !ok || dst.Unmap() != cfg.resolver {
+		return false
+	}
+
+	from, to, payload, ok := parseUDPPacket(p)
+	if !ok || to.Port() != 53 {
+		return true
+	}
+
+	select {
+	case r.inFlight <- struct{}{}:
+	default:
+		r.l.Debug("Dropping DNS query, too many in flight", "from", from)
+		return true
+	}
+
+	// p is nebula's read buffer, it is reused as soon as we return
+	payload = append([]byte(nil), payload...)
+	go func() {
+		defer func() { <-r.inFlight }()
+		r.serve(cfg, from, to, payload)
+	}()
+	return true
+}
+
+// serve answers the query in payload and writes the answer to the OS
+func (r *dnsResponder) serve(cfg *dnsResponderConfig, from, to netip.AddrPort, payload []byte) {
+	req := new(dns.Msg)
+	if err := req.Unpack(payload); err != nil {
+		return
+	}
+
+	resp := r.handle(cfg, req)
+	size := dns.MinMsgSize
+	if opt := req.IsEdns0(); opt != nil {
+		size = int(opt.UDPSize())
+	}
+	resp.Truncate(size)
+
+	b, err := resp.Pack()
+	if err != nil {
+		r.l.Debug("Failed to pack DNS answer", "error", err)
+		return
+	}
+
+	if _, err := r.dev.Device.Write(buildUDPPacket(to, from, b)); err != nil {
+		r.l.Debug("Failed to write DNS answer", "error", err)
+	}
+}
+
+// handle answers names under the overlay domain and forwards the rest
+func (r *dnsResponder) handle(cfg *dnsResponderConfig, req *dns.Msg) *dns.Msg {
+	if len(req.Question) == 1 && dns.IsSubDomain(cfg.domain, strings.ToLower(req.Question[0].Name)) {
+		return r.answer(req, cfg)
+	}
+
+	upstreams := cfg.upstreams
+	if len(upstreams) == 0 && r.fallback != nil {
+		upstreams = r.fallback()
+	}
+
+	for _, u := range upstreams {
+		resp, err := r.forward(req, u)
+		if err != nil {
+			r.l.Debug("DNS upstream failed", "upstream", u, "error", err)
+			continue
+		}
+		return resp
+	}
+
+	m := new(dns.Msg)
+	m.SetRcode(req, dns.RcodeServerFailure)
+	return m
+}
+
+// forward asks upstream, the app is excluded from its own vpn so an upstream
+// on the overlay is asked with injected packets instead of a socket
+func (r *dnsResponder) forward(req *dns.Msg, upstream netip.AddrPort) (*dns.Msg, error) {
+	if r.dev.overlayRoutes(upstream.Addr()) {
+		return r.dev.exchangeOverlayDNS(req, upstream, dnsUpstreamTimeout)
+	}
+	resp, _, err := r.client.Exchange(req, upstream.String())
+	return resp, err
+}
+
+// answer resolves a query under the overlay domain from cert names
+func (r *dnsResponder) answer(req *dns.Msg, cfg *dnsResponderConfig) *dns.Msg {
+	m := new(dns.Msg)
+	m.SetReply(req)
+	m.Authoritative = true
+
+	q := req.Question[0]
+	name := strings.TrimSuffix(strings.ToLower(q.Name), "."+cfg.domain)
+	if name == cfg.domain {
+		// The domain itself holds no records
+		return m
+	}
+
+	addrs, err := r.resolve(name)
+	if errors.Is(err, errNameNotFound) {
+		m.Rcode = dns.RcodeNameError
+		return m
+	}
+	if err != nil {
+		r.l.Debug("Failed to resolve cert name", "name", name, "error", err)
+		m.Rcode = dns.RcodeServerFailure
+		return m
+	}
+
+	hdr := dns.RR_Header{Name: q.Name, Class: dns.ClassINET, Ttl: dnsAnswerTTL}
+	for _, addr := range addrs {
+		switch {
+		case q.Qtype == dns.TypeA && addr.Is4():
+			hdr.Rrtype = dns.TypeA
+			m.Answer = append(m.Answer, &dns.A{Hdr: hdr, A: addr.AsSlice()})
+		case q.Qtype == dns.TypeAAAA && addr.Is6():
+			hdr.Rrtype = dns.TypeAAAA
+			m.Answer = append(m.Answer, &dns.AAAA{Hdr: hdr, AAAA: addr.AsSlice()})
+		}
+	}
+	return m
+}
+
+// resolveCertName returns the vpn addrs of the host holding the cert name,
+// ourselves, a host in the hostmap or one a lighthouse knows, in that order
+func (n *Nebula) resolveCertName(name string) ([]netip.Addr, error) {
+	if networks := n.dev.Networks(); len(networks) > 0 {
+		if c := n.c.GetCertByVpnIp(networks[0].Addr()); c != nil && strings.EqualFold(c.Name(), name) {
+			return vpnAddrsOf(networks), nil
+		}
+	}
+
+	for _, h := range n.c.ListHostmapHosts(false) {
+		if h.Cert != nil && strings.EqualFold(h.Cert.Name(), name) {
+			return h.VpnAddrs, nil
+		}
+	}
+
+	r, err := n.names.resolve(name)
+	return r.addrs, err
+}
+
+// networkDNSServers returns the resolvers of the network the platform last
+// reported, the responder's fallback upstreams
+func (n *Nebula) networkDNSServers() []netip.AddrPort {
+	n.networkLock.Lock()
+	defer n.networkLock.Unlock()
+	if n.network == nil {
+		return nil
+	}
+
+	servers := make([]netip.AddrPort, 0, len(n.network.DNSServers))
+	for _, addr := range n.network.DNSServers {
+		servers = append(servers, netip.AddrPortFrom(addr, 53))
+	}
+	return servers
+}
+
+// DnsSettings tells the platform how to hand the site's DNS responder to the
+// OS as JSON. resolver is the addr to set as the DNS server and route into
+// the tun as a single host, empty when the responder is off. domain is the
+// overlay domain, for platforms that resolve split by domain.
+func DnsSettings(configData string) (string, error) {
+	yamlConfig, err := RenderConfig(configData, "")
+	if err != nil {
+		return "", err
+	}
+
+	c := nc.NewC(slog.New(slog.DiscardHandler))
+	if err := c.LoadString(yamlConfig); err != nil {
+		return "", err
+	}
+
+	cfg, err := loadDNSConfig(c)
+	if err != nil {
+		return "", err
+	}
+
+	settings := struct {
+		Resolver string `json:"resolver"`
+		Domain   string `json:"domain"`
+	}{}
+	if cfg.resolver.IsValid() {
+		settings.Resolver = cfg.resolver.String()
+		settings.Domain = strings.TrimSuffix(cfg.domain, ".")
+	}
+
+	b, err := json.Marshal(settings)
+	if err != nil {
+		return "", err
+	}
+	return string(b), nil
+}
+
+// answerAddrs returns the addresses in the A and AAAA answers of m
+func answerAddrs(m *dns.Msg) []netip.Addr {
+	var addrs []netip.Addr
+	for _, rr := range m.Answer {
+		var ip net.IP
+		switch rr := rr.(type) {
+		case *dns.A:
+			ip = rr.A
+		case *dns.AAAA:
+			ip = rr.AAAA
+		default:
+			continue
+		}
+		if addr, ok := netip.AddrFromSlice(ip); ok && !slices.Contains(addrs, addr.Unmap()) {
+			addrs = append(addrs, addr.Unmap())
+		}
+	}
+	return addrs
+}
+
+func vpnAddrsOf(networks []netip.Prefix) []netip.Addr {
+	addrs := make([]netip.Addr, 0, len(networks))
+	for _, network := range networks {
+		addrs = append(addrs, network.Addr())
+	}
+	return addrs
+}
@@ -0,0 +1,267 @@
+package mobileNebula
+
+import (
+	"context"
+	"encoding/json"
+	"log/slog"
+	"net/netip"
+	"sync"
+	"time"
+
+	nc "github.com/slackhq/nebula/config"
+)
+
+// EventCallback is implemented by the platform side (Kotlin/Swift) to learn
+// about tunnel lifecycle changes as they happen instead of polling
+// ListHostmap. Each event is a JSON object carrying a type, see the Event
+// constants, the time it happened and the fields that type has. Events are
+// delivered in order from a single Go thread, hop to the platform main thread
+// before touching anything that needs it. The tunnel events are read from
+// nebula's info records, which are watched whatever logging.level is.
+type EventCallback interface {
+	OnEvent(event string)
+}
+
+const (
+	// EventTunnelUp carries vpnAddrs and certName of the new tunnel
+	EventTunnelUp = "tunnelUp"
+	// EventTunnelDown carries vpnAddrs, certName when known and a reason
+	EventTunnelDown = "tunnelDown"
+	// EventHandshakeTimeout carries the vpnAddrs we failed to reach
+	EventHandshakeTimeout = "handshakeTimeout"
+	// EventLighthouseReachable and EventLighthouseUnreachable carry the
+	// lighthouse vpnAddrs and only fire when its reachability changes
+	EventLighthouseReachable   = "lighthouseReachable"
+	EventLighthouseUnreachable = "lighthouseUnreachable"
+	// EventReload fires after a reload was applied
+	EventReload = "reload"
+	// EventReloadFailed carries why nebula could not apply a reload, the
+	// instance is back on the config it ran before
+	EventReloadFailed = "reloadFailed"
+	// EventRebind carries the reason the platform gave for the rebind
+	EventRebind = "rebind"
+	// EventStopTimeout carries why Stop gave up waiting on nebula, the tunnel
+	// was forced closed and nebula may still hold its udp sockets. Stop
+	// returns the same reason as its error.
+	EventStopTimeout = "stopTimeout"
+)
+
+// eventQueueSize bounds the events waiting on a slow platform callback, events
+// past it are dropped rather than stalling the nebula goroutine emitting them
+const eventQueueSize = 256
+
+type event struct {
+	Type     string       `json:"type"`
+	Time     time.Time    `json:"time"`
+	VpnAddrs []netip.Addr `json:"vpnAddrs,omitempty"`
+	CertName string       `json:"certName,omitempty"`
+	Reason   string       `json:"reason,omitempty"`
+}
+
+// tunnelDownReasons maps the nebula log messages that accompany a tunnel
+// teardown to the reason we report
+var tunnelDownReasons = map[string]string{
+	"Close tunnel received, tearing down.":                           "closedByRemote",
+	"Dropping tunnel due to inactivity":                              "inactive",
+	"Remote certificate is blocked, tearing down the tunnel":         "certBlocked",
+	"Remote certificate is no longer valid, tearing down the tunnel": "certInvalid",
+}
+
+// eventSink turns what nebula logs into events for the platform. A nil
+// eventSink drops everything, so callers don't have to care whether the
+// platform registered a callback.
+type eventSink struct {
+	cb    EventCallback
+	queue chan event
+	// cbLock keeps deliver from calling cb alongside run
+	cbLock sync.Mutex
+
+	lock        sync.Mutex
+	lighthouses map[netip.Addr]struct{}
+	reachable   map[netip.Addr]struct{}
+}
+
+func newEventSink(cb EventCallback) *eventSink {
+	return &eventSink{
+		cb:          cb,
+		queue:       make(chan event, eventQueueSize),
+		lighthouses: map[netip.Addr]struct{}{},
+		reachable:   map[netip.Addr]struct{}{},
+	}
+}
+
+// run delivers queued events until ctx is done, then delivers what was
+// still queued, the tunnels nebula tore down on its way out among them
+func (s *eventSink) run(ctx context.Context) {
+	for {
+		select {
+		case <-ctx.Done():
+			for {
+				select {
+				case e := <-s.queue:
+					s.deliver(e)
+				default:
+					return
+				}
+			}
+		case e := <-s.queue:
+			s.deliver(e)
+		}
+	}
+}
+
+// deliver hands e to the platform right away. Stop uses it directly, run has
+// wound down with nebula's context by then. Callers must not hold locks the
+// platform could wait on.
+func (s *eventSink) deliver(e event) {
+	if s == nil {
+		return
+	}
+
+	if e.Time.IsZero() {
+		e.Time = time.Now()
+	}
+
+	b, err := json.Marshal(e)
+	if err != nil {
+		return
+	}
+
+	s.cbLock.Lock()
+	defer s.cbLock.Unlock()
+	s.cb.OnEvent(string(b))
+}
+
+func (s *eventSink) emit(e event) {
+	if s == nil {
+		return
+	}
+
+	if e.Time.IsZero() {
+		e.Time = time.Now()
+	}
+
+	select {
+	case s.queue <- e:
+	default:
+	}
+}
+
+// loadLighthouses refreshes which vpn addrs are lighthouses from
+// lighthouse.hosts, it is registered as a reload callback
+func (s *eventSink) loadLighthouses(c *nc.C) {
+	lighthouses := map[netip.Addr]struct{}{}
+	for _, h := range c.GetStringSlice("lighthouse.hosts", []string{}) {
+		if addr, err := netip.ParseAddr(h); err == nil {
+			lighthouses[addr] = struct{}{}
+		}
+	}
+
+	s.lock.Lock()
+	s.lighthouses = lighthouses
+	for addr := range s.reachable {
+		if _, ok := lighthouses[addr]; !ok {
+			delete(s.reachable, addr)
+		}
+	}
+	s.lock.Unlock()
+}
+
+// isLighthouse reports whether any of vpnAddrs is a configured lighthouse
+func (s *eventSink) isLighthouse(vpnAddrs []netip.Addr) bool {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	for _, addr := range vpnAddrs {
+		if _, ok := s.lighthouses[addr]; ok {
+			return true
+		}
+	}
+	return false
+}
+
+// setReachable emits a lighthouse reachability event for every lighthouse in
+// vpnAddrs whose state changed
+func (s *eventSink) setReachable(vpnAddrs []netip.Addr, reachable bool) {
+	var changed []netip.Addr
+
+	s.lock.Lock()
+	for _, addr := range vpnAddrs {
+		if _, ok := s.lighthouses[addr]; !ok {
+			continue
+		}
+		if _, was := s.reachable[addr]; was == reachable {
+			continue
+		}
+		if reachable {
+			s.reachable[addr] = struct{}{}
+		} else {
+			delete(s.reachable, addr)
+		}
+		changed = append(changed, addr)
+	}
+	s.lock.Unlock()
+
+	if len(changed) == 0 {
+		return
+	}
+
+	t := EventLighthouseUnreachable
+	if reachable {
+		t = EventLighthouseReachable
+	}
+	s.emit(event{Type: t, VpnAddrs: changed})
+}
+
+func (s *eventSink) tunnelDown(vpnAddrs []netip.Addr, certName string, reason string) {
+	if s == nil {
+		return
+	}
+	s.emit(event{Type: EventTunnelDown, VpnAddrs: vpnAddrs, CertName: certName, Reason: reason})
+	s.setReachable(vpnAddrs, false)
+}
+
+// observe is the logObserver picking the tunnel lifecycle out of nebula's log
+func (s *eventSink) observe(r slog.Record, attrs []slog.Attr) {
+	switch r.Message {
+	case "Handshake message received", "Handshake message received, but no vpnNetworks in common.":
+		vpnAddrs := vpnAddrsAttr(r, attrs)
+		s.emit(event{Type: EventTunnelUp, Time: r.Time, VpnAddrs: vpnAddrs, CertName: stringAttr(r, attrs, "certName")})
+		s.setReachable(vpnAddrs, true)
+
+	case "Handshake timed out":
+		vpnAddrs := vpnAddrsAttr(r, attrs)
+		s.emit(event{Type: EventHandshakeTimeout, Time: r.Time, VpnAddrs: vpnAddrs})
+		s.setReachable(vpnAddrs, false)
+
+	case "Tunnel status":
+		// Only the dead state tears the tunnel down
+		v, _ := findAttr(r, attrs, "tunnelCheck")
+		if check, ok := v.Any().(map[string]any); ok && check["state"] == "dead" {
+			s.tunnelDown(vpnAddrsAttr(r, attrs), stringAttr(r, attrs, "certName"), "dead")
+		}
+
+	default:
+		if reason, ok := tunnelDownReasons[r.Message]; ok {
+			s.tunnelDown(vpnAddrsAttr(r, attrs), stringAttr(r, attrs, "certName"), reason)
+		}
+	}
+}
+
+func vpnAddrsAttr(r slog.Record, attrs []slog.Attr) []netip.Addr {
+	v, ok := findAttr(r, attrs, "vpnAddrs")
+	if !ok {
+		return nil
+	}
+
+	addrs, _ := v.Any().([]netip.Addr)
+	// The record may outlive the hostinfo it came from, don't alias its slice
+	return append([]netip.Addr(nil), addrs...)
+}
+
+func stringAttr(r slog.Record, attrs []slog.Attr, key string) string {
+	v, ok := findAttr(r, attrs, key)
+	if !ok {
+		return ""
+	}
+	return v.String()
+}
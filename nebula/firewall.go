@@ -0,0 +1,403 @@
+package mobileNebula
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/netip"
+	"slices"
+	"strconv"
+	"sync/atomic"
+
+	"github.com/slackhq/nebula"
+	"github.com/slackhq/nebula/cert"
+	nc "github.com/slackhq/nebula/config"
+	"github.com/slackhq/nebula/firewall"
+)
+
+// firewallRule is one rule of firewall.inbound or firewall.outbound. nebula
+// keeps its rule tables unexported, so the binding collects the rules nebula
+// parses and matches them with the same semantics to tell which rule lets a
+// packet through.
+type firewallRule struct {
+	Index     int      `json:"index"`
+	Port      string   `json:"port,omitempty"`
+	Proto     string   `json:"proto"`
+	Host      string   `json:"host,omitempty"`
+	Groups    []string `json:"groups,omitempty"`
+	Cidr      string   `json:"cidr,omitempty"`
+	LocalCidr string   `json:"localCidr,omitempty"`
+	CAName    string   `json:"caName,omitempty"`
+	CASha     string   `json:"caSha,omitempty"`
+
+	proto     uint8
+	startPort int32
+	endPort   int32
+	cidr      netip.Prefix
+	localCidr netip.Prefix
+	// anyPeer is set when groups, host and cidr are all empty or one is "any"
+	anyPeer bool
+
+	// hits counts the flows the rule let start
+	hits atomic.Uint64
+}
+
+// firewallPolicy is the firewall config of a site, everything a rule is
+// matched with besides the packet and the peer cert
+type firewallPolicy struct {
+	inbound  []*firewallRule
+	outbound []*firewallRule
+
+	// caPool resolves ca_name, nil when the config has no usable pki.ca
+	caPool *cert.CAPool
+	// defaultLocal is where a rule without local_cidr applies, empty means
+	// anywhere. nebula narrows it to our vpn networks when the cert carries
+	// unsafe networks, unless firewall.default_local_cidr_any is set.
+	defaultLocal []netip.Prefix
+}
+
+// newFirewallPolicy reads the firewall section out of a config map, one with
+// the shape yamlToJSONMap returns. The rules are parsed by nebula itself, a
+// rule nebula would reject is an error here too.
+func newFirewallPolicy(cfg map[string]any) (*firewallPolicy, error) {
+	p := &firewallPolicy{inbound: []*firewallRule{}, outbound: []*firewallRule{}}
+
+	// nebula already warned about the rules when it loaded them
+	l := slog.New(slog.DiscardHandler)
+	c := nc.NewC(l)
+	c.Settings = cfg
+	if err := nebula.AddFirewallRulesFromConfig(l, false, c, p); err != nil {
+		return nil, err
+	}
+	if err := nebula.AddFirewallRulesFromConfig(l, true, c, p); err != nil {
+		return nil, err
+	}
+
+	pki, _ := cfg["pki"].(map[string]any)
+	if ca, _ := pki["ca"].(string); ca != "" {
+		// Without a pool ca_name rules never match, nebula would refuse to
+		// start in the first place
+		p.caPool, _ = cert.NewCAPoolFromPEM([]byte(ca))
+	}
+
+	fw, _ := cfg["firewall"].(map[string]any)
+	defaultLocalAny, _ := fw["default_local_cidr_any"].(bool)
+	if crt, _ := pki["cert"].(string); crt != "" && !defaultLocalAny {
+		c, _, err := cert.UnmarshalCertificateFromPEM([]byte(crt))
+		if err == nil && len(c.UnsafeNetworks()) > 0 {
+			p.defaultLocal = c.Networks()
+		}
+	}
+
+	return p, nil
+}
+
+// AddRule is nebula.FirewallInterface, nebula hands it every rule it parsed
+// out of the config in order. The range check is the one nebula's own
+// firewall makes as it adds the rule.
+func (fp *firewallPolicy) AddRule(incoming bool, proto uint8, startPort int32, endPort int32, groups []string, host string, cidr, localCidr string, caName string, caSha string) error {
+	if startPort > endPort {
+		return errors.New("start port was lower than end port")
+	}
+
+	r := &firewallRule{
+		Port:      describePorts(proto, startPort, endPort),
+		Proto:     describeProto(proto),
+		Host:      host,
+		Groups:    groups,
+		Cidr:      cidr,
+		LocalCidr: localCidr,
+		CAName:    caName,
+		CASha:     caSha,
+		proto:     proto,
+		startPort: startPort,
+		endPort:   endPort,
+	}
+
+	// nebula has already checked that both parse
+	if cidr != "" && cidr != "any" {
+		r.cidr, _ = netip.ParsePrefix(cidr)
+	}
+	if localCidr != "" && localCidr != "any" {
+		r.localCidr, _ = netip.ParsePrefix(localCidr)
+	}
+
+	r.anyPeer = (len(groups) == 0 && host == "" && cidr == "") ||
+		slices.Contains(groups, "any") || host == "any" || cidr == "any"
+
+	if incoming {
+		r.Index = len(fp.inbound)
+		fp.inbound = append(fp.inbound, r)
+	} else {
+		r.Index = len(fp.outbound)
+		fp.outbound = append(fp.outbound, r)
+	}
+	return nil
+}
+
+func describeProto(proto uint8) string {
+	switch proto {
+	case firewall.ProtoTCP:
+		return "tcp"
+	case firewall.ProtoUDP:
+		return "udp"
+	case firewall.ProtoICMP:
+		return "icmp"
+	default:
+		return "any"
+	}
+}
+
+// describePorts writes a port range back the way the config spells it, icmp
+// rules have none
+func describePorts(proto uint8, start, end int32) string {
+	switch {
+	case proto == firewall.ProtoICMP:
+		return ""
+	case start == firewall.PortAny:
+		return "any"
+	case start == firewall.PortFragment:
+		return "fragment"
+	case start == end:
+		return strconv.Itoa(int(start))
+	default:
+		return fmt.Sprintf("%d-%d", start, end)
+	}
+}
+
+// match returns the first rule in the table for the direction of p that lets
+// it through, nil when nebula would drop it. peer may be nil when the peer
+// cert isn't known, only rules that don't look at the cert can match then.
+func (fp *firewallPolicy) match(p firewall.Packet, incoming bool, peer cert.Certificate) *firewallRule {
+	rules := fp.outbound
+	if incoming {
+		rules = fp.inbound
+	}
+
+	var caName string
+	if peer != nil && fp.caPool != nil {
+		if ca, err := fp.caPool.GetCAForCert(peer); err == nil {
+			caName = ca.Certificate.Name()
+		}
+	}
+
+	for _, r := range rules {
+		if r.match(p, incoming, peer, caName, fp.defaultLocal) {
+			return r
+		}
+	}
+	return nil
+}
+
+// resetHits zeroes the hit counters of every rule
+func (fp *firewallPolicy) resetHits() {
+	for _, r := range slices.Concat(fp.inbound, fp.outbound) {
+		r.hits.Store(0)
+	}
+}
+
+// match is nebula's port AND proto AND (ca_sha OR ca_name) AND (host OR
+// groups OR cidr) AND local_cidr
+func (r *firewallRule) match(p firewall.Packet, incoming bool, peer cert.Certificate, caName string, defaultLocal []netip.Prefix) bool {
+	isICMP := p.Protocol == firewall.ProtoICMP || p.Protocol == firewall.ProtoICMPv6
+	switch r.proto {
+	case firewall.ProtoAny:
+	case firewall.ProtoICMP:
+		if !isICMP {
+			return false
+		}
+	default:
+		if r.proto != p.Protocol {
+			return false
+		}
+	}
+
+	// ICMP carries no ports, only port any rules apply to it
+	if isICMP {
+		if r.startPort != firewall.PortAny {
+			return false
+		}
+	} else if r.startPort != firewall.PortAny {
+		port := int32(p.RemotePort)
+		if p.Fragment {
+			port = firewall.PortFragment
+		} else if incoming {
+			port = int32(p.LocalPort)
+		}
+		if port < r.startPort || port > r.endPort {
+			return false
+		}
+	}
+
+	if r.CASha != "" || r.CAName != "" {
+		shaOk := r.CASha != "" && peer != nil && peer.Issuer() == r.CASha
+		nameOk := r.CAName != "" && caName == r.CAName
+		if !shaOk && !nameOk {
+			return false
+		}
+	}
+
+	if !r.anyPeer {
+		groupsOk := len(r.Groups) > 0 && peer != nil && !slices.ContainsFunc(r.Groups, func(g string) bool {
+			return !slices.Contains(peer.Groups(), g)
+		})
+		hostOk := r.Host != "" && peer != nil && peer.Name() == r.Host
+		cidrOk := r.cidr.IsValid() && r.cidr.Contains(p.RemoteAddr)
+		if !groupsOk && !hostOk && !cidrOk {
+			return false
+		}
+	}
+
+	switch {
+	case r.LocalCidr == "any":
+		return true
+	case r.localCidr.IsValid():
+		return r.localCidr.Contains(p.LocalAddr)
+	case len(defaultLocal) == 0:
+		return true
+	default:
+		return slices.ContainsFunc(defaultLocal, func(n netip.Prefix) bool {
+			return n.Contains(p.LocalAddr)
+		})
+	}
+}
+
+// simulatedPacket is the packet description SimulateFirewall takes
+type simulatedPacket struct {
+	// Direction is inbound for a packet the peer sends us, outbound for one we
+	// send the peer
+	Direction string `json:"direction"`
+	// Proto is tcp, udp or icmp
+	Proto string `json:"proto"`
+	// Port is ours for inbound and the peer's for outbound, icmp has none
+	Port uint16 `json:"port"`
+	// LocalCidr is where the packet is addressed on our side, its first
+	// address is used. It defaults to our vpn addr, set it to check local_cidr
+	// rules for an unsafe network.
+	LocalCidr string `json:"localCidr"`
+}
+
+type simulationResult struct {
+	Allowed bool `json:"allowed"`
+	// Rule is the first rule in config order allowing the packet
+	Rule   *firewallRule `json:"rule"`
+	Reason string        `json:"reason"`
+}
+
+// SimulateFirewall answers whether the firewall rules in configData, a site
+// JSON, would let packetJson, a simulatedPacket, through with the peer
+// holding peerCert, and which rule would. It doesn't need a running site, the
+// rules are matched the way nebula matches them. The peer addr checked
+// against cidr rules is the first vpn addr of peerCert.
+func SimulateFirewall(configData string, peerCert string, packetJson string) (string, error) {
+	var sp simulatedPacket
+	if err := json.Unmarshal([]byte(packetJson), &sp); err != nil {
+		return "", fmt.Errorf("failed to parse packet: %s", err)
+	}
+
+	var incoming bool
+	switch sp.Direction {
+	case "inbound":
+		incoming = true
+	case "outbound":
+	default:
+		return "", fmt.Errorf("direction was not understood; `%s`", sp.Direction)
+	}
+
+	var p firewall.Packet
+	switch sp.Proto {
+	case "tcp":
+		p.Protocol = firewall.ProtoTCP
+	case "udp":
+		p.Protocol = firewall.ProtoUDP
+	case "icmp":
+		p.Protocol = firewall.ProtoICMP
+	default:
+		return "", fmt.Errorf("proto was not understood; `%s`", sp.Proto)
+	}
+
+	if incoming {
+		p.LocalPort = sp.Port
+	} else {
+		p.RemotePort = sp.Port
+	}
+
+	peer, _, err := cert.UnmarshalCertificateFromPEM([]byte(peerCert))
+	if err != nil {
+		return "", fmt.Errorf("failed to parse peer cert: %s", err)
+	}
+	if len(peer.Networks()) == 0 {
+		return "", errors.New("peer cert has no networks")
+	}
+	p.RemoteAddr = peer.Networks()[0].Addr()
+
+	yamlConfig, err := RenderConfig(configData, "")
+	if err != nil {
+		return "", err
+	}
+
+	cfg, err := yamlToJSONMap([]byte(yamlConfig))
+	if err != nil {
+		return "", err
+	}
+
+	policy, err := newFirewallPolicy(cfg)
+	if err != nil {
+		return "", err
+	}
+
+	if sp.LocalCidr != "" {
+		local, err := netip.ParsePrefix(sp.LocalCidr)
+		if err != nil {
+			addr, aerr := netip.ParseAddr(sp.LocalCidr)
+			if aerr != nil {
+				return "", fmt.Errorf("failed to parse localCidr: %s", err)
+			}
+			local = netip.PrefixFrom(addr, addr.BitLen())
+		}
+		p.LocalAddr = local.Masked().Addr()
+	} else {
+		pki, _ := cfg["pki"].(map[string]any)
+		crt, _ := pki["cert"].(string)
+		c, _, err := cert.UnmarshalCertificateFromPEM([]byte(crt))
+		if err != nil {
+			return "", fmt.Errorf("failed to parse site cert: %s", err)
+		}
+		for _, network := range c.Networks() {
+			if network.Addr().Is4() == p.RemoteAddr.Is4() {
+				p.LocalAddr = network.Addr()
+				break
+			}
+		}
+	}
+
+	res := simulationResult{}
+	switch {
+	case policy.caPool == nil:
+		res.Reason = "site has no usable pki.ca"
+	case !trustedBy(policy.caPool, peer):
+		// nebula never gets a tunnel up with such a peer, whatever the rules
+		res.Reason = "peer cert is not signed by a CA the site trusts"
+	default:
+		res.Rule = policy.match(p, incoming, peer)
+		res.Allowed = res.Rule != nil
+		if res.Allowed {
+			res.Reason = fmt.Sprintf("allowed by %s rule #%d", sp.Direction, res.Rule.Index)
+		} else {
+			res.Reason = fmt.Sprintf("no %s rule matched", sp.Direction)
+		}
+	}
+
+	b, err := json.Marshal(res)
+	if err != nil {
+		return "", err
+	}
+
+	return string(b), nil
+}
+
+func trustedBy(pool *cert.CAPool, c cert.Certificate) bool {
+	_, err := pool.GetCAForCert(c)
+	return err == nil
+}
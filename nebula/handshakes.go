@@ -0,0 +1,355 @@
+package mobileNebula
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"log/slog"
+	"net/netip"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/slackhq/nebula"
+	"github.com/slackhq/nebula/cert"
+	nc "github.com/slackhq/nebula/config"
+	"github.com/slackhq/nebula/handshake"
+)
+
+const (
+	defaultHandshakeHistory = 10
+	// maxHandshakeHistory caps mobile_nebula.handshake_history
+	maxHandshakeHistory = 100
+	// maxHandshakePeers bounds the peers a history is kept for, the one with
+	// the oldest attempt makes room for a new one
+	maxHandshakePeers = 256
+	// handshakeQueueSize bounds the relayed handshakes waiting on a relay
+	// lookup, the relay is left out past it
+	handshakeQueueSize = 64
+)
+
+// Outcomes of a handshake attempt
+const (
+	handshakePending      = "pending"
+	handshakeSuccess      = "success"
+	handshakeTimeout      = "timeout"
+	handshakeCertRejected = "certRejected"
+	handshakeBlocklisted  = "blocklisted"
+	handshakeCANotTrusted = "caNotTrusted"
+	handshakeFailed       = "failed"
+)
+
+type handshakeAttempt struct {
+	Started time.Time `json:"started"`
+	Ended   time.Time `json:"ended,omitzero"`
+	Outcome string    `json:"outcome"`
+	Error   string    `json:"error,omitempty"`
+	// Inbound is true when the peer started the handshake
+	Inbound bool `json:"inbound"`
+	// Remotes are the underlay addrs the handshake was sent to, Relays the
+	// relays asked to carry it
+	Remotes []netip.AddrPort `json:"remotes"`
+	Relays  []netip.Addr     `json:"relays"`
+	// From is the underlay addr the answer came from and Relay the relay
+	// that carried it, when one did
+	From    netip.AddrPort `json:"from,omitzero"`
+	Relayed bool           `json:"relayed"`
+	Relay   netip.Addr     `json:"relay,omitzero"`
+}
+
+// handshakeHistory keeps the last attempts to handshake with every peer,
+// pieced together from what nebula logs as a handshake goes. An attempt
+// stays pending until nebula logs how it ended.
+type handshakeHistory struct {
+	queue chan netip.Addr
+
+	lock  sync.Mutex
+	limit int
+	peers map[netip.Addr][]*handshakeAttempt
+}
+
+func newHandshakeHistory() *handshakeHistory {
+	return &handshakeHistory{
+		queue: make(chan netip.Addr, handshakeQueueSize),
+		limit: defaultHandshakeHistory,
+		peers: map[netip.Addr][]*handshakeAttempt{},
+	}
+}
+
+// load is a reload callback picking up mobile_nebula.handshake_history, the
+// number of attempts kept per peer
+func (h *handshakeHistory) load(c *nc.C) {
+	limit := min(max(c.GetInt("mobile_nebula.handshake_history", defaultHandshakeHistory), 1), maxHandshakeHistory)
+
+	h.lock.Lock()
+	defer h.lock.Unlock()
+	h.limit = limit
+	for addr, attempts := range h.peers {
+		if len(attempts) > limit {
+			h.peers[addr] = attempts[len(attempts)-limit:]
+		}
+	}
+}
+
+// observe is the logObserver following handshakes, nebula logs them at info
+// so it is registered to see info records whatever logging.level is
+func (h *handshakeHistory) observe(r slog.Record, attrs []slog.Attr) {
+	switch r.Message {
+	case "Handshake message sent":
+		// The responder logs its answer too, only ours carries udpAddrs
+		if v, ok := findAttr(r, attrs, "udpAddrs"); ok {
+			remotes, _ := v.Any().([]netip.AddrPort)
+			h.update(vpnAddrsAttr(r, attrs), r.Time, func(a *handshakeAttempt) {
+				a.Remotes = appendNew(a.Remotes, remotes...)
+			})
+		}
+
+	case "Attempt to relay through hosts":
+		v, _ := findAttr(r, attrs, "relays")
+		relays, _ := v.Any().([]netip.Addr)
+		h.update(vpnAddrsAttr(r, attrs), r.Time, func(a *handshakeAttempt) {
+			a.Relays = appendNew(a.Relays, relays...)
+		})
+
+	case "Handshake message received", "Handshake message received, but no vpnNetworks in common.":
+		v, _ := findAttr(r, attrs, "from")
+		via, _ := v.Any().(nebula.ViaSender)
+		if addr, ok := h.succeeded(vpnAddrsAttr(r, attrs), r.Time, via); ok && via.IsRelayed {
+			// nebula doesn't log which relay, ask it once the tunnel landed
+			time.AfterFunc(pinSettleDelay, func() { h.enqueue(addr) })
+		}
+
+	case "Handshake timed out":
+		v, _ := findAttr(r, attrs, "udpAddrs")
+		remotes, _ := v.Any().([]netip.AddrPort)
+		h.end(vpnAddrsAttr(r, attrs), r.Time, handshakeTimeout, "", remotes)
+
+	case "Failed to process handshake packet, abandoning":
+		v, _ := findAttr(r, attrs, "error")
+		err, _ := v.Any().(error)
+		outcome, msg := handshakeOutcome(err), ""
+		if err != nil {
+			msg = err.Error()
+		}
+		h.end(vpnAddrsAttr(r, attrs), r.Time, outcome, msg, nil)
+	}
+}
+
+// handshakeOutcome tells apart why nebula gave up on a peer's handshake
+func handshakeOutcome(err error) string {
+	switch {
+	case errors.Is(err, cert.ErrBlockListed):
+		return handshakeBlocklisted
+	case errors.Is(err, cert.ErrCaNotFound):
+		return handshakeCANotTrusted
+	case errors.Is(err, handshake.ErrPublicKeyMismatch), err != nil && (strings.HasPrefix(err.Error(), "verify cert:") || strings.HasPrefix(err.Error(), "recombine cert:")):
+		return handshakeCertRejected
+	default:
+		return handshakeFailed
+	}
+}
+
+// update applies f to the pending attempt with the first of vpnAddrs,
+// starting one at t when there is none
+func (h *handshakeHistory) update(vpnAddrs []netip.Addr, t time.Time, f func(a *handshakeAttempt)) {
+	if len(vpnAddrs) == 0 {
+		return
+	}
+
+	h.lock.Lock()
+	defer h.lock.Unlock()
+	_, a := h.pendingLocked(vpnAddrs)
+	if a == nil {
+		a = h.addLocked(vpnAddrs[0], &handshakeAttempt{Started: t, Outcome: handshakePending, Remotes: []netip.AddrPort{}, Relays: []netip.Addr{}})
+	}
+	f(a)
+}
+
+// succeeded ends the pending attempt with vpnAddrs, a handshake the peer
+// started is added as a finished one. It returns the vpn addr the attempt is
+// kept under.
+func (h *handshakeHistory) succeeded(vpnAddrs []netip.Addr, t time.Time, via nebula.ViaSender) (netip.Addr, bool) {
+	if len(vpnAddrs) == 0 {
+		return netip.Addr{}, false
+	}
+
+	h.lock.Lock()
+	defer h.lock.Unlock()
+	addr, a := h.pendingLocked(vpnAddrs)
+	if a == nil {
+		addr = vpnAddrs[0]
+		a = h.addLocked(addr, &handshakeAttempt{Started: t, Inbound: true, Remotes: []netip.AddrPort{}, Relays: []netip.Addr{}})
+	}
+	a.Ended, a.Outcome = t, handshakeSuccess
+	a.Relayed = via.IsRelayed
+	if !via.IsRelayed {
+		a.From = via.UdpAddr
+	}
+	return addr, true
+}
+
+// end finishes the pending attempt with vpnAddrs, there is none when the
+// history started after it did
+func (h *handshakeHistory) end(vpnAddrs []netip.Addr, t time.Time, outcome string, msg string, remotes []netip.AddrPort) {
+	h.lock.Lock()
+	defer h.lock.Unlock()
+	_, a := h.pendingLocked(vpnAddrs)
+	if a == nil {
+		return
+	}
+	a.Ended, a.Outcome, a.Error = t, outcome, msg
+	a.Remotes = appendNew(a.Remotes, remotes...)
+}
+
+// pendingLocked finds the pending attempt with any of vpnAddrs and the addr
+// it is kept under
+func (h *handshakeHistory) pendingLocked(vpnAddrs []netip.Addr) (netip.Addr, *handshakeAttempt) {
+	for _, addr := range vpnAddrs {
+		attempts := h.peers[addr]
+		if len(attempts) > 0 && attempts[len(attempts)-1].Outcome == handshakePending {
+			return addr, attempts[len(attempts)-1]
+		}
+	}
+	return netip.Addr{}, nil
+}
+
+func (h *handshakeHistory) addLocked(vpnAddr netip.Addr, a *handshakeAttempt) *handshakeAttempt {
+	if _, ok := h.peers[vpnAddr]; !ok && len(h.peers) >= maxHandshakePeers {
+		oldest, oldestStart := netip.Addr{}, time.Time{}
+		for addr, attempts := range h.peers {
+			if start := attempts[len(attempts)-1].Started; !oldest.IsValid() || start.Before(oldestStart) {
+				oldest, oldestStart = addr, start
+			}
+		}
+		delete(h.peers, oldest)
+	}
+
+	attempts := append(h.peers[vpnAddr], a)
+	if len(attempts) > h.limit {
+		attempts = attempts[len(attempts)-h.limit:]
+	}
+	h.peers[vpnAddr] = attempts
+	return a
+}
+
+func (h *handshakeHistory) enqueue(vpnAddr netip.Addr) {
+	select {
+	case h.queue <- vpnAddr:
+	default:
+	}
+}
+
+// run fills in the relay of relayed handshakes with relayOf until ctx is
+// done, relayOf returns an invalid addr when the tunnel isn't relayed
+func (h *handshakeHistory) run(ctx context.Context, relayOf func(vpnAddr netip.Addr) netip.Addr) {
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case vpnAddr := <-h.queue:
+			relay := relayOf(vpnAddr)
+			if !relay.IsValid() {
+				continue
+			}
+
+			h.lock.Lock()
+			if attempts := h.peers[vpnAddr]; len(attempts) > 0 {
+				if a := attempts[len(attempts)-1]; a.Relayed && !a.Relay.IsValid() {
+					a.Relay = relay
+				}
+			}
+			h.lock.Unlock()
+		}
+	}
+}
+
+// snapshot copies the attempts with vpnAddr, every peer's for an invalid one
+func (h *handshakeHistory) snapshot(vpnAddr netip.Addr) map[netip.Addr][]handshakeAttempt {
+	h.lock.Lock()
+	defer h.lock.Unlock()
+
+	snap := map[netip.Addr][]handshakeAttempt{}
+	for addr, attempts := range h.peers {
+		if vpnAddr.IsValid() && addr != vpnAddr {
+			continue
+		}
+		// Newest first, the way a support screen reads them
+		copies := make([]handshakeAttempt, 0, len(attempts))
+		for _, a := range slices.Backward(attempts) {
+			c := *a
+			c.Remotes, c.Relays = slices.Clone(a.Remotes), slices.Clone(a.Relays)
+			copies = append(copies, c)
+		}
+		snap[addr] = copies
+	}
+	return snap
+}
+
+// latest returns a copy of the last attempt with vpnAddr, nil when there is
+// none
+func (h *handshakeHistory) latest(vpnAddr netip.Addr) *handshakeAttempt {
+	h.lock.Lock()
+	defer h.lock.Unlock()
+	attempts := h.peers[vpnAddr]
+	if len(attempts) == 0 {
+		return nil
+	}
+	a := *attempts[len(attempts)-1]
+	a.Remotes, a.Relays = slices.Clone(a.Remotes), slices.Clone(a.Relays)
+	return &a
+}
+
+func appendNew[T comparable](s []T, vs ...T) []T {
+	for _, v := range vs {
+		if !slices.Contains(s, v) {
+			s = append(s, v)
+		}
+	}
+	return s
+}
+
+// relayOf returns the relay carrying the tunnel to vpnAddr
+func (n *Nebula) relayOf(vpnAddr netip.Addr) netip.Addr {
+	hi := n.c.GetHostInfoByVpnAddr(vpnAddr, false)
+	if hi == nil || hi.CurrentRemote.IsValid() || len(hi.CurrentRelaysToMe) == 0 {
+		return netip.Addr{}
+	}
+	return hi.CurrentRelaysToMe[0]
+}
+
+// HandshakeHistory returns the last handshake attempts with the peer at
+// vpnIp as JSON, newest first, or those of every peer keyed by vpn addr when
+// vpnIp is empty. Each attempt lists when it started and ended, the underlay
+// addrs and relays it was sent to, where the answer came from and how it
+// ended: pending, success, timeout, certRejected, blocklisted, caNotTrusted
+// or failed. How many attempts are kept per peer is set with
+// mobile_nebula.handshake_history.
+func (n *Nebula) HandshakeHistory(vpnIp string) (string, error) {
+	var vpnAddr netip.Addr
+	if vpnIp != "" {
+		var err error
+		vpnAddr, err = netip.ParseAddr(vpnIp)
+		if err != nil {
+			return "", err
+		}
+		vpnAddr = vpnAddr.Unmap()
+	}
+
+	snap := n.handshakes.snapshot(vpnAddr)
+
+	var v any = snap
+	if vpnAddr.IsValid() {
+		attempts := snap[vpnAddr]
+		if attempts == nil {
+			attempts = []handshakeAttempt{}
+		}
+		v = attempts
+	}
+
+	b, err := json.Marshal(v)
+	if err != nil {
+		return "", err
+	}
+	return string(b), nil
+}
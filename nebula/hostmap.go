@@ -0,0 +1,197 @@
+package mobileNebula
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/netip"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/slackhq/nebula"
+)
+
+// hostmapQuery is the JSON QueryHostmap takes, every filter is optional and
+// a host has to match all that are set
+type hostmapQuery struct {
+	Pending bool `json:"pending"`
+	// Name matches a case insensitive substring of the cert name
+	Name  string `json:"name"`
+	Group string `json:"group"`
+	// Cidr matches hosts with a vpn addr inside it
+	Cidr string `json:"cidr"`
+	// Relayed true only matches relayed tunnels, false only direct ones
+	Relayed *bool `json:"relayed"`
+	// SeenWithinMs matches hosts that exchanged traffic with us that recently
+	SeenWithinMs int64 `json:"seenWithinMs"`
+	Offset       int   `json:"offset"`
+	// Limit of 0 returns every match from Offset on
+	Limit int `json:"limit"`
+}
+
+// hostmapHost is a ControlHostInfo with the cert flattened the way ParseCerts
+// does it
+type hostmapHost struct {
+	VpnAddrs               []netip.Addr     `json:"vpnAddrs"`
+	LocalIndex             uint32           `json:"localIndex"`
+	RemoteIndex            uint32           `json:"remoteIndex"`
+	RemoteAddrs            []netip.AddrPort `json:"remoteAddrs"`
+	Cert                   m                `json:"cert"`
+	MessageCounter         uint64           `json:"messageCounter"`
+	CurrentRemote          netip.AddrPort   `json:"currentRemote"`
+	CurrentRelaysToMe      []netip.Addr     `json:"currentRelaysToMe"`
+	CurrentRelaysThroughMe []netip.Addr     `json:"currentRelaysThroughMe"`
+	Relayed                bool             `json:"relayed"`
+	// Relay is the relay carrying a relayed tunnel
+	Relay netip.Addr `json:"relay"`
+	// ForcedRelay is true when SetTunnelPath keeps the tunnel on a relay
+	ForcedRelay bool `json:"forcedRelay"`
+	// SinceLastTrafficMs is -1 when we never exchanged traffic with the host
+	SinceLastTrafficMs int64 `json:"sinceLastTrafficMs"`
+}
+
+type hostmapPage struct {
+	// Total is how many hosts matched before pagination
+	Total  int           `json:"total"`
+	Offset int           `json:"offset"`
+	Hosts  []hostmapHost `json:"hosts"`
+}
+
+// QueryHostmap returns one page of the hosts in the hostmap matching
+// queryJson, a hostmapQuery, as JSON. Hosts are ordered by vpn addr so pages
+// are stable while the hostmap is. nebula still copies the whole hostmap to
+// answer, the savings are in only flattening and marshaling the page.
+func (n *Nebula) QueryHostmap(queryJson string) (string, error) {
+	var q hostmapQuery
+	if err := json.Unmarshal([]byte(queryJson), &q); err != nil {
+		return "", fmt.Errorf("failed to parse query: %s", err)
+	}
+
+	page, err := queryHosts(n.c.ListHostmapHosts(q.Pending), q, n.sinceLastTraffic)
+	if err != nil {
+		return "", err
+	}
+	for i := range page.Hosts {
+		page.Hosts[i].ForcedRelay = n.relays.forced(firstAddr(page.Hosts[i].VpnAddrs))
+	}
+
+	b, err := json.Marshal(page)
+	if err != nil {
+		return "", err
+	}
+
+	return string(b), nil
+}
+
+// sinceLastTraffic returns how long ago we exchanged traffic with addr, -1
+// for never
+func (n *Nebula) sinceLastTraffic(addr netip.Addr) int64 {
+	v, ok := n.dev.traffic.peers.Load(addr)
+	if !ok {
+		return -1
+	}
+	return v.(*peerTraffic).counters(time.Now()).SinceLastTrafficMs
+}
+
+func queryHosts(hosts []nebula.ControlHostInfo, q hostmapQuery, sinceLastTraffic func(netip.Addr) int64) (hostmapPage, error) {
+	page := hostmapPage{Offset: q.Offset, Hosts: []hostmapHost{}}
+
+	var cidr netip.Prefix
+	if q.Cidr != "" {
+		var err error
+		cidr, err = netip.ParsePrefix(q.Cidr)
+		if err != nil {
+			return page, fmt.Errorf("failed to parse cidr: %s", err)
+		}
+		cidr = cidr.Masked()
+	}
+
+	if q.Offset < 0 || q.Limit < 0 {
+		return page, errors.New("offset and limit must not be negative")
+	}
+
+	type match struct {
+		h       nebula.ControlHostInfo
+		relayed bool
+		since   int64
+	}
+
+	name := strings.ToLower(q.Name)
+	var matched []match
+	for _, h := range hosts {
+		relayed := !h.CurrentRemote.IsValid() && len(h.CurrentRelaysToMe) > 0
+		if q.Relayed != nil && *q.Relayed != relayed {
+			continue
+		}
+
+		if cidr.IsValid() && !slices.ContainsFunc(h.VpnAddrs, cidr.Contains) {
+			continue
+		}
+
+		if name != "" && (h.Cert == nil || !strings.Contains(strings.ToLower(h.Cert.Name()), name)) {
+			continue
+		}
+
+		if q.Group != "" && (h.Cert == nil || !slices.Contains(h.Cert.Groups(), q.Group)) {
+			continue
+		}
+
+		// The most recently active vpn addr speaks for the host
+		since := int64(-1)
+		for _, addr := range h.VpnAddrs {
+			if s := sinceLastTraffic(addr); s >= 0 && (since < 0 || s < since) {
+				since = s
+			}
+		}
+		if q.SeenWithinMs > 0 && (since < 0 || since > q.SeenWithinMs) {
+			continue
+		}
+
+		matched = append(matched, match{h: h, relayed: relayed, since: since})
+	}
+
+	slices.SortFunc(matched, func(a, b match) int {
+		return firstAddr(a.h.VpnAddrs).Compare(firstAddr(b.h.VpnAddrs))
+	})
+
+	page.Total = len(matched)
+	start := min(q.Offset, len(matched))
+	end := len(matched)
+	if q.Limit > 0 {
+		end = min(start+q.Limit, end)
+	}
+
+	// Flattening certs is the expensive part, only do it for the page
+	for _, mh := range matched[start:end] {
+		h := hostmapHost{
+			VpnAddrs:               mh.h.VpnAddrs,
+			LocalIndex:             mh.h.LocalIndex,
+			RemoteIndex:            mh.h.RemoteIndex,
+			RemoteAddrs:            mh.h.RemoteAddrs,
+			MessageCounter:         mh.h.MessageCounter,
+			CurrentRemote:          mh.h.CurrentRemote,
+			CurrentRelaysToMe:      mh.h.CurrentRelaysToMe,
+			CurrentRelaysThroughMe: mh.h.CurrentRelaysThroughMe,
+			Relayed:                mh.relayed,
+			SinceLastTrafficMs:     mh.since,
+		}
+		if mh.relayed {
+			// nebula sends through the first relay it still has a tunnel to,
+			// it drops the ones it doesn't
+			h.Relay = mh.h.CurrentRelaysToMe[0]
+		}
+		if mh.h.Cert != nil {
+			h.Cert = certToFlatJson(mh.h.Cert)
+		}
+		page.Hosts = append(page.Hosts, h)
+	}
+	return page, nil
+}
+
+func firstAddr(addrs []netip.Addr) netip.Addr {
+	if len(addrs) == 0 {
+		return netip.Addr{}
+	}
+	return addrs[0]
+}
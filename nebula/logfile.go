@@ -0,0 +1,129 @@
+package mobileNebula
+
+import (
+	"fmt"
+	"os"
+	"sync"
+
+	nc "github.com/slackhq/nebula/config"
+)
+
+const (
+	defaultLogMaxSize  = 1024 * 1024
+	defaultLogMaxFiles = 3
+)
+
+// rotatingFile is the log file, appended to across connects so the logs
+// leading up to a reconnect survive it. Once the file would grow past maxSize
+// it moves to path.1, path.1 to path.2 and so on, keeping maxFiles files in
+// all counting the one being written.
+type rotatingFile struct {
+	lock     sync.Mutex
+	path     string
+	f        *os.File
+	size     int64
+	maxSize  int64
+	maxFiles int
+}
+
+func openRotatingFile(path string) (*rotatingFile, error) {
+	f, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0644)
+	if err != nil {
+		return nil, err
+	}
+
+	fi, err := f.Stat()
+	if err != nil {
+		f.Close()
+		return nil, err
+	}
+
+	return &rotatingFile{
+		path:     path,
+		f:        f,
+		size:     fi.Size(),
+		maxSize:  defaultLogMaxSize,
+		maxFiles: defaultLogMaxFiles,
+	}, nil
+}
+
+// configure applies mobile_nebula.logging.max_size, in bytes, and
+// mobile_nebula.logging.max_files, it is also a reload callback
+func (r *rotatingFile) configure(c *nc.C) {
+	maxSize := int64(c.GetInt("mobile_nebula.logging.max_size", defaultLogMaxSize))
+	maxFiles := c.GetInt("mobile_nebula.logging.max_files", defaultLogMaxFiles)
+
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	r.maxSize = max(maxSize, 1)
+	r.maxFiles = max(maxFiles, 1)
+}
+
+func (r *rotatingFile) Write(p []byte) (int, error) {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+
+	if r.f == nil {
+		return 0, os.ErrClosed
+	}
+
+	if r.size > 0 && r.size+int64(len(p)) > r.maxSize {
+		// The logger has nowhere to report a failed rotation, when the file
+		// could be reopened keep writing to it rather than losing lines
+		if err := r.rotate(); err != nil && r.f == nil {
+			return 0, err
+		}
+	}
+
+	n, err := r.f.Write(p)
+	r.size += int64(n)
+	return n, err
+}
+
+func (r *rotatingFile) rotate() error {
+	_ = r.f.Close()
+
+	var rotateErr error
+	for i := r.maxFiles - 1; i > 0; i-- {
+		from := r.path
+		if i > 1 {
+			from = fmt.Sprintf("%s.%d", r.path, i-1)
+		}
+		err := os.Rename(from, fmt.Sprintf("%s.%d", r.path, i))
+		if err != nil && !os.IsNotExist(err) && rotateErr == nil {
+			rotateErr = err
+		}
+	}
+
+	// With a single file there is nothing to rotate into, start it over
+	flags := os.O_WRONLY | os.O_CREATE | os.O_APPEND
+	if r.maxFiles == 1 {
+		flags |= os.O_TRUNC
+	}
+
+	f, err := os.OpenFile(r.path, flags, 0644)
+	if err != nil {
+		r.f = nil
+		return err
+	}
+
+	r.f = f
+	r.size = 0
+	if fi, err := f.Stat(); err == nil {
+		r.size = fi.Size()
+	}
+	return rotateErr
+}
+
+func (r *rotatingFile) Close() error {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+
+	if r.f == nil {
+		return nil
+	}
+
+	err := r.f.Close()
+	r.f = nil
+	return err
+}
@@ -0,0 +1,176 @@
+package mobileNebula
+
+import (
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"sync"
+	"time"
+
+	"github.com/slackhq/nebula/logging"
+)
+
+const (
+	// logRingEntries and logRingBytes bound the recent log ring, whichever is
+	// hit first evicts the oldest records. The byte count is an estimate of the
+	// text kept, well under the iOS extension memory limit either way.
+	logRingEntries = 2000
+	logRingBytes   = 512 * 1024
+)
+
+// logEntry is a log record as kept by the ring, attrs are flattened to plain
+// values so the ring doesn't pin anything nebula logged
+type logEntry struct {
+	Time    time.Time      `json:"time"`
+	Level   string         `json:"level"`
+	Message string         `json:"msg"`
+	Fields  map[string]any `json:"fields,omitempty"`
+
+	level slog.Level
+	size  int
+}
+
+// logRing keeps the most recent log records in memory for RecentLogs
+type logRing struct {
+	lock    sync.Mutex
+	entries []logEntry
+	start   int
+	count   int
+	size    int
+}
+
+func newLogRing() *logRing {
+	return &logRing{entries: make([]logEntry, logRingEntries)}
+}
+
+// observe is the logObserver feeding the ring
+func (lr *logRing) observe(r slog.Record, attrs []slog.Attr) {
+	e := logEntry{
+		Time:    r.Time,
+		Level:   logging.LevelName(r.Level),
+		Message: r.Message,
+		level:   r.Level,
+		size:    len(r.Message),
+	}
+
+	if len(attrs) > 0 || r.NumAttrs() > 0 {
+		e.Fields = make(map[string]any, len(attrs)+r.NumAttrs())
+		for _, a := range attrs {
+			e.size += addLogField(e.Fields, "", a)
+		}
+		r.Attrs(func(a slog.Attr) bool {
+			e.size += addLogField(e.Fields, "", a)
+			return true
+		})
+	}
+
+	lr.add(e)
+}
+
+func (lr *logRing) add(e logEntry) {
+	lr.lock.Lock()
+	defer lr.lock.Unlock()
+
+	for lr.count > 0 && (lr.count == len(lr.entries) || lr.size+e.size > logRingBytes) {
+		lr.size -= lr.entries[lr.start].size
+		lr.entries[lr.start] = logEntry{}
+		lr.start = (lr.start + 1) % len(lr.entries)
+		lr.count--
+	}
+
+	lr.entries[(lr.start+lr.count)%len(lr.entries)] = e
+	lr.count++
+	lr.size += e.size
+}
+
+// query returns the newest limit records at or above minLevel logged after
+// since, oldest first, a limit below 1 returns all of them
+func (lr *logRing) query(limit int, minLevel slog.Level, since time.Time) []logEntry {
+	lr.lock.Lock()
+	defer lr.lock.Unlock()
+
+	var found []logEntry
+	for i := lr.count - 1; i >= 0; i-- {
+		e := lr.entries[(lr.start+i)%len(lr.entries)]
+		if !e.Time.After(since) {
+			break
+		}
+		if e.level < minLevel {
+			continue
+		}
+
+		found = append(found, e)
+		if len(found) == limit {
+			break
+		}
+	}
+
+	for i, j := 0, len(found)-1; i < j; i, j = i+1, j-1 {
+		found[i], found[j] = found[j], found[i]
+	}
+	return found
+}
+
+// addLogField flattens a into fields, groups become dotted keys, and returns
+// roughly how many bytes it added
+func addLogField(fields map[string]any, prefix string, a slog.Attr) int {
+	v := a.Value.Resolve()
+	key := prefix + a.Key
+
+	switch v.Kind() {
+	case slog.KindGroup:
+		size := 0
+		for _, ga := range v.Group() {
+			size += addLogField(fields, key+".", ga)
+		}
+		return size
+	case slog.KindString:
+		fields[key] = v.String()
+		return len(key) + len(v.String())
+	case slog.KindInt64:
+		fields[key] = v.Int64()
+	case slog.KindUint64:
+		fields[key] = v.Uint64()
+	case slog.KindFloat64:
+		fields[key] = v.Float64()
+	case slog.KindBool:
+		fields[key] = v.Bool()
+	default:
+		s := v.String()
+		if err, ok := v.Any().(error); ok {
+			s = err.Error()
+		}
+		fields[key] = s
+		return len(key) + len(s)
+	}
+	return len(key) + 8
+}
+
+// RecentLogs returns the most recent log records kept in memory as a JSON
+// array, oldest first. limit caps how many are returned, below 1 returns all
+// that match, minLevel is a nebula log level name and an empty one matches
+// every level, sinceUnixMs only returns records logged after it, 0 for all.
+// The ring only holds what the configured log level lets through, and is
+// bounded, so older records fall out of it.
+func (n *Nebula) RecentLogs(limit int, minLevel string, sinceUnixMs int64) (string, error) {
+	level := logging.LevelTrace
+	if minLevel != "" {
+		var err error
+		level, err = logging.ParseLevel(minLevel)
+		if err != nil {
+			return "", fmt.Errorf("failed to parse level: %s", err)
+		}
+	}
+
+	entries := n.logs.query(limit, level, time.UnixMilli(sinceUnixMs))
+	if entries == nil {
+		entries = []logEntry{}
+	}
+
+	b, err := json.Marshal(entries)
+	if err != nil {
+		return "", err
+	}
+
+	return string(b), nil
+}
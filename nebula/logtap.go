@@ -0,0 +1,238 @@
+package mobileNebula
+
+import (
+	"context"
+	"log/slog"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// logObserver is handed the records the configured log level lets through,
+// along with the attributes accumulated on the logger that produced it. It is
+// called inline from nebula's hot paths, often with a hostmap or handshake
+// lock held, so it must not block and must not log.
+type logObserver func(r slog.Record, attrs []slog.Attr)
+
+// logTap wraps the nebula log handler so the binding can watch what nebula
+// logs. nebula has no event hooks of its own, its structured log records are
+// the only place a handshake timeout or a tunnel teardown surfaces outside of
+// the core.
+//
+// logging.ApplyConfig and the sshd log commands find the level and format
+// knobs by type asserting on the handler, so those are forwarded to the
+// wrapped handler.
+type logTap struct {
+	root   *logTapRoot
+	inner  slog.Handler
+	attrs  []slog.Attr
+	prefix string
+}
+
+// logTapRoot is shared by every handler derived from a newLogTap call
+type logTapRoot struct {
+	lock      sync.Mutex
+	observers atomic.Pointer[tapObservers]
+}
+
+type tapObserver struct {
+	fn logObserver
+	// forced observers see records at or above level even when the configured
+	// level drops them
+	forced bool
+	level  slog.Level
+}
+
+// tapObservers is an immutable snapshot, forced and level summarize the forced
+// observers so Enabled doesn't have to walk the list
+type tapObservers struct {
+	list   []*tapObserver
+	forced bool
+	level  slog.Level
+}
+
+func newLogTap(inner slog.Handler) *logTap {
+	return &logTap{root: &logTapRoot{}, inner: inner}
+}
+
+// addObserver registers o for every record logged from now on that the
+// configured level lets through, until the returned func is called
+func (t *logTap) addObserver(o logObserver) func() {
+	return t.add(&tapObserver{fn: o})
+}
+
+// addObserverAt registers o for every record at or above level, whatever the
+// configured level, until the returned func is called. nebula builds every
+// record the observer wants while it is registered, keep it to short windows
+// or to features the user turned on.
+func (t *logTap) addObserverAt(o logObserver, level slog.Level) func() {
+	return t.add(&tapObserver{fn: o, forced: true, level: level})
+}
+
+func (t *logTap) add(op *tapObserver) func() {
+	t.root.lock.Lock()
+	defer t.root.lock.Unlock()
+
+	var observers []*tapObserver
+	if cur := t.root.observers.Load(); cur != nil {
+		observers = append(observers, cur.list...)
+	}
+	t.root.store(append(observers, op))
+
+	return func() {
+		t.root.lock.Lock()
+		defer t.root.lock.Unlock()
+
+		var remaining []*tapObserver
+		for _, cur := range t.root.observers.Load().list {
+			if cur != op {
+				remaining = append(remaining, cur)
+			}
+		}
+		t.root.store(remaining)
+	}
+}
+
+func (r *logTapRoot) store(list []*tapObserver) {
+	snap := &tapObservers{list: list}
+	for _, o := range list {
+		if o.forced && (!snap.forced || o.level < snap.level) {
+			snap.forced, snap.level = true, o.level
+		}
+	}
+	r.observers.Store(snap)
+}
+
+func (t *logTap) loadObservers() *tapObservers {
+	if cur := t.root.observers.Load(); cur != nil {
+		return cur
+	}
+	return &tapObservers{}
+}
+
+func (t *logTap) Enabled(ctx context.Context, l slog.Level) bool {
+	if o := t.loadObservers(); o.forced && l >= o.level {
+		return true
+	}
+	return t.inner.Enabled(ctx, l)
+}
+
+func (t *logTap) Handle(ctx context.Context, r slog.Record) error {
+	var err error
+	enabled := t.inner.Enabled(ctx, r.Level)
+	if enabled {
+		err = t.inner.Handle(ctx, r)
+	}
+
+	observers := t.loadObservers().list
+	if len(observers) == 0 {
+		return err
+	}
+
+	attrs := t.attrs
+	if t.prefix != "" && r.NumAttrs() > 0 {
+		// Qualify the record attrs the same way the accumulated ones are so
+		// observers see one flat namespace
+		nr := slog.NewRecord(r.Time, r.Level, r.Message, r.PC)
+		r.Attrs(func(a slog.Attr) bool {
+			nr.AddAttrs(slog.Attr{Key: t.prefix + a.Key, Value: a.Value})
+			return true
+		})
+		r = nr
+	}
+
+	for _, o := range observers {
+		if enabled || (o.forced && r.Level >= o.level) {
+			o.fn(r, attrs)
+		}
+	}
+	return err
+}
+
+// logAlways writes msg to the wrapped handler whatever the configured level,
+// for the few lines the log file must carry even when the user turned logging
+// down. Observers don't see it.
+func (t *logTap) logAlways(msg string, attrs ...slog.Attr) {
+	r := slog.NewRecord(time.Now(), slog.LevelInfo, msg, 0)
+	r.AddAttrs(attrs...)
+	_ = t.inner.Handle(context.Background(), r)
+}
+
+func (t *logTap) WithAttrs(attrs []slog.Attr) slog.Handler {
+	if len(attrs) == 0 {
+		return t
+	}
+
+	merged := make([]slog.Attr, 0, len(t.attrs)+len(attrs))
+	merged = append(merged, t.attrs...)
+	for _, a := range attrs {
+		merged = append(merged, slog.Attr{Key: t.prefix + a.Key, Value: a.Value})
+	}
+
+	return &logTap{root: t.root, inner: t.inner.WithAttrs(attrs), attrs: merged, prefix: t.prefix}
+}
+
+func (t *logTap) WithGroup(name string) slog.Handler {
+	if name == "" {
+		return t
+	}
+	return &logTap{root: t.root, inner: t.inner.WithGroup(name), attrs: t.attrs, prefix: t.prefix + name + "."}
+}
+
+func (t *logTap) SetLevel(level slog.Level) {
+	if h, ok := t.inner.(interface{ SetLevel(slog.Level) }); ok {
+		h.SetLevel(level)
+	}
+}
+
+func (t *logTap) GetLevel() slog.Level {
+	if h, ok := t.inner.(interface{ GetLevel() slog.Level }); ok {
+		return h.GetLevel()
+	}
+	return slog.LevelInfo
+}
+
+func (t *logTap) SetFormat(format string) error {
+	if h, ok := t.inner.(interface{ SetFormat(string) error }); ok {
+		return h.SetFormat(format)
+	}
+	return nil
+}
+
+func (t *logTap) GetFormat() string {
+	if h, ok := t.inner.(interface{ GetFormat() string }); ok {
+		return h.GetFormat()
+	}
+	return ""
+}
+
+func (t *logTap) SetDisableTimestamp(v bool) {
+	if h, ok := t.inner.(interface{ SetDisableTimestamp(bool) }); ok {
+		h.SetDisableTimestamp(v)
+	}
+}
+
+// findAttr returns the value of key from the record, falling back to the
+// attributes accumulated on the logger
+func findAttr(r slog.Record, attrs []slog.Attr, key string) (slog.Value, bool) {
+	var v slog.Value
+	found := false
+	r.Attrs(func(a slog.Attr) bool {
+		if a.Key == key {
+			v = a.Value.Resolve()
+			found = true
+			return false
+		}
+		return true
+	})
+	if found {
+		return v, true
+	}
+
+	for i := len(attrs) - 1; i >= 0; i-- {
+		if attrs[i].Key == key {
+			return attrs[i].Value.Resolve(), true
+		}
+	}
+	return v, false
+}
@@ -0,0 +1,178 @@
+package mobileNebula
+
+import (
+	"context"
+	"encoding/json"
+	"sync"
+	"time"
+
+	"github.com/rcrowley/go-metrics"
+	nc "github.com/slackhq/nebula/config"
+)
+
+const (
+	// statsTypeLocal keeps nebula's metrics in process for Metrics instead of
+	// exporting them, nebula itself only knows graphite and prometheus
+	statsTypeLocal = "local"
+	// defaultSampleInterval is how often local stats sample the runtime when
+	// stats.interval isn't set
+	defaultSampleInterval = 10 * time.Second
+)
+
+// localStats rewrites stats.type local into a config nebula runs. nebula's
+// exporters stay off, its message and lighthouse metrics default to on and
+// stats.local, a key nebula ignores, tells us to sample.
+func localStats(rawConfig map[string]any) {
+	stats, ok := rawConfig["stats"].(map[string]any)
+	if !ok || stats["type"] != statsTypeLocal {
+		return
+	}
+
+	stats["type"] = "none"
+	stats["local"] = true
+	for _, k := range []string{"message_metrics", "lighthouse_metrics"} {
+		if _, ok := stats[k]; !ok {
+			stats[k] = true
+		}
+	}
+}
+
+// metricsSampler captures the go runtime and gc metrics into nebula's
+// registry, the capture loop nebula runs for its exporters does the same
+type metricsSampler struct {
+	lock     sync.Mutex
+	interval time.Duration
+	cancel   context.CancelFunc
+}
+
+// configure is a reload callback picking up stats.local and stats.interval,
+// the sampler stops with ctx
+func (s *metricsSampler) configure(ctx context.Context, c *nc.C) {
+	interval := time.Duration(0)
+	if c.GetBool("stats.local", false) {
+		interval = c.GetDuration("stats.interval", defaultSampleInterval)
+		if interval <= 0 {
+			interval = defaultSampleInterval
+		}
+	}
+
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	if interval == s.interval {
+		return
+	}
+
+	if s.cancel != nil {
+		s.cancel()
+		s.cancel = nil
+	}
+	s.interval = interval
+	if interval == 0 {
+		return
+	}
+
+	// Registering is guarded by a sync.Once inside go-metrics
+	metrics.RegisterDebugGCStats(metrics.DefaultRegistry)
+	metrics.RegisterRuntimeMemStats(metrics.DefaultRegistry)
+
+	ctx, s.cancel = context.WithCancel(ctx)
+	go func() {
+		t := time.NewTicker(interval)
+		defer t.Stop()
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case <-t.C:
+				metrics.CaptureDebugGCStatsOnce(metrics.DefaultRegistry)
+				metrics.CaptureRuntimeMemStatsOnce(metrics.DefaultRegistry)
+			}
+		}
+	}()
+}
+
+type metricsSnapshot struct {
+	Time time.Time `json:"time"`
+	// Sampling is true when local stats fill in the runtime metrics
+	Sampling bool                      `json:"sampling"`
+	Metrics  map[string]metricSnapshot `json:"metrics"`
+}
+
+// metricSnapshot is one metric, the fields set depend on its type. Timer
+// durations are in nanoseconds.
+type metricSnapshot struct {
+	Type     string   `json:"type"`
+	Count    *int64   `json:"count,omitempty"`
+	Value    *float64 `json:"value,omitempty"`
+	Rate1    *float64 `json:"rate1,omitempty"`
+	Rate5    *float64 `json:"rate5,omitempty"`
+	Rate15   *float64 `json:"rate15,omitempty"`
+	RateMean *float64 `json:"rateMean,omitempty"`
+	Min      *int64   `json:"min,omitempty"`
+	Max      *int64   `json:"max,omitempty"`
+	Mean     *float64 `json:"mean,omitempty"`
+	StdDev   *float64 `json:"stdDev,omitempty"`
+	P50      *float64 `json:"p50,omitempty"`
+	P95      *float64 `json:"p95,omitempty"`
+	P99      *float64 `json:"p99,omitempty"`
+}
+
+// snapshotMetrics reads every metric in r, the types go-metrics has no
+// snapshot for are left out
+func snapshotMetrics(r metrics.Registry) map[string]metricSnapshot {
+	snap := map[string]metricSnapshot{}
+	r.Each(func(name string, i any) {
+		switch m := i.(type) {
+		case metrics.Counter:
+			snap[name] = metricSnapshot{Type: "counter", Count: new(m.Count())}
+		case metrics.Gauge:
+			snap[name] = metricSnapshot{Type: "gauge", Value: new(float64(m.Value()))}
+		case metrics.GaugeFloat64:
+			snap[name] = metricSnapshot{Type: "gauge", Value: new(m.Value())}
+		case metrics.Meter:
+			s := m.Snapshot()
+			ms := metricSnapshot{Type: "meter", Count: new(s.Count())}
+			ms.setRates(s.Rate1(), s.Rate5(), s.Rate15(), s.RateMean())
+			snap[name] = ms
+		case metrics.Histogram:
+			s := m.Snapshot()
+			ms := metricSnapshot{Type: "histogram", Count: new(s.Count())}
+			ms.setSample(s.Min(), s.Max(), s.Mean(), s.StdDev(), s.Percentiles([]float64{0.5, 0.95, 0.99}))
+			snap[name] = ms
+		case metrics.Timer:
+			s := m.Snapshot()
+			ms := metricSnapshot{Type: "timer", Count: new(s.Count())}
+			ms.setRates(s.Rate1(), s.Rate5(), s.Rate15(), s.RateMean())
+			ms.setSample(s.Min(), s.Max(), s.Mean(), s.StdDev(), s.Percentiles([]float64{0.5, 0.95, 0.99}))
+			snap[name] = ms
+		}
+	})
+	return snap
+}
+
+func (m *metricSnapshot) setRates(rate1, rate5, rate15, rateMean float64) {
+	m.Rate1, m.Rate5, m.Rate15, m.RateMean = &rate1, &rate5, &rate15, &rateMean
+}
+
+func (m *metricSnapshot) setSample(lo, hi int64, mean, stdDev float64, ps []float64) {
+	m.Min, m.Max, m.Mean, m.StdDev = &lo, &hi, &mean, &stdDev
+	m.P50, m.P95, m.P99 = &ps[0], &ps[1], &ps[2]
+}
+
+// Metrics returns a JSON snapshot of nebula's metrics registry: handshakes,
+// message counters, firewall drops, lighthouse queries and the like, keyed by
+// metric name. The message and lighthouse metrics need stats.message_metrics
+// and stats.lighthouse_metrics, a stats.type of local turns both on and
+// samples the runtime metrics every stats.interval. The registry is process
+// wide, with several sites running it sums them all.
+func (n *Nebula) Metrics() (string, error) {
+	b, err := json.Marshal(metricsSnapshot{
+		Time:     time.Now(),
+		Sampling: n.config.GetBool("stats.local", false),
+		Metrics:  snapshotMetrics(metrics.DefaultRegistry),
+	})
+	if err != nil {
+		return "", err
+	}
+	return string(b), nil
+}
@@ -75,6 +75,8 @@ func RenderConfig(configData string, key string) (string, error) {
 	}
 	pki["key"] = key
 
+	localStats(rawConfig)
+
 	// Marshal to YAML
 	yamlBytes, err := yaml.Marshal(rawConfig)
 	if err != nil {
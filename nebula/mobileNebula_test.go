@@ -1,13 +1,40 @@
 package mobileNebula
 
 import (
+	"archive/zip"
+	"bytes"
+	"context"
+	"crypto/ed25519"
+	"encoding/binary"
 	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
 	"log/slog"
+	"maps"
+	"net"
+	"net/netip"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"sync"
+	"sync/atomic"
 	"testing"
+	"time"
 
+	"github.com/miekg/dns"
+	"github.com/rcrowley/go-metrics"
+	"github.com/slackhq/nebula"
+	"github.com/slackhq/nebula/cert"
 	nebcfg "github.com/slackhq/nebula/config"
+	"github.com/slackhq/nebula/logging"
+	"github.com/slackhq/nebula/overlay"
+	"github.com/slackhq/nebula/routing"
+	"github.com/slackhq/nebula/util"
 	"github.com/stretchr/testify/assert"
 	"github.com/stretchr/testify/require"
+	"gopkg.in/yaml.v2"
 )
 
 func TestRenderConfig(t *testing.T) {
@@ -399,3 +426,2188 @@ cipher: aes
 	require.True(t, ok, "pki should be a map")
 	assert.Equal(t, "test-ca", pki["ca"])
 }
+
+type fakeEventCallback struct {
+	events chan string
+}
+
+func (f *fakeEventCallback) OnEvent(event string) {
+	f.events <- event
+}
+
+func (f *fakeEventCallback) next(t *testing.T) map[string]interface{} {
+	t.Helper()
+	select {
+	case raw := <-f.events:
+		var e map[string]interface{}
+		require.NoError(t, json.Unmarshal([]byte(raw), &e))
+		return e
+	case <-time.After(time.Second):
+		t.Fatal("timed out waiting for event")
+		return nil
+	}
+}
+
+func TestEventSink(t *testing.T) {
+	cb := &fakeEventCallback{events: make(chan string, 16)}
+	sink := newEventSink(cb)
+
+	c := nebcfg.NewC(slog.New(slog.DiscardHandler))
+	require.NoError(t, c.LoadString("lighthouse:\n  hosts:\n    - 10.1.0.1\n"))
+	sink.loadLighthouses(c)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go sink.run(ctx)
+
+	// Start registers the sink to see info whatever the configured level
+	inner := logging.NewHandler(io.Discard)
+	inner.SetLevel(slog.LevelError)
+	tap := newLogTap(inner)
+	tap.addObserverAt(sink.observe, slog.LevelInfo)
+	l := slog.New(tap)
+
+	lh := []netip.Addr{netip.MustParseAddr("10.1.0.1")}
+	peer := []netip.Addr{netip.MustParseAddr("10.1.0.2")}
+
+	l.Info("Handshake message received", "vpnAddrs", lh, "certName", "lighthouse")
+	e := cb.next(t)
+	assert.Equal(t, EventTunnelUp, e["type"])
+	assert.Equal(t, "lighthouse", e["certName"])
+	assert.Equal(t, []interface{}{"10.1.0.1"}, e["vpnAddrs"])
+
+	e = cb.next(t)
+	assert.Equal(t, EventLighthouseReachable, e["type"])
+
+	// A second tunnel to the same lighthouse is not a reachability change
+	l.Info("Handshake message received", "vpnAddrs", lh, "certName", "lighthouse")
+	assert.Equal(t, EventTunnelUp, cb.next(t)["type"])
+
+	l.With("vpnAddrs", peer, "localIndex", 1).Info("Handshake timed out")
+	e = cb.next(t)
+	assert.Equal(t, EventHandshakeTimeout, e["type"])
+	assert.Equal(t, []interface{}{"10.1.0.2"}, e["vpnAddrs"])
+
+	l.With("vpnAddrs", lh, "certName", "lighthouse").Info("Close tunnel received, tearing down.")
+	e = cb.next(t)
+	assert.Equal(t, EventTunnelDown, e["type"])
+	assert.Equal(t, "closedByRemote", e["reason"])
+	assert.Equal(t, "lighthouse", e["certName"])
+	assert.Equal(t, EventLighthouseUnreachable, cb.next(t)["type"])
+
+	l.With("vpnAddrs", peer).Info("Tunnel status", "tunnelCheck", map[string]any{"state": "alive"})
+	l.With("vpnAddrs", peer).Info("Tunnel status", "tunnelCheck", map[string]any{"state": "dead"})
+	e = cb.next(t)
+	assert.Equal(t, EventTunnelDown, e["type"])
+	assert.Equal(t, "dead", e["reason"])
+
+	// What is still queued when nebula's context ends is delivered
+	draining := newEventSink(cb)
+	draining.emit(event{Type: EventTunnelDown, Reason: "closed"})
+	draining.emit(event{Type: EventReload})
+	done, stop := context.WithCancel(context.Background())
+	stop()
+	draining.run(done)
+	assert.Equal(t, EventTunnelDown, cb.next(t)["type"])
+	assert.Equal(t, EventReload, cb.next(t)["type"])
+
+	// A nil sink is what a Nebula started without a callback holds
+	var none *eventSink
+	none.emit(event{Type: EventReload})
+	none.tunnelDown(peer, "", "closed")
+}
+
+// fakeDevice is an overlay.Device that hands out queued packets on Read and
+// records what is written to it
+type fakeDevice struct {
+	overlay.Device
+	networks []netip.Prefix
+	routes   map[netip.Addr]netip.Addr
+	reads    [][]byte
+	writes   [][]byte
+	// hold, when set, blocks Read once reads runs dry like a quiet tun would
+	hold chan struct{}
+	// blocked, when set, learns a Read is blocked on hold
+	blocked chan struct{}
+	// written, when set, gets a copy of every write, writes can come from
+	// other goroutines
+	written chan []byte
+	lock    sync.Mutex
+}
+
+func (d *fakeDevice) Read(p []byte) (int, error) {
+	if len(d.reads) == 0 {
+		if d.hold != nil {
+			if d.blocked != nil {
+				select {
+				case d.blocked <- struct{}{}:
+				default:
+				}
+			}
+			<-d.hold
+		}
+		return 0, io.EOF
+	}
+	n := copy(p, d.reads[0])
+	d.reads = d.reads[1:]
+	return n, nil
+}
+
+func (d *fakeDevice) Write(p []byte) (int, error) {
+	d.lock.Lock()
+	defer d.lock.Unlock()
+	d.writes = append(d.writes, append([]byte(nil), p...))
+	if d.written != nil {
+		d.written <- append([]byte(nil), p...)
+	}
+	return len(p), nil
+}
+
+func (d *fakeDevice) Networks() []netip.Prefix { return d.networks }
+
+func (d *fakeDevice) RoutesFor(addr netip.Addr) routing.Gateways {
+	if gw, ok := d.routes[addr]; ok {
+		return routing.Gateways{routing.NewGateway(gw, 1)}
+	}
+	return nil
+}
+
+// ipv4Packet builds a bare ipv4 header of the given total length
+func ipv4Packet(src, dst string, length int) []byte {
+	p := make([]byte, length)
+	p[0] = 0x45
+	s, d := netip.MustParseAddr(src).As4(), netip.MustParseAddr(dst).As4()
+	copy(p[12:16], s[:])
+	copy(p[16:20], d[:])
+	return p
+}
+
+func TestTunDeviceTraffic(t *testing.T) {
+	fd := &fakeDevice{
+		networks: []netip.Prefix{netip.MustParsePrefix("10.1.0.0/16")},
+		routes:   map[netip.Addr]netip.Addr{netip.MustParseAddr("192.168.1.5"): netip.MustParseAddr("10.1.0.3")},
+		reads: [][]byte{
+			ipv4Packet("10.1.0.10", "10.1.0.2", 100),
+			ipv4Packet("10.1.0.10", "10.1.0.2", 50),
+			ipv4Packet("10.1.0.10", "192.168.1.5", 60),
+			ipv4Packet("10.1.0.10", "8.8.8.8", 40),
+			{0x00},
+		},
+	}
+	dev := newTunDevice(fd)
+
+	buf := make([]byte, 1500)
+	for range 5 {
+		_, err := dev.Read(buf)
+		require.NoError(t, err)
+	}
+	_, err := dev.Write(ipv4Packet("10.1.0.2", "10.1.0.10", 80))
+	require.NoError(t, err)
+
+	now := time.Now()
+	peer := dev.traffic.peer(netip.MustParseAddr("10.1.0.2")).counters(now)
+	assert.Equal(t, uint64(150), peer.OfferedBytes)
+	assert.Equal(t, uint64(2), peer.OfferedPackets)
+	assert.Equal(t, uint64(80), peer.RxBytes)
+	assert.Equal(t, uint64(1), peer.RxPackets)
+	assert.GreaterOrEqual(t, peer.SinceLastTrafficMs, int64(0))
+
+	// Traffic to an unsafe route belongs to the gateway
+	gw := dev.traffic.peer(netip.MustParseAddr("10.1.0.3")).counters(now)
+	assert.Equal(t, uint64(60), gw.OfferedBytes)
+
+	// Traffic no peer carries only counts in the totals
+	_, tracked := dev.traffic.peers.Load(netip.MustParseAddr("8.8.8.8"))
+	assert.False(t, tracked)
+
+	total := dev.traffic.total.counters(now)
+	assert.Equal(t, uint64(250), total.OfferedBytes)
+	assert.Equal(t, uint64(4), total.OfferedPackets)
+	assert.Equal(t, uint64(80), total.RxBytes)
+
+	idle := dev.traffic.peer(netip.MustParseAddr("10.1.0.99")).counters(now)
+	assert.Equal(t, int64(-1), idle.SinceLastTrafficMs)
+
+	// Firewall drops are attributed from nebula's debug log whatever the
+	// configured level
+	h := logging.NewHandler(io.Discard)
+	h.SetLevel(slog.LevelError)
+	tap := newLogTap(h)
+	tap.addObserverAt(dev.traffic.observe, slog.LevelDebug)
+	hl := slog.New(tap).With("vpnAddrs", []netip.Addr{netip.MustParseAddr("10.1.0.2")})
+	hl.Debug("dropping outbound packet", "reason", "no matching rule")
+	hl.Debug("dropping inbound packet", "reason", "no matching rule")
+	hl.Debug("unrelated")
+	assert.Equal(t, uint64(2), dev.traffic.peer(netip.MustParseAddr("10.1.0.2")).drops.Load())
+
+	// Peers past the bound only count in the totals
+	stats := newTrafficStats()
+	for i := range maxTrafficPeers + 10 {
+		stats.offered(netip.AddrFrom4([4]byte{10, 2, byte(i >> 8), byte(i)}), 10, now)
+	}
+	assert.EqualValues(t, maxTrafficPeers, stats.npeers.Load())
+	assert.Nil(t, stats.peer(netip.MustParseAddr("10.3.0.1")))
+	assert.Equal(t, uint64(maxTrafficPeers+10), stats.total.counters(now).OfferedPackets)
+}
+
+// echoReplyFor turns an echo request built by buildEchoRequest into the reply
+// a peer would send
+func echoReplyFor(req []byte) []byte {
+	p := append([]byte(nil), req...)
+	if p[0]>>4 == 4 {
+		copy(p[12:16], req[16:20])
+		copy(p[16:20], req[12:16])
+		p[20] = 0
+	} else {
+		copy(p[8:24], req[24:40])
+		copy(p[24:40], req[8:24])
+		p[40] = 129
+	}
+	return p
+}
+
+func TestEchoPackets(t *testing.T) {
+	src, dst := netip.MustParseAddr("10.1.0.10"), netip.MustParseAddr("10.1.0.2")
+	req := buildEchoRequest(src, dst, 0x1234, 7)
+	assert.Equal(t, uint16(0), checksum(req[:20], 0), "ipv4 header checksum")
+	assert.Equal(t, uint16(0), checksum(req[20:], 0), "icmp checksum")
+
+	_, _, _, ok := parseEchoReply(req)
+	assert.False(t, ok, "a request is not a reply")
+
+	from, id, seq, ok := parseEchoReply(echoReplyFor(req))
+	require.True(t, ok)
+	assert.Equal(t, dst, from)
+	assert.Equal(t, uint16(0x1234), id)
+	assert.Equal(t, uint16(7), seq)
+
+	src6, dst6 := netip.MustParseAddr("fd00::10"), netip.MustParseAddr("fd00::2")
+	req = buildEchoRequest(src6, dst6, 0x4321, 9)
+	pseudo := checksumSum(req[8:40], 0) + uint32(len(req)-40) + 58
+	assert.Equal(t, uint16(0), checksum(req[40:], pseudo), "icmpv6 checksum")
+
+	from, id, seq, ok = parseEchoReply(echoReplyFor(req))
+	require.True(t, ok)
+	assert.Equal(t, dst6, from)
+	assert.Equal(t, uint16(0x4321), id)
+	assert.Equal(t, uint16(9), seq)
+}
+
+func TestPinger(t *testing.T) {
+	fd := &fakeDevice{
+		networks: []netip.Prefix{netip.MustParsePrefix("10.1.0.10/16")},
+		hold:     make(chan struct{}),
+	}
+	defer close(fd.hold)
+	dev := newTunDevice(fd)
+
+	src, ok := dev.localAddrFor(netip.MustParseAddr("10.1.0.2"))
+	require.True(t, ok)
+	assert.Equal(t, netip.MustParseAddr("10.1.0.10"), src)
+	_, ok = dev.localAddrFor(netip.MustParseAddr("fd00::2"))
+	assert.False(t, ok)
+
+	p := newPinger(dev, src, netip.MustParseAddr("10.1.0.2"))
+	remove := dev.addInboundFilter(p.filter)
+
+	// Play nebula and the peer, answer the first probe and lose the second
+	go func() {
+		buf := make([]byte, 9001)
+		for i := range 2 {
+			n, err := dev.Read(buf)
+			if err != nil || i == 1 {
+				continue
+			}
+			_, _ = dev.Write(echoReplyFor(buf[:n]))
+		}
+	}()
+
+	rtt, answered, err := p.probe(0, time.Second)
+	require.NoError(t, err)
+	assert.True(t, answered)
+	assert.Greater(t, rtt, time.Duration(0))
+
+	_, answered, err = p.probe(1, 20*time.Millisecond)
+	require.NoError(t, err)
+	assert.False(t, answered)
+
+	// The answer was consumed, anything else still reaches the OS
+	assert.Empty(t, fd.writes)
+	_, err = dev.Write(ipv4Packet("10.1.0.2", "10.1.0.10", 60))
+	require.NoError(t, err)
+	assert.Len(t, fd.writes, 1)
+
+	remove()
+	_, err = dev.Write(echoReplyFor(buildEchoRequest(src, netip.MustParseAddr("10.1.0.2"), p.id, 0)))
+	require.NoError(t, err)
+	assert.Len(t, fd.writes, 2, "a removed filter no longer consumes")
+
+	// Both probes crossed the device
+	assert.Equal(t, uint64(2), dev.traffic.peer(netip.MustParseAddr("10.1.0.2")).counters(time.Now()).OfferedPackets)
+}
+
+func testCertPEM(t *testing.T, networks ...string) string {
+	b, err := testCert(t, "test", nil, networks...).MarshalPEM()
+	require.NoError(t, err)
+	return string(b)
+}
+
+func testCert(t *testing.T, name string, groups []string, networks ...string) cert.Certificate {
+	pub, priv, err := ed25519.GenerateKey(nil)
+	require.NoError(t, err)
+
+	tbs := cert.TBSCertificate{
+		Version:   cert.Version1,
+		Name:      name,
+		Groups:    groups,
+		IsCA:      true,
+		NotBefore: time.Now().Add(-time.Hour),
+		NotAfter:  time.Now().Add(time.Hour),
+		PublicKey: pub,
+		Curve:     cert.Curve_CURVE25519,
+	}
+	for _, n := range networks {
+		tbs.Networks = append(tbs.Networks, netip.MustParsePrefix(n))
+	}
+
+	c, err := tbs.Sign(nil, cert.Curve_CURVE25519, priv)
+	require.NoError(t, err)
+	return c
+}
+
+func TestDiffConfigs(t *testing.T) {
+	base := map[string]any{
+		"pki":      map[string]any{"cert": testCertPEM(t, "10.1.0.1/16"), "key": "a"},
+		"tun":      map[string]any{"mtu": 1300},
+		"listen":   map[string]any{"port": 0, "send_recv_error": "always"},
+		"firewall": map[string]any{"outbound": []any{map[string]any{"port": "any", "proto": "any", "host": "any"}}},
+	}
+	render := func(changes map[string]any) string {
+		cfg := map[string]any{}
+		for k, v := range base {
+			cfg[k] = v
+		}
+		for k, v := range changes {
+			cfg[k] = v
+		}
+		b, err := yaml.Marshal(cfg)
+		require.NoError(t, err)
+		return string(b)
+	}
+
+	sections := func(r *reloadReport) []string {
+		var s []string
+		for _, rr := range r.RestartRequired {
+			s = append(s, rr.Section)
+		}
+		return s
+	}
+
+	// Nothing changed
+	r, err := diffConfigs(render(nil), render(nil))
+	require.NoError(t, err)
+	assert.Empty(t, r.Changed)
+	assert.Empty(t, r.RestartRequired)
+	assert.False(t, r.Reconnect)
+
+	// Live changes, including a renewed cert with the same networks
+	r, err = diffConfigs(render(nil), render(map[string]any{
+		"pki":      map[string]any{"cert": testCertPEM(t, "10.1.0.1/16"), "key": "b"},
+		"listen":   map[string]any{"port": 0, "send_recv_error": "never"},
+		"firewall": map[string]any{},
+		"punchy":   map[string]any{"punch": true},
+	}))
+	require.NoError(t, err)
+	assert.Equal(t, []string{"firewall", "listen", "pki", "punchy"}, r.Changed)
+	assert.Empty(t, r.RestartRequired)
+	assert.False(t, r.Reconnect)
+
+	// Changes that need a reconnect
+	r, err = diffConfigs(render(nil), render(map[string]any{
+		"pki":    map[string]any{"cert": testCertPEM(t, "10.1.0.2/16"), "key": "a"},
+		"tun":    map[string]any{"mtu": 1280},
+		"listen": map[string]any{"port": 4242, "send_recv_error": "always"},
+		"cipher": "chachapoly",
+	}))
+	require.NoError(t, err)
+	assert.Equal(t, []string{"cipher", "listen", "pki", "tun"}, r.Changed)
+	assert.Equal(t, []string{"tun", "cipher", "listen", "pki"}, sections(r))
+	assert.True(t, r.Reconnect)
+
+	_, err = diffConfigs(render(nil), "pki: [")
+	assert.Error(t, err)
+}
+
+func TestApplyReload(t *testing.T) {
+	tap := newLogTap(logging.NewHandler(io.Discard))
+	l := slog.New(tap)
+
+	good := "firewall:\n  rule: a\n"
+	c := nebcfg.NewC(l)
+	require.NoError(t, c.LoadString(good))
+
+	var applied []string
+	c.RegisterReloadCallback(func(c *nebcfg.C) {
+		if !c.HasChanged("firewall") {
+			return
+		}
+		if c.GetBool("firewall.bad", false) {
+			l.Error("Error while creating firewall during reload", "error", "bad rule")
+			return
+		}
+		if c.GetBool("firewall.badContext", false) {
+			util.NewContextualError("Invalid lighthouse.local_allow_list", nil, errors.New("bad cidr")).Log(l)
+			return
+		}
+		// The packet path failing meanwhile is not the reload's doing
+		if c.GetBool("firewall.noise", false) {
+			l.Error("Failed to write outgoing packet", "error", "boom")
+		}
+		applied = append(applied, c.GetString("firewall.rule", ""))
+	})
+
+	n := &Nebula{l: l, config: c, tap: tap, yamlConfig: good, events: newEventSink(&fakeEventCallback{})}
+
+	// A clean reload becomes the new rollback point
+	require.NoError(t, n.applyReload("firewall:\n  rule: b\n"))
+	assert.Equal(t, []string{"b"}, applied)
+	assert.Equal(t, "firewall:\n  rule: b\n", n.yamlConfig)
+
+	// A reload nebula logs an error for goes back to the last good config
+	err := n.applyReload("firewall:\n  rule: c\n  bad: true\n")
+	require.EqualError(t, err, "reload failed and was rolled back: Error while creating firewall during reload: bad rule")
+	assert.Equal(t, []string{"b", "b"}, applied)
+	assert.Equal(t, "firewall:\n  rule: b\n", n.yamlConfig)
+	assert.Equal(t, "b", c.GetString("firewall.rule", ""))
+
+	// The error observer doesn't outlive the reload
+	l.Error("unrelated")
+	require.NoError(t, n.applyReload("firewall:\n  rule: d\n"))
+	assert.Equal(t, []string{"b", "b", "d"}, applied)
+
+	require.NoError(t, n.applyReload("firewall:\n  rule: e\n  noise: true\n"))
+	assert.Equal(t, []string{"b", "b", "d", "e"}, applied)
+
+	err = n.applyReload("firewall:\n  rule: f\n  badContext: true\n")
+	require.EqualError(t, err, "reload failed and was rolled back: Invalid lighthouse.local_allow_list: bad cidr")
+	assert.Equal(t, "firewall:\n  rule: e\n  noise: true\n", n.yamlConfig)
+
+	var types []string
+	for len(n.events.queue) > 0 {
+		types = append(types, (<-n.events.queue).Type)
+	}
+	assert.Equal(t, []string{EventReload, EventReloadFailed, EventReload, EventReload, EventReloadFailed}, types)
+}
+
+func TestRememberForWake(t *testing.T) {
+	addr := netip.MustParseAddr
+	dev := newTunDevice(&fakeDevice{networks: []netip.Prefix{netip.MustParsePrefix("10.1.0.0/16")}})
+	now := time.Now()
+	for i, a := range []string{"10.1.0.2", "10.1.0.3", "10.1.0.4", "10.1.0.5", "8.8.8.8"} {
+		dev.traffic.peer(addr(a)).addOffered(10, now.Add(-time.Duration(i)*time.Minute).UnixNano())
+	}
+	// Too long ago to count
+	dev.traffic.peer(addr("10.1.0.6")).addOffered(10, now.Add(-time.Hour).UnixNano())
+
+	hosts := []nebula.ControlHostInfo{
+		{VpnAddrs: []netip.Addr{addr("10.1.0.2")}},
+		{VpnAddrs: []netip.Addr{addr("10.1.0.4")}},
+		{VpnAddrs: []netip.Addr{addr("10.1.0.5")}},
+		{VpnAddrs: []netip.Addr{addr("10.1.0.6")}},
+	}
+
+	c := nebcfg.NewC(slog.New(logging.NewHandler(io.Discard)))
+	require.NoError(t, c.LoadString("pki: {}\n"))
+	n := &Nebula{config: c, dev: dev}
+
+	n.rememberForWake(hosts)
+	assert.Equal(t, []netip.Addr{addr("10.1.0.2"), addr("10.1.0.4"), addr("10.1.0.5")}, n.wakePeers)
+
+	require.NoError(t, c.LoadString("mobile_nebula:\n  wake:\n    max_peers: 2\n    recent_traffic: 2h\n"))
+	n.rememberForWake(hosts)
+	assert.Equal(t, []netip.Addr{addr("10.1.0.2"), addr("10.1.0.4")}, n.wakePeers)
+
+	require.NoError(t, c.LoadString("mobile_nebula:\n  wake:\n    max_peers: 0\n"))
+	n.rememberForWake(hosts)
+	assert.Empty(t, n.wakePeers)
+}
+
+func TestRebindDecision(t *testing.T) {
+	wifi, err := parseNetworkInfo(`{"type": "wifi", "ipv4": true, "ipv6": true, "localAddrs": ["192.168.1.5", "::ffff:10.0.0.1", "fd00::5", "192.168.1.5"]}`)
+	require.NoError(t, err)
+	assert.Equal(t, []netip.Addr{netip.MustParseAddr("10.0.0.1"), netip.MustParseAddr("192.168.1.5"), netip.MustParseAddr("fd00::5")}, wifi.LocalAddrs)
+
+	rebind, why := rebindDecision(nil, wifi)
+	assert.True(t, rebind, why)
+
+	// Reordered addresses and a metered flip are the same network
+	same, err := parseNetworkInfo(`{"type": "wifi", "metered": true, "ipv4": true, "ipv6": true, "localAddrs": ["fd00::5", "192.168.1.5", "10.0.0.1"]}`)
+	require.NoError(t, err)
+	rebind, why = rebindDecision(&wifi, same)
+	assert.False(t, rebind)
+	assert.Equal(t, "nothing material changed", why)
+
+	cell := wifi
+	cell.Type = "cellular"
+	rebind, why = rebindDecision(&wifi, cell)
+	assert.True(t, rebind)
+	assert.Equal(t, "network type changed", why)
+
+	v4Only := wifi
+	v4Only.IPv6 = false
+	rebind, why = rebindDecision(&wifi, v4Only)
+	assert.True(t, rebind)
+	assert.Equal(t, "address families changed", why)
+
+	moved := wifi
+	moved.LocalAddrs = []netip.Addr{netip.MustParseAddr("192.168.2.9")}
+	rebind, why = rebindDecision(&wifi, moved)
+	assert.True(t, rebind)
+	assert.Equal(t, "local addresses changed", why)
+
+	rebind, why = rebindDecision(&wifi, networkInfo{Type: "wifi"})
+	assert.False(t, rebind)
+	assert.Equal(t, "no usable network", why)
+
+	_, err = parseNetworkInfo(`{"localAddrs": ["nope"]}`)
+	assert.Error(t, err)
+}
+
+func TestPreferLocalRanges(t *testing.T) {
+	wifi, err := parseNetworkInfo(`{"type": "wifi", "ipv4": true, "localNetworks": ["192.168.1.5/24", "10.0.0.1/8", "192.168.1.0/24"]}`)
+	require.NoError(t, err)
+	lan := []netip.Prefix{netip.MustParsePrefix("10.0.0.0/8"), netip.MustParsePrefix("192.168.1.0/24")}
+	assert.Equal(t, lan, localRangesFor(wifi))
+	assert.Empty(t, localRangesFor(networkInfo{Type: "cellular", LocalNetworks: lan}))
+
+	ranges := func(yamlConfig string) []any {
+		cfg, err := yamlToJSONMap([]byte(yamlConfig))
+		require.NoError(t, err)
+		r, _ := cfg["preferred_ranges"].([]any)
+		return r
+	}
+
+	// The site's own range stays the site's
+	site := "preferred_ranges:\n  - 10.0.0.0/8\nlisten:\n  port: 4242\n"
+	yamlConfig, added, err := editPreferredRanges(site, nil, lan)
+	require.NoError(t, err)
+	assert.Equal(t, []netip.Prefix{netip.MustParsePrefix("192.168.1.0/24")}, added)
+	assert.Equal(t, []any{"10.0.0.0/8", "192.168.1.0/24"}, ranges(yamlConfig))
+
+	// Leaving wifi takes back only what was added
+	yamlConfig, added, err = editPreferredRanges(yamlConfig, added, nil)
+	require.NoError(t, err)
+	assert.Empty(t, added)
+	assert.Equal(t, []any{"10.0.0.0/8"}, ranges(yamlConfig))
+
+	yamlConfig, added, err = editPreferredRanges("listen:\n  port: 4242\n", nil, lan)
+	require.NoError(t, err)
+	assert.Equal(t, lan, added)
+	yamlConfig, _, err = editPreferredRanges(yamlConfig, added, nil)
+	require.NoError(t, err)
+	assert.NotContains(t, yamlConfig, "preferred_ranges")
+
+	unchanged, added, err := editPreferredRanges(site, nil, nil)
+	require.NoError(t, err)
+	assert.Equal(t, site, unchanged)
+	assert.Empty(t, added)
+
+	// The running config takes the ranges without a reload event
+	l := slog.New(slog.DiscardHandler)
+	c := nebcfg.NewC(l)
+	require.NoError(t, c.LoadString(site))
+	var changed []string
+	c.RegisterReloadCallback(func(c *nebcfg.C) {
+		for _, k := range []string{"preferred_ranges", "listen"} {
+			if c.HasChanged(k) {
+				changed = append(changed, k)
+			}
+		}
+	})
+	n := &Nebula{l: l, config: c, yamlConfig: site, events: newEventSink(&fakeEventCallback{})}
+	require.NoError(t, n.setPreferredRanges(lan))
+	assert.Equal(t, []string{"preferred_ranges"}, changed)
+	assert.Equal(t, []string{"10.0.0.0/8", "192.168.1.0/24"}, c.GetStringSlice("preferred_ranges", nil))
+	assert.Equal(t, lan, n.localRanges)
+
+	require.NoError(t, n.setPreferredRanges(nil))
+	assert.Equal(t, []string{"10.0.0.0/8"}, c.GetStringSlice("preferred_ranges", nil))
+	assert.Empty(t, n.addedRanges)
+	assert.Empty(t, n.events.queue)
+}
+
+func TestLogTapLevels(t *testing.T) {
+	h := logging.NewHandler(io.Discard)
+	h.SetLevel(slog.LevelWarn)
+	tap := newLogTap(h)
+	l := slog.New(tap)
+	ctx := context.Background()
+
+	var plain, forced []string
+	tap.addObserver(func(r slog.Record, _ []slog.Attr) { plain = append(plain, r.Message) })
+	assert.False(t, tap.Enabled(ctx, slog.LevelInfo), "a plain observer must not lower the level")
+
+	remove := tap.addObserverAt(func(r slog.Record, _ []slog.Attr) { forced = append(forced, r.Message) }, slog.LevelInfo)
+	assert.True(t, tap.Enabled(ctx, slog.LevelInfo))
+	assert.False(t, tap.Enabled(ctx, slog.LevelDebug))
+
+	l.Debug("debug")
+	l.Info("info")
+	l.Warn("warn")
+	assert.Equal(t, []string{"warn"}, plain)
+	assert.Equal(t, []string{"info", "warn"}, forced)
+
+	remove()
+	assert.False(t, tap.Enabled(ctx, slog.LevelInfo))
+	l.Info("after")
+	assert.Equal(t, []string{"info", "warn"}, forced)
+
+	// logAlways reaches the writer above the configured level, without the observers
+	var buf bytes.Buffer
+	h = logging.NewHandler(&buf)
+	h.SetLevel(slog.LevelError)
+	tap = newLogTap(h)
+	tap.addObserver(func(r slog.Record, _ []slog.Attr) { plain = append(plain, r.Message) })
+	slog.New(tap).Info("dropped")
+	tap.logAlways("Starting new session", slog.Int("pid", 7))
+	assert.NotContains(t, buf.String(), "dropped")
+	assert.Contains(t, buf.String(), `msg="Starting new session" pid=7`)
+	assert.Equal(t, []string{"warn"}, plain)
+}
+
+func TestLogRing(t *testing.T) {
+	h := logging.NewHandler(io.Discard)
+	tap := newLogTap(h)
+	ring := newLogRing()
+	tap.addObserver(ring.observe)
+	l := slog.New(tap)
+
+	start := time.Now()
+	l.Debug("dropped, the level doesn't let it through")
+	l.Info("hello", "vpnAddrs", []netip.Addr{netip.MustParseAddr("10.1.0.2")}, slog.Group("tunnelCheck", "state", "dead"))
+	l.With("handshake", 1).Warn("careful", "error", errors.New("boom"))
+	h.SetLevel(slog.LevelDebug)
+	l.Debug("debugging")
+
+	n := &Nebula{logs: ring}
+	var entries []logEntry
+	out, err := n.RecentLogs(0, "", 0)
+	require.NoError(t, err)
+	require.NoError(t, json.Unmarshal([]byte(out), &entries))
+	require.Len(t, entries, 3)
+	assert.Equal(t, "hello", entries[0].Message)
+	assert.Equal(t, "info", entries[0].Level)
+	assert.Equal(t, map[string]any{"vpnAddrs": "[10.1.0.2]", "tunnelCheck.state": "dead"}, entries[0].Fields)
+	assert.Equal(t, map[string]any{"handshake": float64(1), "error": "boom"}, entries[1].Fields)
+	assert.Equal(t, "debugging", entries[2].Message)
+
+	out, err = n.RecentLogs(1, "warn", start.UnixMilli()-1)
+	require.NoError(t, err)
+	require.NoError(t, json.Unmarshal([]byte(out), &entries))
+	require.Len(t, entries, 1)
+	assert.Equal(t, "careful", entries[0].Message)
+
+	out, err = n.RecentLogs(0, "", time.Now().Add(time.Hour).UnixMilli())
+	require.NoError(t, err)
+	assert.Equal(t, "[]", out)
+
+	_, err = n.RecentLogs(0, "loud", 0)
+	assert.Error(t, err)
+
+	// The ring is bounded by entries
+	for i := range logRingEntries + 10 {
+		l.Info("filler", "i", i)
+	}
+	got := ring.query(0, slog.LevelInfo, time.Time{})
+	require.Len(t, got, logRingEntries)
+	assert.Equal(t, int64(10), got[0].Fields["i"])
+
+	// and by size
+	big := strings.Repeat("x", 1000)
+	for range logRingBytes/1000 + 10 {
+		l.Info(big)
+	}
+	got = ring.query(0, slog.LevelInfo, time.Time{})
+	assert.Len(t, got, logRingBytes/1000)
+	assert.Equal(t, big, got[0].Message)
+	assert.LessOrEqual(t, ring.size, logRingBytes)
+}
+
+func TestRotatingFile(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "log")
+	require.NoError(t, os.WriteFile(path, []byte("previous\n"), 0644))
+
+	r, err := openRotatingFile(path)
+	require.NoError(t, err)
+	defer r.Close()
+
+	c := nebcfg.NewC(slog.New(logging.NewHandler(io.Discard)))
+	require.NoError(t, c.LoadString("mobile_nebula:\n  logging:\n    max_size: 20\n    max_files: 3\n"))
+	r.configure(c)
+
+	read := func(p string) string {
+		b, err := os.ReadFile(p)
+		require.NoError(t, err)
+		return string(b)
+	}
+
+	write := func(lines ...string) {
+		for _, line := range lines {
+			_, err := r.Write([]byte(line))
+			require.NoError(t, err)
+		}
+	}
+
+	// Appends to the previous session
+	write("line 001\n")
+	assert.Equal(t, "previous\nline 001\n", read(path))
+
+	// Rotates once the next write would pass max_size
+	write("line 002\n", "line 003\n")
+	assert.Equal(t, "line 002\nline 003\n", read(path))
+	assert.Equal(t, "previous\nline 001\n", read(path+".1"))
+
+	// Only max_files are kept
+	write("line 004\n", "line 005\n", "line 006\n")
+	assert.Equal(t, "line 006\n", read(path))
+	assert.Equal(t, "line 004\nline 005\n", read(path+".1"))
+	assert.Equal(t, "line 002\nline 003\n", read(path+".2"))
+	assert.NoFileExists(t, path+".3")
+
+	require.NoError(t, r.Close())
+	_, err = r.Write([]byte("closed"))
+	assert.ErrorIs(t, err, os.ErrClosed)
+}
+
+func TestDiagnosticBundle(t *testing.T) {
+	dir := t.TempDir()
+	logFile := filepath.Join(dir, "log")
+	require.NoError(t, os.WriteFile(logFile, []byte("current\n"), 0644))
+	require.NoError(t, os.WriteFile(logFile+".1", []byte("older\n"), 0644))
+
+	rawConfig, err := json.Marshal(map[string]any{
+		"pki": map[string]any{
+			"ca":   testCertPEM(t, "10.1.0.0/16"),
+			"cert": testCertPEM(t, "10.1.0.2/16"),
+			"key":  "SECRET-PKI-KEY",
+		},
+		"sshd":   map[string]any{"host_key": "SECRET-SSH-KEY"},
+		"listen": map[string]any{"port": 4242},
+	})
+	require.NoError(t, err)
+
+	configData, err := json.Marshal(map[string]any{
+		"name":          "bundle",
+		"id":            "1234",
+		"managed":       true,
+		"rawConfig":     string(rawConfig),
+		"key":           "SECRET-SITE-KEY",
+		"dnCredentials": map[string]any{"hostID": "host-1", "privateKey": "SECRET-DN-KEY"},
+	})
+	require.NoError(t, err)
+
+	out := filepath.Join(dir, "bundle.zip")
+	require.NoError(t, DiagnosticBundle(string(configData), logFile, out))
+
+	zr, err := zip.OpenReader(out)
+	require.NoError(t, err)
+	defer zr.Close()
+
+	files := map[string]string{}
+	for _, f := range zr.File {
+		r, err := f.Open()
+		require.NoError(t, err)
+		b, err := io.ReadAll(r)
+		require.NoError(t, err)
+		r.Close()
+		files[f.Name] = string(b)
+
+		assert.NotContains(t, files[f.Name], "SECRET", f.Name)
+	}
+
+	assert.ElementsMatch(t, []string{"build.json", "site.json", "config.yaml", "pki-cert.json", "pki-ca.json", "log", "log.1"}, slices.Collect(maps.Keys(files)))
+	assert.Equal(t, "current\n", files["log"])
+	assert.Equal(t, "older\n", files["log.1"])
+	assert.Contains(t, files["config.yaml"], "key: '[redacted]'")
+	assert.Contains(t, files["site.json"], `"privateKey": "[redacted]"`)
+	assert.Contains(t, files["site.json"], `"hostID": "host-1"`)
+	assert.Contains(t, files["pki-cert.json"], "10.1.0.2/16")
+
+	// Pieces that can't be gathered are noted, not fatal
+	require.NoError(t, DiagnosticBundle(`{"rawConfig": "{}"}`, filepath.Join(dir, "missing"), out))
+	zr2, err := zip.OpenReader(out)
+	require.NoError(t, err)
+	defer zr2.Close()
+	var names []string
+	for _, f := range zr2.File {
+		names = append(names, f.Name)
+	}
+	assert.Contains(t, names, "errors.txt")
+
+	assert.Error(t, DiagnosticBundle("{}", logFile, filepath.Join(dir, "nope", "bundle.zip")))
+}
+
+func TestQueryHosts(t *testing.T) {
+	addr := netip.MustParseAddr
+	host := func(vpnAddr string, name string, groups []string, relayed bool) nebula.ControlHostInfo {
+		h := nebula.ControlHostInfo{
+			VpnAddrs: []netip.Addr{addr(vpnAddr)},
+			Cert:     testCert(t, name, groups, vpnAddr+"/16"),
+		}
+		if relayed {
+			h.CurrentRelaysToMe = []netip.Addr{addr("10.1.0.1")}
+		} else {
+			h.CurrentRemote = netip.MustParseAddrPort("192.168.1.2:4242")
+		}
+		return h
+	}
+
+	hosts := []nebula.ControlHostInfo{
+		host("10.1.0.5", "phone-alice", []string{"phone"}, false),
+		host("10.1.0.3", "laptop-bob", []string{"laptop", "admin"}, true),
+		host("10.2.0.9", "phone-bob", []string{"phone"}, true),
+		host("10.1.0.4", "server", []string{"server"}, false),
+	}
+	seen := map[netip.Addr]int64{addr("10.1.0.5"): 1000, addr("10.2.0.9"): 60000}
+	since := func(a netip.Addr) int64 {
+		if s, ok := seen[a]; ok {
+			return s
+		}
+		return -1
+	}
+
+	vpnAddrs := func(p hostmapPage) []string {
+		var s []string
+		for _, h := range p.Hosts {
+			s = append(s, h.VpnAddrs[0].String())
+		}
+		return s
+	}
+
+	relayed := true
+	tests := []struct {
+		name  string
+		q     hostmapQuery
+		total int
+		want  []string
+	}{
+		{name: "everything, ordered", q: hostmapQuery{}, total: 4, want: []string{"10.1.0.3", "10.1.0.4", "10.1.0.5", "10.2.0.9"}},
+		{name: "name", q: hostmapQuery{Name: "BOB"}, total: 2, want: []string{"10.1.0.3", "10.2.0.9"}},
+		{name: "group", q: hostmapQuery{Group: "phone"}, total: 2, want: []string{"10.1.0.5", "10.2.0.9"}},
+		{name: "cidr", q: hostmapQuery{Cidr: "10.1.0.4/31"}, total: 2, want: []string{"10.1.0.4", "10.1.0.5"}},
+		{name: "relayed", q: hostmapQuery{Relayed: &relayed}, total: 2, want: []string{"10.1.0.3", "10.2.0.9"}},
+		{name: "seen", q: hostmapQuery{SeenWithinMs: 5000}, total: 1, want: []string{"10.1.0.5"}},
+		{name: "page", q: hostmapQuery{Offset: 1, Limit: 2}, total: 4, want: []string{"10.1.0.4", "10.1.0.5"}},
+		{name: "past the end", q: hostmapQuery{Offset: 10}, total: 4, want: nil},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			p, err := queryHosts(hosts, tt.q, since)
+			require.NoError(t, err)
+			assert.Equal(t, tt.total, p.Total)
+			assert.Equal(t, tt.want, vpnAddrs(p))
+		})
+	}
+
+	p, err := queryHosts(hosts, hostmapQuery{Name: "laptop"}, since)
+	require.NoError(t, err)
+	require.Len(t, p.Hosts, 1)
+	assert.True(t, p.Hosts[0].Relayed)
+	assert.Equal(t, addr("10.1.0.1"), p.Hosts[0].Relay)
+	assert.Equal(t, int64(-1), p.Hosts[0].SinceLastTrafficMs)
+	assert.Equal(t, "laptop-bob", p.Hosts[0].Cert["name"])
+	assert.Equal(t, []string{"laptop", "admin"}, p.Hosts[0].Cert["groups"])
+
+	_, err = queryHosts(hosts, hostmapQuery{Cidr: "nope"}, since)
+	assert.Error(t, err)
+	_, err = queryHosts(hosts, hostmapQuery{Limit: -1}, since)
+	assert.Error(t, err)
+}
+
+func TestKeepPinnedRemotes(t *testing.T) {
+	oldRaw, err := json.Marshal(map[string]any{"pki": map[string]any{"cert": "old"}})
+	require.NoError(t, err)
+	oldSite, err := json.Marshal(map[string]any{"name": "managed", "managed": true, "rawConfig": string(oldRaw)})
+	require.NoError(t, err)
+	pinned, err := PinRemote(string(oldSite), "10.1.0.5", "192.168.1.5:4242")
+	require.NoError(t, err)
+	pinned, err = PinRemote(pinned, "10.1.0.6", "192.168.1.6:4242")
+	require.NoError(t, err)
+	pinnedRaw, err := siteRawConfig(pinned)
+	require.NoError(t, err)
+	oldRawConfig, err := json.Marshal(pinnedRaw)
+	require.NoError(t, err)
+
+	// A managed update hands back a whole new rawConfig, one that pins a peer
+	// of its own
+	newRaw, err := json.Marshal(map[string]any{
+		"pki":           map[string]any{"cert": "new"},
+		"mobile_nebula": map[string]any{"pinned_remotes": map[string]any{"10.1.0.6": "10.9.9.9:4242"}},
+	})
+	require.NoError(t, err)
+	updated, err := json.Marshal(map[string]any{"name": "managed", "managed": true, "rawConfig": string(newRaw)})
+	require.NoError(t, err)
+
+	site, err := KeepPinnedRemotes(string(updated), string(oldRawConfig))
+	require.NoError(t, err)
+	pins, err := ListPinnedRemotes(site)
+	require.NoError(t, err)
+	assert.JSONEq(t, `{"10.1.0.5": "192.168.1.5:4242", "10.1.0.6": "10.9.9.9:4242"}`, pins)
+
+	raw, err := siteRawConfig(site)
+	require.NoError(t, err)
+	assert.Equal(t, map[string]any{"cert": "new"}, raw["pki"], "the rest of the update stands")
+
+	// Nothing pinned leaves the update alone
+	site, err = KeepPinnedRemotes(string(updated), string(oldRaw))
+	require.NoError(t, err)
+	assert.Equal(t, string(updated), site)
+
+	_, err = KeepPinnedRemotes(string(updated), "nope")
+	assert.Error(t, err)
+}
+
+func TestPinnedRemotes(t *testing.T) {
+	rawConfig, err := json.Marshal(map[string]any{
+		"pki":             map[string]any{"cert": "cert"},
+		"static_host_map": map[string]any{"10.1.0.1": []any{"1.2.3.4:4242"}},
+	})
+	require.NoError(t, err)
+	configData, err := json.Marshal(map[string]any{"name": "pins", "rawConfig": string(rawConfig)})
+	require.NoError(t, err)
+
+	site, err := PinRemote(string(configData), "10.1.0.5", "192.168.1.5:4242")
+	require.NoError(t, err)
+	site, err = PinRemote(site, "10.1.0.1", "5.6.7.8:4242")
+	require.NoError(t, err)
+
+	pins, err := ListPinnedRemotes(site)
+	require.NoError(t, err)
+	assert.JSONEq(t, `{"10.1.0.5": "192.168.1.5:4242", "10.1.0.1": "5.6.7.8:4242"}`, pins)
+
+	var d map[string]any
+	require.NoError(t, json.Unmarshal([]byte(site), &d))
+	assert.Equal(t, "pins", d["name"])
+
+	// Pinned peers don't become static hosts, the pin moves their tunnel
+	yamlConfig, err := RenderConfig(site, "key")
+	require.NoError(t, err)
+	c := nebcfg.NewC(slog.New(slog.DiscardHandler))
+	require.NoError(t, c.LoadString(yamlConfig))
+	assert.Equal(t, map[string]any{"10.1.0.1": []any{"1.2.3.4:4242"}}, c.GetMap("static_host_map", nil))
+
+	p := newRemotePins(slog.New(slog.DiscardHandler))
+	p.load(c)
+	remote, ok := p.pinFor(netip.MustParseAddr("10.1.0.5"))
+	assert.True(t, ok)
+	assert.Equal(t, netip.MustParseAddrPort("192.168.1.5:4242"), remote)
+
+	// Loading queues every pin for the tunnels that already exist
+	assert.Len(t, p.queue, 2)
+	for len(p.queue) > 0 {
+		<-p.queue
+	}
+
+	// A tunnel to a pinned peer coming up gets its pin applied
+	applied := make(chan netip.Addr, 4)
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go p.run(ctx, func(vpnAddr netip.Addr, remote netip.AddrPort) bool {
+		applied <- vpnAddr
+		return true
+	})
+
+	r := slog.NewRecord(time.Now(), slog.LevelInfo, "Handshake message received", 0)
+	r.AddAttrs(slog.Any("vpnAddrs", []netip.Addr{netip.MustParseAddr("10.1.0.9")}))
+	p.observe(r, nil)
+	r = slog.NewRecord(time.Now(), slog.LevelInfo, "Handshake message received", 0)
+	r.AddAttrs(slog.Any("vpnAddrs", []netip.Addr{netip.MustParseAddr("10.1.0.5")}))
+	p.observe(r, nil)
+
+	select {
+	case got := <-applied:
+		assert.Equal(t, netip.MustParseAddr("10.1.0.5"), got)
+	case <-time.After(5 * time.Second):
+		t.Fatal("pin was not applied")
+	}
+
+	site, err = UnpinRemote(site, "10.1.0.5")
+	require.NoError(t, err)
+	site, err = UnpinRemote(site, "10.1.0.1")
+	require.NoError(t, err)
+	pins, err = ListPinnedRemotes(site)
+	require.NoError(t, err)
+	assert.Equal(t, "{}", pins)
+	require.NoError(t, json.Unmarshal([]byte(site), &d))
+	assert.NotContains(t, d["rawConfig"], "mobile_nebula")
+
+	_, err = PinRemote(site, "nope", "1.2.3.4:4242")
+	assert.Error(t, err)
+	_, err = PinRemote(site, "10.1.0.5", "1.2.3.4")
+	assert.Error(t, err)
+	_, err = ListPinnedRemotes(`{"name": "legacy"}`)
+	assert.Error(t, err)
+}
+
+func TestPacketCapture(t *testing.T) {
+	dir := t.TempDir()
+	fd := &fakeDevice{networks: []netip.Prefix{netip.MustParsePrefix("10.1.0.0/16")}}
+	n := &Nebula{l: slog.New(slog.DiscardHandler), dev: newTunDevice(fd)}
+
+	path := filepath.Join(dir, "all.pcap")
+	require.NoError(t, n.StartCapture(path, 1<<20, 60000, ""))
+	assert.EqualError(t, n.StartCapture(filepath.Join(dir, "other.pcap"), 1<<20, 60000, ""), "a capture is already running")
+
+	n.dev.outbound(ipv4Packet("10.1.0.10", "10.1.0.2", 40))
+	n.dev.inbound(ipv4Packet("10.1.0.3", "10.1.0.10", 60))
+	require.NoError(t, n.StopCapture())
+	require.NoError(t, n.StopCapture())
+
+	// Nothing is written once stopped
+	n.dev.outbound(ipv4Packet("10.1.0.10", "10.1.0.2", 40))
+
+	b, err := os.ReadFile(path)
+	require.NoError(t, err)
+	require.Len(t, b, pcapHeaderLen+pcapRecordHeaderLen+40+pcapRecordHeaderLen+60)
+	assert.Equal(t, uint32(0xa1b2c3d4), binary.LittleEndian.Uint32(b[0:4]))
+	assert.Equal(t, uint32(pcapLinkTypeRaw), binary.LittleEndian.Uint32(b[20:24]))
+	rec := b[pcapHeaderLen:]
+	assert.Equal(t, uint32(40), binary.LittleEndian.Uint32(rec[8:12]))
+	assert.Equal(t, ipv4Packet("10.1.0.10", "10.1.0.2", 40), rec[pcapRecordHeaderLen:pcapRecordHeaderLen+40])
+
+	// Filtered to one peer and cut off at maxBytes
+	path = filepath.Join(dir, "peer.pcap")
+	require.NoError(t, n.StartCapture(path, pcapHeaderLen+2*(pcapRecordHeaderLen+40), 60000, "10.1.0.2"))
+	c := n.dev.capture.Load()
+	for range 3 {
+		n.dev.outbound(ipv4Packet("10.1.0.10", "10.1.0.3", 40))
+		n.dev.outbound(ipv4Packet("10.1.0.10", "10.1.0.2", 40))
+	}
+	assert.Nil(t, n.dev.capture.Load(), "a full capture stops itself")
+	require.NoError(t, c.close())
+
+	b, err = os.ReadFile(path)
+	require.NoError(t, err)
+	assert.Len(t, b, pcapHeaderLen+2*(pcapRecordHeaderLen+40))
+
+	require.NoError(t, n.StopCapture(), "the full capture ended fine")
+	require.NoError(t, n.StopCapture())
+
+	// and by time, what the writer ran into is still reported once it ended
+	require.NoError(t, n.StartCapture(filepath.Join(dir, "short.pcap"), 1<<20, 10, ""))
+	require.NoError(t, n.dev.capture.Load().f.Close())
+	assert.Eventually(t, func() bool { return n.dev.capture.Load() == nil }, 5*time.Second, 10*time.Millisecond)
+	assert.ErrorIs(t, n.StopCapture(), os.ErrClosed)
+	require.NoError(t, n.StopCapture())
+
+	assert.Error(t, n.StartCapture(path, 10, 60000, ""))
+	assert.Error(t, n.StartCapture(path, 1<<20, 0, ""))
+	assert.Error(t, n.StartCapture(path, 1<<20, 60000, "nope"))
+	assert.Error(t, n.StartCapture(filepath.Join(dir, "missing", "x.pcap"), 1<<20, 60000, ""))
+
+	// A writer that can't keep up costs packets, not packet path time
+	stalled := &packetCapture{dev: n.dev, records: make(chan captureRecord, 1), maxBytes: 1 << 20}
+	stalled.write(netip.MustParseAddr("10.1.0.2"), ipv4Packet("10.1.0.10", "10.1.0.2", 40), time.Now())
+	stalled.write(netip.MustParseAddr("10.1.0.2"), ipv4Packet("10.1.0.10", "10.1.0.2", 40), time.Now())
+	assert.Equal(t, uint64(1), stalled.dropped.Load())
+	assert.Equal(t, int64(pcapRecordHeaderLen+40), stalled.written)
+}
+
+func l4Packet(src, dst string, proto byte, srcPort, dstPort uint16) []byte {
+	p := ipv4Packet(src, dst, 40)
+	p[9] = proto
+	binary.BigEndian.PutUint16(p[20:22], srcPort)
+	binary.BigEndian.PutUint16(p[22:24], dstPort)
+	return p
+}
+
+func TestFirewallFlows(t *testing.T) {
+	admin := testCert(t, "admin-laptop", []string{"admin", "laptop"}, "10.1.0.2/16")
+	phone := testCert(t, "phone", []string{"phone"}, "10.1.0.3/16")
+	certs := map[netip.Addr]cert.Certificate{
+		netip.MustParseAddr("10.1.0.2"): admin,
+		netip.MustParseAddr("10.1.0.3"): phone,
+	}
+
+	p, err := newFirewallPolicy(map[string]any{
+		"firewall": map[string]any{
+			"inbound": []any{
+				map[string]any{"port": 22, "proto": "tcp", "groups": []any{"admin", "laptop"}},
+				map[string]any{"port": "8000-8100", "proto": "tcp", "host": "phone", "local_cidr": "10.1.0.10/32"},
+				map[string]any{"port": "any", "proto": "icmp", "host": "any"},
+			},
+			"outbound": []any{
+				map[string]any{"port": "any", "proto": "any", "host": "any"},
+			},
+		},
+	})
+	require.NoError(t, err)
+
+	ft := newFlowTable()
+	ft.setPolicy(p, func(addr netip.Addr) cert.Certificate { return certs[addr] })
+
+	ssh := l4Packet("10.1.0.2", "10.1.0.10", 6, 50000, 22)
+	ft.seen(ssh, true, netip.MustParseAddr("10.1.0.2"), time.Now())
+	ft.seen(l4Packet("10.1.0.10", "10.1.0.2", 6, 22, 50000), false, netip.MustParseAddr("10.1.0.2"), time.Now())
+	ft.seen(ssh, true, netip.MustParseAddr("10.1.0.2"), time.Now())
+	// phone is not an admin
+	ft.seen(l4Packet("10.1.0.3", "10.1.0.10", 6, 50001, 22), true, netip.MustParseAddr("10.1.0.3"), time.Now())
+	ft.seen(l4Packet("10.1.0.3", "10.1.0.10", 6, 50002, 8080), true, netip.MustParseAddr("10.1.0.3"), time.Now())
+	ft.seen(l4Packet("10.1.0.10", "10.1.0.3", 17, 40000, 53), false, netip.MustParseAddr("10.1.0.3"), time.Now())
+
+	now := time.Now()
+	state := ft.state(now)
+	require.Len(t, state.ObservedFlows, 4)
+
+	e := state.ObservedFlows[0]
+	assert.Equal(t, "tcp", e.Proto)
+	assert.Equal(t, netip.MustParseAddr("10.1.0.10"), e.LocalAddr)
+	assert.Equal(t, uint16(22), e.LocalPort)
+	assert.Equal(t, uint16(50000), e.RemotePort)
+	assert.True(t, e.Incoming)
+	assert.Equal(t, uint64(2), e.RxPackets)
+	assert.Equal(t, uint64(1), e.TxPackets)
+	assert.Equal(t, 0, e.Rule)
+	assert.InDelta(t, (12 * time.Minute).Milliseconds(), e.ExpiresInMs, 1000)
+
+	rules := map[uint16]int{}
+	for _, e := range state.ObservedFlows[1:] {
+		rules[e.RemotePort] = e.Rule
+	}
+	assert.Equal(t, map[uint16]int{50001: -1, 50002: 1, 53: 0}, rules)
+
+	require.Len(t, state.Inbound, 3)
+	assert.Equal(t, uint64(1), state.Inbound[0].Hits)
+	assert.Equal(t, 1, state.Inbound[0].Active)
+	assert.Equal(t, uint64(1), state.Inbound[1].Hits)
+	assert.Equal(t, uint64(0), state.Inbound[2].Hits)
+	require.Len(t, state.Outbound, 1)
+	assert.Equal(t, uint64(1), state.Outbound[0].Hits)
+
+	// udp times out well before tcp
+	state = ft.state(now.Add(5 * time.Minute))
+	assert.Len(t, state.ObservedFlows, 3)
+	assert.Equal(t, 0, state.Outbound[0].Active)
+	assert.Equal(t, uint64(1), state.Outbound[0].Hits)
+
+	b, err := json.Marshal(state)
+	require.NoError(t, err)
+	assert.Contains(t, string(b), `"groups":["admin","laptop"]`)
+	assert.Contains(t, string(b), `"port":"8000-8100","proto":"tcp","host":"phone"`)
+
+	// Outbound flows nebula drops aren't tracked, those to a peer whose cert
+	// isn't known yet wait to be matched before they are listed
+	strict, err := newFirewallPolicy(map[string]any{"firewall": map[string]any{
+		"outbound": []any{map[string]any{"port": 443, "proto": "tcp", "group": "admin"}},
+	}})
+	require.NoError(t, err)
+	ft = newFlowTable()
+	ft.setPolicy(strict, func(addr netip.Addr) cert.Certificate { return certs[addr] })
+
+	ft.seen(l4Packet("10.1.0.10", "10.1.0.2", 6, 40000, 443), false, netip.MustParseAddr("10.1.0.2"), now)
+	ft.seen(l4Packet("10.1.0.10", "10.1.0.3", 6, 40001, 443), false, netip.MustParseAddr("10.1.0.3"), now)
+	ft.seen(l4Packet("10.1.0.10", "10.1.0.4", 6, 40002, 443), false, netip.MustParseAddr("10.1.0.4"), now)
+	assert.Len(t, ft.flows, 2)
+
+	state = ft.state(now)
+	require.Len(t, state.ObservedFlows, 1)
+	assert.Equal(t, netip.MustParseAddr("10.1.0.2"), state.ObservedFlows[0].RemoteAddr)
+
+	certs[netip.MustParseAddr("10.1.0.4")] = admin
+	state = ft.state(now)
+	assert.Len(t, state.ObservedFlows, 2)
+
+	// A reload that stops allowing a flow forgets it
+	strict, err = newFirewallPolicy(map[string]any{"firewall": map[string]any{
+		"outbound": []any{map[string]any{"port": 443, "proto": "tcp", "cidr": "10.1.0.2/32"}},
+	}})
+	require.NoError(t, err)
+	ft.setPolicy(strict, func(addr netip.Addr) cert.Certificate { return certs[addr] })
+	state = ft.state(now)
+	require.Len(t, state.ObservedFlows, 1)
+	assert.Len(t, ft.flows, 1)
+
+	_, err = newFirewallPolicy(map[string]any{"firewall": map[string]any{
+		"inbound": []any{map[string]any{"port": 22, "proto": "tcp", "group": "a", "groups": []any{"b"}}},
+	}})
+	assert.EqualError(t, err, "firewall.inbound rule #0; only one of group or groups should be defined, both provided")
+
+	_, err = newFirewallPolicy(map[string]any{"firewall": map[string]any{
+		"outbound": []any{map[string]any{"port": "90-80", "proto": "tcp", "host": "any"}},
+	}})
+	assert.EqualError(t, err, "firewall.outbound rule #0; `start port was lower than end port`")
+}
+
+func TestFirewallTracking(t *testing.T) {
+	fd := &fakeDevice{networks: []netip.Prefix{netip.MustParsePrefix("10.1.0.0/16")}}
+	n := &Nebula{l: slog.New(slog.DiscardHandler), dev: newTunDevice(fd)}
+	p, err := newFirewallPolicy(map[string]any{"firewall": map[string]any{
+		"outbound": []any{map[string]any{"port": "any", "proto": "any", "host": "any"}},
+	}})
+	require.NoError(t, err)
+	n.dev.flows.setPolicy(p, nil)
+
+	flows := func() firewallState { return n.dev.flows.state(time.Now()) }
+
+	// Off until asked for
+	n.dev.outbound(l4Packet("10.1.0.10", "10.1.0.2", 17, 40000, 53))
+	s, err := n.FirewallState()
+	require.NoError(t, err)
+	assert.Contains(t, s, `"source":"observed","tracking":false`)
+	state := flows()
+	assert.False(t, state.Tracking)
+	assert.Empty(t, state.ObservedFlows)
+	assert.Empty(t, n.dev.flows.flows)
+
+	require.NoError(t, n.StartFirewallTracking(60000))
+	n.dev.outbound(l4Packet("10.1.0.10", "10.1.0.2", 17, 40000, 53))
+	state = flows()
+	assert.True(t, state.Tracking)
+	assert.Len(t, state.ObservedFlows, 1)
+	assert.Equal(t, uint64(1), state.Outbound[0].Hits)
+
+	// Starting again starts over
+	require.NoError(t, n.StartFirewallTracking(60000))
+	state = flows()
+	assert.Empty(t, state.ObservedFlows)
+	assert.Equal(t, uint64(0), state.Outbound[0].Hits)
+
+	n.StopFirewallTracking()
+	n.StopFirewallTracking()
+	n.dev.outbound(l4Packet("10.1.0.10", "10.1.0.2", 17, 40000, 53))
+	assert.False(t, flows().Tracking)
+	assert.Empty(t, n.dev.flows.flows)
+
+	// and it stops by itself
+	require.NoError(t, n.StartFirewallTracking(10))
+	assert.Eventually(t, func() bool { return !n.dev.flows.enabled.Load() }, 5*time.Second, 10*time.Millisecond)
+
+	assert.Error(t, n.StartFirewallTracking(0))
+}
+
+func TestSimulateFirewall(t *testing.T) {
+	caPub, caPriv, err := ed25519.GenerateKey(nil)
+	require.NoError(t, err)
+	notBefore, notAfter := time.Now().Add(-time.Hour), time.Now().Add(time.Hour)
+	ca, err := (&cert.TBSCertificate{
+		Version:   cert.Version1,
+		Name:      "corp-ca",
+		IsCA:      true,
+		NotBefore: notBefore,
+		NotAfter:  notAfter,
+		PublicKey: caPub,
+		Curve:     cert.Curve_CURVE25519,
+	}).Sign(nil, cert.Curve_CURVE25519, caPriv)
+	require.NoError(t, err)
+	caPEM, err := ca.MarshalPEM()
+	require.NoError(t, err)
+	caSha, err := ca.Fingerprint()
+	require.NoError(t, err)
+
+	sign := func(name string, groups []string, network string) string {
+		c, err := (&cert.TBSCertificate{
+			Version:   cert.Version1,
+			Name:      name,
+			Groups:    groups,
+			Networks:  []netip.Prefix{netip.MustParsePrefix(network)},
+			NotBefore: notBefore,
+			NotAfter:  notAfter,
+			PublicKey: make([]byte, 32),
+			Curve:     cert.Curve_CURVE25519,
+		}).Sign(ca, cert.Curve_CURVE25519, caPriv)
+		require.NoError(t, err)
+		b, err := c.MarshalPEM()
+		require.NoError(t, err)
+		return string(b)
+	}
+
+	rawConfig, err := json.Marshal(map[string]any{
+		"pki": map[string]any{"ca": string(caPEM), "cert": sign("me", nil, "10.1.0.10/16")},
+		"firewall": map[string]any{
+			"outbound": []any{map[string]any{"port": "any", "proto": "any", "host": "any"}},
+			"inbound": []any{
+				map[string]any{"port": "any", "proto": "icmp", "host": "any"},
+				map[string]any{"port": "22", "proto": "tcp", "group": "admin", "ca_sha": caSha},
+				map[string]any{"port": "8000-8100", "proto": "tcp", "ca_name": "corp-ca", "cidr": "10.1.2.0/24"},
+				map[string]any{"port": "53", "proto": "udp", "host": "phone", "local_cidr": "192.168.1.0/24"},
+			},
+		},
+	})
+	require.NoError(t, err)
+	site, err := json.Marshal(map[string]any{"name": "test", "rawConfig": string(rawConfig)})
+	require.NoError(t, err)
+
+	simulate := func(peerCert string, packet string) simulationResult {
+		out, err := SimulateFirewall(string(site), peerCert, packet)
+		require.NoError(t, err)
+		var res simulationResult
+		require.NoError(t, json.Unmarshal([]byte(out), &res))
+		return res
+	}
+
+	admin := sign("admin-laptop", []string{"admin"}, "10.1.0.2/16")
+	phone := sign("phone", []string{"phone"}, "10.1.2.3/16")
+
+	res := simulate(admin, `{"direction":"inbound","proto":"tcp","port":22}`)
+	assert.True(t, res.Allowed)
+	require.NotNil(t, res.Rule)
+	assert.Equal(t, 1, res.Rule.Index)
+	assert.Equal(t, "allowed by inbound rule #1", res.Reason)
+
+	res = simulate(phone, `{"direction":"inbound","proto":"tcp","port":22}`)
+	assert.False(t, res.Allowed)
+	assert.Nil(t, res.Rule)
+	assert.Equal(t, "no inbound rule matched", res.Reason)
+
+	// cidr is the peer's vpn addr
+	assert.Equal(t, 2, simulate(phone, `{"direction":"inbound","proto":"tcp","port":8080}`).Rule.Index)
+	assert.False(t, simulate(admin, `{"direction":"inbound","proto":"tcp","port":8080}`).Allowed)
+
+	assert.Equal(t, 0, simulate(admin, `{"direction":"inbound","proto":"icmp"}`).Rule.Index)
+	assert.Equal(t, 0, simulate(admin, `{"direction":"outbound","proto":"udp","port":53}`).Rule.Index)
+
+	// local_cidr rules only match packets addressed inside them
+	assert.False(t, simulate(phone, `{"direction":"inbound","proto":"udp","port":53}`).Allowed)
+	assert.Equal(t, 3, simulate(phone, `{"direction":"inbound","proto":"udp","port":53,"localCidr":"192.168.1.0/24"}`).Rule.Index)
+
+	// A cert from another CA never gets a tunnel
+	res = simulate(testCertPEM(t, "10.1.0.2/16"), `{"direction":"inbound","proto":"icmp"}`)
+	assert.False(t, res.Allowed)
+	assert.Equal(t, "peer cert is not signed by a CA the site trusts", res.Reason)
+
+	_, err = SimulateFirewall(string(site), admin, `{"direction":"sideways","proto":"tcp"}`)
+	assert.Error(t, err)
+	_, err = SimulateFirewall(string(site), admin, `{"direction":"inbound","proto":"sctp"}`)
+	assert.Error(t, err)
+	_, err = SimulateFirewall(string(site), "nope", `{"direction":"inbound","proto":"tcp"}`)
+	assert.Error(t, err)
+}
+
+func TestDNSResponder(t *testing.T) {
+	// An upstream that knows one public name
+	upstream := &dns.Server{Addr: "127.0.0.1:0", Net: "udp", Handler: dns.HandlerFunc(func(w dns.ResponseWriter, req *dns.Msg) {
+		m := new(dns.Msg)
+		m.SetReply(req)
+		rr, _ := dns.NewRR(req.Question[0].Name + " 60 IN A 93.184.215.14")
+		m.Answer = append(m.Answer, rr)
+		_ = w.WriteMsg(m)
+	})}
+	started := make(chan struct{})
+	upstream.NotifyStartedFunc = func() { close(started) }
+	go func() { _ = upstream.ListenAndServe() }()
+	<-started
+	defer func() { _ = upstream.Shutdown() }()
+	upstreamAddr := netip.MustParseAddrPort(upstream.PacketConn.LocalAddr().String())
+
+	var lock sync.Mutex
+	var lookups []string
+	var fallback []netip.AddrPort
+	fd := &fakeDevice{networks: []netip.Prefix{netip.MustParsePrefix("10.1.0.10/16")}, written: make(chan []byte, 8)}
+	dev := newTunDevice(fd)
+	r := newDNSResponder(slog.New(slog.DiscardHandler), dev, func(name string) ([]netip.Addr, error) {
+		lock.Lock()
+		defer lock.Unlock()
+		lookups = append(lookups, name)
+		switch name {
+		case "laptop":
+			return []netip.Addr{netip.MustParseAddr("10.1.0.2"), netip.MustParseAddr("fd00::2")}, nil
+		case "tablet":
+			return nil, os.ErrDeadlineExceeded
+		}
+		return nil, errNameNotFound
+	}, func() []netip.AddrPort {
+		lock.Lock()
+		defer lock.Unlock()
+		return fallback
+	})
+	dev.setOutboundFilter(r.intercept)
+
+	resolver := netip.MustParseAddrPort(defaultDNSResolver + ":53")
+	client := netip.MustParseAddrPort("10.1.0.10:40000")
+	r.apply(dnsResponderConfig{resolver: resolver.Addr(), domain: "nebula.", upstreams: []netip.AddrPort{upstreamAddr}})
+
+	queryPacket := func(name string, qtype uint16) []byte {
+		q := new(dns.Msg)
+		q.SetQuestion(name, qtype)
+		b, err := q.Pack()
+		require.NoError(t, err)
+		return buildUDPPacket(client, resolver, b)
+	}
+	answer := func() *dns.Msg {
+		t.Helper()
+		select {
+		case p := <-fd.written:
+			from, to, payload, ok := parseUDPPacket(p)
+			require.True(t, ok)
+			assert.Equal(t, resolver, from)
+			assert.Equal(t, client, to)
+			resp := new(dns.Msg)
+			require.NoError(t, resp.Unpack(payload))
+			return resp
+		case <-time.After(5 * time.Second):
+			t.Fatal("timed out waiting for the answer")
+			return nil
+		}
+	}
+	query := func(name string, qtype uint16) *dns.Msg {
+		t.Helper()
+		require.True(t, r.intercept(queryPacket(name, qtype)))
+		return answer()
+	}
+
+	// nebula never reads a query, the answer goes straight back to the OS
+	other := ipv4Packet("10.1.0.10", "10.1.0.2", 40)
+	fd.reads = [][]byte{queryPacket("Laptop.nebula.", dns.TypeA), other}
+	buf := make([]byte, 1500)
+	n, err := dev.Read(buf)
+	require.NoError(t, err)
+	assert.Equal(t, other, buf[:n])
+
+	resp := answer()
+	assert.True(t, resp.Authoritative)
+	require.Len(t, resp.Answer, 1)
+	assert.Equal(t, "10.1.0.2", resp.Answer[0].(*dns.A).A.String())
+	assert.Equal(t, uint32(dnsAnswerTTL), resp.Answer[0].Header().Ttl)
+
+	resp = query("laptop.nebula.", dns.TypeAAAA)
+	require.Len(t, resp.Answer, 1)
+	assert.Equal(t, "fd00::2", resp.Answer[0].(*dns.AAAA).AAAA.String())
+
+	resp = query("phone.nebula.", dns.TypeA)
+	assert.Equal(t, dns.RcodeNameError, resp.Rcode)
+	assert.Empty(t, resp.Answer)
+	assert.Equal(t, dns.RcodeServerFailure, query("tablet.nebula.", dns.TypeA).Rcode)
+	lock.Lock()
+	assert.Equal(t, []string{"laptop", "laptop", "phone", "tablet"}, lookups)
+	lock.Unlock()
+
+	// Everything else is forwarded
+	resp = query("example.com.", dns.TypeA)
+	assert.Equal(t, dns.RcodeSuccess, resp.Rcode)
+	require.Len(t, resp.Answer, 1)
+	assert.Equal(t, "93.184.215.14", resp.Answer[0].(*dns.A).A.String())
+
+	// Without upstreams the network's resolvers are asked, with neither there
+	// is nowhere to forward to
+	r.apply(dnsResponderConfig{resolver: resolver.Addr(), domain: "nebula."})
+	assert.Equal(t, dns.RcodeServerFailure, query("example.com.", dns.TypeA).Rcode)
+	lock.Lock()
+	fallback = []netip.AddrPort{upstreamAddr}
+	lock.Unlock()
+	assert.Equal(t, dns.RcodeSuccess, query("example.com.", dns.TypeA).Rcode)
+
+	// An upstream on the overlay is asked across it
+	overlayUpstream := netip.MustParseAddrPort("10.1.0.53:53")
+	r.apply(dnsResponderConfig{resolver: resolver.Addr(), domain: "nebula.", upstreams: []netip.AddrPort{overlayUpstream}})
+	require.True(t, r.intercept(queryPacket("intranet.corp.", dns.TypeA)))
+	sent := <-dev.injected
+	from, to, payload, ok := parseUDPPacket(sent)
+	require.True(t, ok)
+	assert.Equal(t, overlayUpstream, to)
+	q := new(dns.Msg)
+	require.NoError(t, q.Unpack(payload))
+	m := new(dns.Msg)
+	m.SetReply(q)
+	rr, _ := dns.NewRR("intranet.corp. 60 IN A 10.1.0.80")
+	m.Answer = append(m.Answer, rr)
+	b, err := m.Pack()
+	require.NoError(t, err)
+	_, err = dev.Write(buildUDPPacket(overlayUpstream, from, b))
+	require.NoError(t, err)
+	resp = answer()
+	require.Len(t, resp.Answer, 1)
+	assert.Equal(t, "10.1.0.80", resp.Answer[0].(*dns.A).A.String())
+
+	// Anything else sent to the resolver is dropped, other traffic is nebula's
+	tcp := l4Packet("10.1.0.10", defaultDNSResolver, 6, 40000, 53)
+	assert.True(t, r.intercept(tcp))
+	assert.False(t, r.intercept(other))
+	select {
+	case <-fd.written:
+		t.Fatal("nothing answers a tcp packet")
+	case <-time.After(50 * time.Millisecond):
+	}
+
+	r.apply(dnsResponderConfig{})
+	assert.False(t, r.intercept(queryPacket("laptop.nebula.", dns.TypeA)))
+
+	// mobile_nebula.dns
+	c := nebcfg.NewC(slog.New(slog.DiscardHandler))
+	require.NoError(t, c.LoadString("mobile_nebula:\n  dns_resolvers: [1.1.1.1, '[fd00::53]:5353']\n"))
+	cfg, err := loadDNSConfig(c)
+	require.NoError(t, err)
+	assert.False(t, cfg.resolver.IsValid())
+
+	require.NoError(t, c.LoadString("mobile_nebula:\n  dns_resolvers: [1.1.1.1, '[fd00::53]:5353', "+defaultDNSResolver+"]\n  dns:\n    enabled: true\n    domain: Corp.\n"))
+	cfg, err = loadDNSConfig(c)
+	require.NoError(t, err)
+	assert.Equal(t, dnsResponderConfig{
+		resolver:  resolver.Addr(),
+		domain:    "corp.",
+		upstreams: []netip.AddrPort{netip.MustParseAddrPort("1.1.1.1:53"), netip.MustParseAddrPort("[fd00::53]:5353")},
+	}, cfg)
+
+	require.NoError(t, c.LoadString("mobile_nebula:\n  dns:\n    enabled: true\n    resolver: 10.99.0.1\n    upstreams: [9.9.9.9]\n"))
+	cfg, err = loadDNSConfig(c)
+	require.NoError(t, err)
+	assert.Equal(t, netip.MustParseAddr("10.99.0.1"), cfg.resolver)
+	assert.Equal(t, []netip.AddrPort{netip.MustParseAddrPort("9.9.9.9:53")}, cfg.upstreams)
+
+	require.NoError(t, c.LoadString("mobile_nebula:\n  dns:\n    enabled: true\n    resolver: nope\n"))
+	_, err = loadDNSConfig(c)
+	assert.ErrorContains(t, err, "mobile_nebula.dns.resolver")
+	require.NoError(t, c.LoadString("mobile_nebula:\n  dns:\n    enabled: true\n    upstreams: [nope]\n"))
+	_, err = loadDNSConfig(c)
+	assert.ErrorContains(t, err, "mobile_nebula.dns.upstreams")
+
+	// What the platforms hand the OS
+	settings, err := DnsSettings(`{"rawConfig": "{\"mobile_nebula\": {\"dns\": {\"enabled\": true, \"domain\": \"corp\"}}}"}`)
+	require.NoError(t, err)
+	assert.JSONEq(t, `{"resolver": "`+defaultDNSResolver+`", "domain": "corp"}`, settings)
+	settings, err = DnsSettings(`{"rawConfig": "{}"}`)
+	require.NoError(t, err)
+	assert.JSONEq(t, `{"resolver": "", "domain": ""}`, settings)
+}
+
+func TestLighthouseNames(t *testing.T) {
+	var queries []string
+	down := netip.MustParseAddrPort("10.1.0.1:53")
+	ln := newLighthouseNames(func(q *dns.Msg, server netip.AddrPort, _ time.Duration) (*dns.Msg, error) {
+		queries = append(queries, server.String()+" "+q.Question[0].Name+" "+dns.TypeToString[q.Question[0].Qtype])
+		if server == down {
+			return nil, os.ErrDeadlineExceeded
+		}
+
+		m := new(dns.Msg)
+		m.SetReply(q)
+		switch {
+		case q.Question[0].Name != "laptop.":
+			m.Rcode = dns.RcodeNameError
+		case q.Question[0].Qtype == dns.TypeA:
+			rr, _ := dns.NewRR("laptop. 3600 IN A 10.1.0.2")
+			m.Answer = append(m.Answer, rr)
+		case q.Question[0].Qtype == dns.TypeAAAA:
+			rr, _ := dns.NewRR("laptop. 60 IN AAAA fd00::2")
+			m.Answer = append(m.Answer, rr)
+		}
+		return m, nil
+	})
+
+	_, err := ln.resolve("laptop")
+	assert.ErrorContains(t, err, "no lighthouse dns endpoints")
+
+	c := nebcfg.NewC(slog.New(slog.DiscardHandler))
+	require.NoError(t, c.LoadString("lighthouse:\n  hosts: [10.1.0.1]\nmobile_nebula:\n  lighthouse_dns: [10.1.0.1, \"10.1.0.3:5353\"]"))
+	ln.load(c)
+
+	// A lighthouse that doesn't answer is passed over, the lowest ttl wins
+	r, err := ln.resolve("Laptop")
+	require.NoError(t, err)
+	assert.Equal(t, []netip.Addr{netip.MustParseAddr("10.1.0.2"), netip.MustParseAddr("fd00::2")}, r.addrs)
+	assert.False(t, r.cached)
+	assert.WithinDuration(t, time.Now().Add(time.Minute), r.expires, 5*time.Second)
+	assert.Equal(t, []string{"10.1.0.1:53 laptop. A", "10.1.0.3:5353 laptop. A", "10.1.0.3:5353 laptop. AAAA"}, queries)
+
+	queries = nil
+	r, err = ln.resolve("laptop.")
+	require.NoError(t, err)
+	assert.True(t, r.cached)
+	assert.Empty(t, queries)
+
+	// Unknown names are cached as such
+	_, err = ln.resolve("phone")
+	assert.ErrorIs(t, err, errNameNotFound)
+	queries = nil
+	r, err = ln.resolve("phone")
+	assert.ErrorIs(t, err, errNameNotFound)
+	assert.True(t, r.cached)
+	assert.Empty(t, queries)
+
+	// Nobody answering is an error of its own and isn't cached
+	require.NoError(t, c.LoadString("mobile_nebula:\n  lighthouse_dns: [10.1.0.1]"))
+	ln.load(c)
+	_, err = ln.resolve("laptop")
+	assert.ErrorIs(t, err, os.ErrDeadlineExceeded)
+	assert.NotErrorIs(t, err, errNameNotFound)
+	_, err = ln.resolve("laptop")
+	assert.ErrorIs(t, err, os.ErrDeadlineExceeded)
+
+	_, err = ln.resolve("not a name..")
+	assert.Error(t, err)
+}
+
+func TestOverlayDNS(t *testing.T) {
+	fd := &fakeDevice{
+		networks: []netip.Prefix{netip.MustParsePrefix("10.1.0.10/16")},
+		hold:     make(chan struct{}),
+		blocked:  make(chan struct{}, 1),
+	}
+	defer close(fd.hold)
+	dev := newTunDevice(fd)
+	lighthouse := netip.MustParseAddrPort("10.1.0.1:53")
+
+	// Play nebula and the lighthouse, on an idle tunnel nebula is already
+	// waiting on the OS when the query is injected
+	reading := make(chan struct{})
+	go func() {
+		buf := make([]byte, 9001)
+		close(reading)
+		n, err := dev.Read(buf)
+		if err != nil {
+			return
+		}
+		src, dst, payload, ok := parseUDPPacket(buf[:n])
+		if !ok || dst != lighthouse {
+			return
+		}
+		q := new(dns.Msg)
+		if q.Unpack(payload) != nil {
+			return
+		}
+		m := new(dns.Msg)
+		m.SetReply(q)
+		rr, _ := dns.NewRR(q.Question[0].Name + " 300 IN A 10.1.0.2")
+		m.Answer = append(m.Answer, rr)
+		b, _ := m.Pack()
+		_, _ = dev.Write(buildUDPPacket(dst, src, b))
+	}()
+	<-reading
+	<-fd.blocked
+
+	q := new(dns.Msg)
+	q.SetQuestion("laptop.", dns.TypeA)
+	resp, err := dev.exchangeOverlayDNS(q, lighthouse, 5*time.Second)
+	require.NoError(t, err)
+	assert.Equal(t, []netip.Addr{netip.MustParseAddr("10.1.0.2")}, answerAddrs(resp))
+	assert.Empty(t, fd.writes, "the answer never reaches the OS")
+
+	_, err = dev.exchangeOverlayDNS(q, lighthouse, 10*time.Millisecond)
+	assert.ErrorIs(t, err, os.ErrDeadlineExceeded)
+
+	// Checksums hold up for both families
+	for _, ap := range [][2]string{{"10.1.0.10:40000", "10.1.0.1:53"}, {"[fd00::10]:40000", "[fd00::1]:53"}} {
+		src, dst := netip.MustParseAddrPort(ap[0]), netip.MustParseAddrPort(ap[1])
+		p := buildUDPPacket(src, dst, []byte("hello"))
+		gotSrc, gotDst, payload, ok := parseUDPPacket(p)
+		require.True(t, ok)
+		assert.Equal(t, src, gotSrc)
+		assert.Equal(t, dst, gotDst)
+		assert.Equal(t, []byte("hello"), payload)
+
+		l4 := p[20:]
+		pseudo := checksumSum(p[12:20], 0)
+		if src.Addr().Is6() {
+			l4 = p[40:]
+			pseudo = checksumSum(p[8:40], 0)
+		}
+		assert.Equal(t, uint16(0), checksum(l4, pseudo+uint32(len(l4))+17))
+	}
+}
+
+func TestDebugCommand(t *testing.T) {
+	tap := newLogTap(logging.NewHandler(io.Discard))
+	c := nebcfg.NewC(slog.New(tap))
+	require.NoError(t, c.LoadString("pki: {}\n"))
+	dir := t.TempDir()
+	n := &Nebula{l: slog.New(tap), tap: tap, config: c, logFile: &rotatingFile{path: filepath.Join(dir, "nebula.log")}}
+	run := func(cmdline string) (string, error) {
+		return runDebugCommand(n.debugCommands(), cmdline)
+	}
+
+	out, err := run("")
+	require.NoError(t, err)
+	assert.True(t, strings.HasPrefix(out, "Available commands:\n"))
+	assert.Contains(t, out, "print-tunnel - Prints json details about a tunnel for the provided vpn addr\n")
+	assert.Contains(t, out, "list-lighthouse-addrmap - List all lighthouse map entries\n")
+	assert.Contains(t, out, "print-relays - Prints json details about all relay info\n")
+
+	out, err = run("close-tunnel -h")
+	require.NoError(t, err)
+	assert.Contains(t, out, "close-tunnel - Closes a tunnel")
+	assert.Contains(t, out, "-local-only")
+
+	_, err = run("nope")
+	assert.ErrorContains(t, err, "unknown command nope")
+	_, err = run("print-tunnel -bogus")
+	assert.ErrorContains(t, err, "flag provided but not defined: -bogus")
+	_, err = run(`print-tunnel "10.1.0.2`)
+	assert.Error(t, err)
+
+	// Argument problems are output, like over ssh
+	out, err = run("print-tunnel")
+	require.NoError(t, err)
+	assert.Equal(t, "No vpn address was provided\n", out)
+	out, err = run("change-remote 10.1.0.2")
+	require.NoError(t, err)
+	assert.Equal(t, "No address was provided\n", out)
+
+	out, err = run("log-level debug")
+	require.NoError(t, err)
+	assert.Equal(t, "Log level is: debug\n", out)
+	assert.Equal(t, slog.LevelDebug, tap.GetLevel())
+	out, err = run("log-format json")
+	require.NoError(t, err)
+	assert.Equal(t, "Log format is: json\n", out)
+
+	// Profiles stay inside the sandbox dir next to the log file
+	out, err = run("save-mutex-profile ../escape.pb.gz")
+	require.NoError(t, err)
+	assert.Contains(t, out, "outside the sandbox directory")
+	out, err = run(`save-mutex-profile "mutex profile.pb.gz"`)
+	require.NoError(t, err)
+	assert.Contains(t, out, "Profile created at")
+	assert.FileExists(t, filepath.Join(dir, "nebula-debug", "mutex profile.pb.gz"))
+
+	// The lighthouse map is read a host at a time
+	lh, peer, unknown := netip.MustParseAddr("10.1.0.1"), netip.MustParseAddr("10.1.0.20"), netip.MustParseAddr("10.1.0.3")
+	var queried []netip.Addr
+	entries := lighthouseMapEntries([]netip.Addr{peer, lh, unknown, peer}, func(addr netip.Addr) *nebula.CacheMap {
+		queried = append(queried, addr)
+		if addr == unknown {
+			return nil
+		}
+		return &nebula.CacheMap{addr.String(): {Learned: []netip.AddrPort{netip.MustParseAddrPort("192.168.1.2:4242")}}}
+	})
+	assert.Equal(t, []netip.Addr{peer, lh, unknown}, queried)
+	require.Len(t, entries, 2)
+	assert.Equal(t, "10.1.0.1", entries[0].VpnAddr)
+	b, err := json.Marshal(entries[1])
+	require.NoError(t, err)
+	assert.JSONEq(t, `{"vpnAddr":"10.1.0.20","addrs":{"10.1.0.20":{"learned":["192.168.1.2:4242"],"relay":null}}}`, string(b))
+
+	// We reach 10.1.0.5 through the relay at 10.1.0.1 and relay between
+	// 10.1.0.2 and 10.1.0.6
+	relays := debugRelays([]nebula.ControlHostInfo{
+		{VpnAddrs: []netip.Addr{netip.MustParseAddr("10.1.0.5")}, CurrentRelaysToMe: []netip.Addr{lh}},
+		{VpnAddrs: []netip.Addr{netip.MustParseAddr("10.1.0.2")}, CurrentRelaysThroughMe: []netip.Addr{netip.MustParseAddr("10.1.0.6")}},
+		{VpnAddrs: []netip.Addr{lh}, CurrentRelaysThroughMe: []netip.Addr{netip.MustParseAddr("10.1.0.5")}},
+		{VpnAddrs: []netip.Addr{netip.MustParseAddr("10.1.0.6")}},
+	})
+	require.Len(t, relays.Relays, 2)
+	assert.Equal(t, lh, relays.Relays[0].NebulaAddr)
+	assert.Equal(t, []debugRelayFor{{Type: "terminal", PeerAddr: netip.MustParseAddr("10.1.0.5"), RelayedThrough: []netip.Addr{lh}}}, relays.Relays[0].RelayForAddrs)
+	assert.Equal(t, netip.MustParseAddr("10.1.0.2"), relays.Relays[1].NebulaAddr)
+	assert.Equal(t, []debugRelayFor{{Type: "forwarding", PeerAddr: netip.MustParseAddr("10.1.0.6")}}, relays.Relays[1].RelayForAddrs)
+	b, err = json.Marshal(debugRelays(nil))
+	require.NoError(t, err)
+	assert.Equal(t, `{"Relays":null}`, string(b))
+}
+
+func TestRelayOverrides(t *testing.T) {
+	allowRanges := func(yamlConfig string) map[string]any {
+		cfg, err := yamlToJSONMap([]byte(yamlConfig))
+		require.NoError(t, err)
+		lh, _ := cfg["lighthouse"].(map[string]any)
+		ranges, _ := lh["remote_allow_ranges"].(map[string]any)
+		return ranges
+	}
+
+	site := "lighthouse:\n  remote_allow_ranges:\n    10.1.0.2/32:\n      192.168.0.0/16: true\n"
+	r := newRelayOverrides()
+	peer := netip.MustParseAddr("10.1.0.2")
+	other := netip.MustParseAddr("10.1.0.3")
+
+	// Nothing forced leaves the config alone
+	y, commit, err := r.apply(site)
+	require.NoError(t, err)
+	commit()
+	assert.Equal(t, site, y)
+
+	y, commit, err = r.set(site, peer, true)
+	require.NoError(t, err)
+	require.NotNil(t, commit)
+	assert.False(t, r.forced(peer), "nothing changes until nebula runs it")
+	commit()
+	assert.True(t, r.forced(peer))
+	assert.Equal(t, denyAllRemotes(), allowRanges(y)["10.1.0.2/32"])
+
+	_, commit, err = r.set(y, peer, true)
+	require.NoError(t, err)
+	assert.Nil(t, commit, "already forced")
+
+	y, commit, err = r.set(y, other, true)
+	require.NoError(t, err)
+	commit()
+
+	// A reload keeps the overrides on top of the new site config
+	y, commit, err = r.apply("lighthouse:\n  interval: 60\n")
+	require.NoError(t, err)
+	commit()
+	assert.Len(t, allowRanges(y), 2)
+
+	// Lifting restores what the site had, the site reloaded without one
+	y, commit, err = r.set(y, other, false)
+	require.NoError(t, err)
+	commit()
+	assert.Equal(t, map[string]any{"10.1.0.2/32": denyAllRemotes()}, allowRanges(y))
+	y, commit, err = r.set(y, peer, false)
+	require.NoError(t, err)
+	commit()
+	assert.Nil(t, allowRanges(y))
+	assert.False(t, r.forced(peer))
+
+	// The original entry comes back
+	y, commit, err = r.set(site, peer, true)
+	require.NoError(t, err)
+	commit()
+	y, commit, err = r.set(y, peer, false)
+	require.NoError(t, err)
+	commit()
+	assert.Equal(t, map[string]any{"192.168.0.0/16": true}, allowRanges(y)["10.1.0.2/32"])
+
+	// nebula takes the override as a valid allow list
+	c := nebcfg.NewC(slog.New(slog.DiscardHandler))
+	y, _, err = r.set(site, peer, true)
+	require.NoError(t, err)
+	require.NoError(t, c.LoadString(y))
+	al, err := nebula.NewRemoteAllowListFromConfig(c, "lighthouse.remote_allow_list", "lighthouse.remote_allow_ranges")
+	require.NoError(t, err)
+	assert.False(t, al.Allow(peer, netip.MustParseAddr("192.168.1.2")))
+	assert.False(t, al.Allow(peer, netip.MustParseAddr("2001:db8::1")))
+	assert.True(t, al.Allow(other, netip.MustParseAddr("192.168.1.2")))
+}
+
+func TestStartupTrace(t *testing.T) {
+	begin := time.Now().Add(-time.Second)
+	trace := newStartupTrace(begin)
+	at := func(ms int) time.Time { return begin.Add(time.Duration(ms) * time.Millisecond) }
+
+	trace.add(phaseRenderConfig, at(0), at(10))
+	trace.add(phaseLogging, at(10), at(15))
+	trace.add(phaseConfigLoad, at(15), at(40))
+	trace.add(phaseLogging, at(40), at(45))
+
+	trace.observeMain(slog.NewRecord(at(120), slog.LevelInfo, "Firewall rule added", 0), nil)
+	trace.observeMain(slog.NewRecord(at(125), slog.LevelInfo, "Firewall rule added", 0), nil)
+	trace.observeMain(slog.NewRecord(at(130), slog.LevelInfo, "Firewall started", 0), nil)
+	trace.lock.Lock()
+	trace.deviceBegin, trace.deviceEnd = at(140), at(160)
+	trace.lock.Unlock()
+	trace.mainReturned(at(45), at(900))
+
+	c := nebcfg.NewC(slog.New(slog.DiscardHandler))
+	require.NoError(t, c.LoadString("lighthouse:\n  hosts: [10.1.0.1]"))
+	require.True(t, trace.awaitLighthouse(c))
+
+	var report startupReport
+	js, err := (&Nebula{trace: trace}).StartupTrace()
+	require.NoError(t, err)
+	require.NoError(t, json.Unmarshal([]byte(js), &report))
+	assert.Equal(t, []startupPhase{
+		{Name: phaseRenderConfig, StartMs: 0, DurationMs: 10},
+		{Name: phaseLogging, StartMs: 10, DurationMs: 10},
+		{Name: phaseConfigLoad, StartMs: 15, DurationMs: 25},
+		{Name: phasePKI, StartMs: 45, DurationMs: 75},
+		{Name: phaseFirewall, StartMs: 120, DurationMs: 10},
+		{Name: phaseTunDevice, StartMs: 140, DurationMs: 20},
+		{Name: phaseUDPBind, StartMs: 160, DurationMs: 740},
+	}, report.Phases)
+	assert.Equal(t, []string{phaseLighthouse}, report.Pending)
+
+	// Only a handshake with a lighthouse ends the wait
+	r := slog.NewRecord(time.Now(), slog.LevelInfo, "Handshake message received", 0)
+	r.AddAttrs(slog.Any("vpnAddrs", []netip.Addr{netip.MustParseAddr("10.1.0.9")}))
+	trace.observeHandshakes(r, nil)
+	select {
+	case <-trace.handshakeDone:
+		t.Fatal("a peer handshake ended the lighthouse phase")
+	default:
+	}
+
+	r = slog.NewRecord(time.Now(), slog.LevelInfo, "Handshake message received", 0)
+	r.AddAttrs(slog.Any("vpnAddrs", []netip.Addr{netip.MustParseAddr("10.1.0.1")}))
+	trace.observeHandshakes(r, nil)
+	trace.observeHandshakes(r, nil)
+	<-trace.handshakeDone
+
+	report = trace.report()
+	assert.Empty(t, report.Pending)
+	assert.Equal(t, phaseLighthouse, report.Phases[len(report.Phases)-1].Name)
+
+	// A failed Main only reports the time it took as pki
+	trace = newStartupTrace(begin)
+	trace.mainReturned(at(0), at(50))
+	assert.Equal(t, []startupPhase{{Name: phasePKI, StartMs: 0, DurationMs: 50}}, trace.report().Phases)
+
+	// Lighthouses don't wait on one
+	require.NoError(t, c.LoadString("lighthouse:\n  am_lighthouse: true\n  hosts: [10.1.0.1]"))
+	assert.False(t, trace.awaitLighthouse(c))
+}
+
+func TestStopWatchdog(t *testing.T) {
+	release := make(chan struct{})
+	done := runInBackground(func() { <-release })
+	select {
+	case <-done:
+		t.Fatal("done before the func returned")
+	case <-time.After(10 * time.Millisecond):
+	}
+
+	// The dump shows where the stop is stuck
+	assert.Contains(t, goroutineStacks(), "TestStopWatchdog")
+
+	close(release)
+	<-done
+
+	cb := &fakeEventCallback{events: make(chan string, 1)}
+	var s *eventSink
+	s.deliver(event{Type: EventStopTimeout})
+	s = newEventSink(cb)
+	s.deliver(event{Type: EventStopTimeout, Reason: "nebula did not stop within 5s"})
+	e := cb.next(t)
+	assert.Equal(t, EventStopTimeout, e["type"])
+	assert.Equal(t, "nebula did not stop within 5s", e["reason"])
+	assert.NotEmpty(t, e["time"])
+}
+
+// closingDevice is a fakeDevice that records being closed
+type closingDevice struct {
+	fakeDevice
+	closed atomic.Bool
+}
+
+func (d *closingDevice) Close() error {
+	d.closed.Store(true)
+	return nil
+}
+
+// lockCheckingCallback records whether lifecycle was free when an event came
+type lockCheckingCallback struct {
+	n      *Nebula
+	events chan bool
+}
+
+func (f *lockCheckingCallback) OnEvent(string) {
+	free := f.n.lifecycle.TryLock()
+	if free {
+		f.n.lifecycle.Unlock()
+	}
+	f.events <- free
+}
+
+func TestStopTimeout(t *testing.T) {
+	c := nebcfg.NewC(slog.New(slog.DiscardHandler))
+	require.NoError(t, c.LoadString("mobile_nebula:\n  stop_timeout: 20ms\n"))
+	fd := &closingDevice{}
+	n := &Nebula{l: slog.New(slog.DiscardHandler), config: c, dev: newTunDevice(fd), logFile: &rotatingFile{}}
+	cb := &lockCheckingCallback{n: n, events: make(chan bool, 2)}
+	n.events = newEventSink(cb)
+
+	// nebula never finishes stopping
+	n.stopped = make(chan struct{})
+
+	begin := time.Now()
+	err := n.Stop()
+	assert.EqualError(t, err, "nebula did not stop within 20ms, the tunnel was forced closed")
+	assert.Less(t, time.Since(begin), 5*time.Second)
+	assert.True(t, fd.closed.Load(), "the tun device is closed under nebula")
+	assert.True(t, <-cb.events, "the event is delivered outside lifecycle")
+
+	// A second Stop reports the same without waiting or another event
+	begin = time.Now()
+	assert.Equal(t, err, n.Stop())
+	assert.Less(t, time.Since(begin), 20*time.Millisecond)
+	assert.Empty(t, cb.events)
+
+	// and nothing once nebula is done
+	close(n.stopped)
+	assert.NoError(t, n.Stop())
+}
+
+func TestMetrics(t *testing.T) {
+	raw := map[string]any{"stats": map[string]any{"type": "local", "interval": "1s", "lighthouse_metrics": false}}
+	localStats(raw)
+	assert.Equal(t, map[string]any{"type": "none", "local": true, "interval": "1s", "message_metrics": true, "lighthouse_metrics": false}, raw["stats"])
+
+	// Other stats types are nebula's
+	raw = map[string]any{"stats": map[string]any{"type": "prometheus"}}
+	localStats(raw)
+	assert.Equal(t, map[string]any{"type": "prometheus"}, raw["stats"])
+
+	r := metrics.NewRegistry()
+	metrics.GetOrRegisterCounter("handshakes", r).Inc(3)
+	metrics.GetOrRegisterGauge("hostmap.main.hosts", r).Update(2)
+	metrics.GetOrRegisterMeter("messages.tx", r).Mark(5)
+	metrics.GetOrRegisterHistogram("handshake.duration", r, metrics.NewUniformSample(10)).Update(40)
+	metrics.GetOrRegisterTimer("lighthouse.query", r).Update(time.Millisecond)
+
+	snap := snapshotMetrics(r)
+	require.Len(t, snap, 5)
+	assert.Equal(t, "counter", snap["handshakes"].Type)
+	assert.Equal(t, int64(3), *snap["handshakes"].Count)
+	assert.Equal(t, 2.0, *snap["hostmap.main.hosts"].Value)
+	assert.Equal(t, int64(5), *snap["messages.tx"].Count)
+	assert.NotNil(t, snap["messages.tx"].RateMean)
+	assert.Equal(t, 40.0, *snap["handshake.duration"].P50)
+	assert.Nil(t, snap["handshake.duration"].Rate1)
+	assert.Equal(t, int64(time.Millisecond), *snap["lighthouse.query"].Max)
+
+	// A zero counter still reports its count
+	metrics.GetOrRegisterCounter("dropped", r)
+	b, err := json.Marshal(snapshotMetrics(r)["dropped"])
+	require.NoError(t, err)
+	assert.JSONEq(t, `{"type":"counter","count":0}`, string(b))
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	c := nebcfg.NewC(slog.New(slog.DiscardHandler))
+	require.NoError(t, c.LoadString("stats:\n  type: none\n  local: true\n  interval: 10ms"))
+	var s metricsSampler
+	s.configure(ctx, c)
+	assert.Eventually(t, func() bool {
+		g, ok := metrics.DefaultRegistry.Get("runtime.MemStats.HeapAlloc").(metrics.Gauge)
+		return ok && g.Value() > 0
+	}, 5*time.Second, 10*time.Millisecond)
+
+	require.NoError(t, c.LoadString("stats:\n  type: none"))
+	s.configure(ctx, c)
+	assert.Nil(t, s.cancel)
+	assert.Zero(t, s.interval)
+}
+
+func TestHandshakeHistory(t *testing.T) {
+	h := newHandshakeHistory()
+	peer := netip.MustParseAddr("10.1.0.5")
+	remote := netip.MustParseAddrPort("192.0.2.5:4242")
+	record := func(msg string, args ...any) {
+		r := slog.NewRecord(time.Now(), slog.LevelInfo, msg, 0)
+		r.Add(args...)
+		h.observe(r, []slog.Attr{slog.Any("vpnAddrs", []netip.Addr{peer})})
+	}
+
+	record("Handshake message sent", "udpAddrs", []netip.AddrPort{remote})
+	record("Attempt to relay through hosts", "relays", []netip.Addr{netip.MustParseAddr("10.1.0.1")})
+	record("Handshake message sent", "udpAddrs", []netip.AddrPort{remote, netip.MustParseAddrPort("198.51.100.5:4242")})
+	record("Handshake timed out", "udpAddrs", []netip.AddrPort{remote})
+
+	record("Handshake message sent", "udpAddrs", []netip.AddrPort{remote})
+	record("Failed to process handshake packet, abandoning", "error", fmt.Errorf("verify cert: %w", cert.ErrBlockListed))
+
+	// The answer to a peer's handshake starts nothing
+	record("Handshake message sent", "from", nebula.ViaSender{UdpAddr: remote})
+	record("Handshake message received", "from", nebula.ViaSender{UdpAddr: remote})
+
+	record("Handshake message sent", "udpAddrs", []netip.AddrPort{remote})
+	record("Handshake message received", "from", nebula.ViaSender{IsRelayed: true})
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go h.run(ctx, func(vpnAddr netip.Addr) netip.Addr { return netip.MustParseAddr("10.1.0.1") })
+
+	var attempts []handshakeAttempt
+	require.Eventually(t, func() bool {
+		js, err := (&Nebula{handshakes: h}).HandshakeHistory("10.1.0.5")
+		require.NoError(t, err)
+		require.NoError(t, json.Unmarshal([]byte(js), &attempts))
+		return attempts[0].Relay.IsValid()
+	}, 5*time.Second, 10*time.Millisecond)
+
+	require.Len(t, attempts, 4)
+	assert.Equal(t, handshakeSuccess, attempts[0].Outcome)
+	assert.True(t, attempts[0].Relayed)
+	assert.Equal(t, handshakeSuccess, attempts[1].Outcome)
+	assert.True(t, attempts[1].Inbound)
+	assert.Equal(t, remote, attempts[1].From)
+	assert.Equal(t, handshakeBlocklisted, attempts[2].Outcome)
+	assert.Contains(t, attempts[2].Error, "block list")
+	assert.Equal(t, handshakeTimeout, attempts[3].Outcome)
+	assert.Len(t, attempts[3].Remotes, 2)
+	assert.Equal(t, []netip.Addr{netip.MustParseAddr("10.1.0.1")}, attempts[3].Relays)
+	assert.False(t, attempts[3].Ended.IsZero())
+
+	assert.Equal(t, handshakeCANotTrusted, handshakeOutcome(fmt.Errorf("verify cert: %w", cert.ErrCaNotFound)))
+	assert.Equal(t, handshakeCertRejected, handshakeOutcome(fmt.Errorf("verify cert: %w", cert.ErrExpired)))
+	assert.Equal(t, handshakeFailed, handshakeOutcome(errors.New("packet too short")))
+
+	// Trimmed to the configured history
+	c := nebcfg.NewC(slog.New(slog.DiscardHandler))
+	require.NoError(t, c.LoadString("mobile_nebula:\n  handshake_history: 2"))
+	h.load(c)
+	js, err := (&Nebula{handshakes: h}).HandshakeHistory("")
+	require.NoError(t, err)
+	var all map[netip.Addr][]handshakeAttempt
+	require.NoError(t, json.Unmarshal([]byte(js), &all))
+	assert.Len(t, all[peer], 2)
+
+	_, err = (&Nebula{handshakes: h}).HandshakeHistory("nope")
+	assert.Error(t, err)
+}
+
+func TestSelfTest(t *testing.T) {
+	// The listener check passes only while something holds the port
+	pc, err := net.ListenPacket("udp", "127.0.0.1:0")
+	require.NoError(t, err)
+	port := pc.LocalAddr().(*net.UDPAddr).Port
+	assert.Equal(t, selfTestPass, checkListener("127.0.0.1", port).Status)
+	require.NoError(t, pc.Close())
+	assert.Equal(t, selfTestFail, checkListener("127.0.0.1", port).Status)
+	assert.Equal(t, selfTestPass, checkListener("[::]", 0).Status)
+
+	now := time.Now()
+	newCA := func() (cert.Certificate, ed25519.PrivateKey) {
+		pub, key, err := ed25519.GenerateKey(nil)
+		require.NoError(t, err)
+		ca, err := (&cert.TBSCertificate{
+			Version: cert.Version1, Name: "ca", IsCA: true, Curve: cert.Curve_CURVE25519, PublicKey: pub,
+			NotBefore: now.Add(-time.Hour), NotAfter: now.Add(365 * 24 * time.Hour),
+		}).Sign(nil, cert.Curve_CURVE25519, key)
+		require.NoError(t, err)
+		return ca, key
+	}
+	ca, caKey := newCA()
+	signed := func(ca cert.Certificate, key ed25519.PrivateKey, notAfter time.Time) cert.Certificate {
+		c, err := (&cert.TBSCertificate{
+			Version: cert.Version1, Name: "phone", Curve: cert.Curve_CURVE25519, PublicKey: make([]byte, 32),
+			Networks:  []netip.Prefix{netip.MustParsePrefix("10.1.0.2/16")},
+			NotBefore: now.Add(-time.Hour), NotAfter: notAfter,
+		}).Sign(ca, cert.Curve_CURVE25519, key)
+		require.NoError(t, err)
+		return c
+	}
+	host := func(notAfter time.Time) cert.Certificate { return signed(ca, caKey, notAfter) }
+	pool := cert.NewCAPool()
+	require.NoError(t, pool.AddCA(ca))
+
+	assert.Equal(t, selfTestPass, certCheck(host(now.Add(30*24*time.Hour)), pool, now).Status)
+	assert.Equal(t, selfTestWarn, certCheck(host(now.Add(24*time.Hour)), pool, now).Status)
+	expired := certCheck(host(now.Add(24*time.Hour)), pool, now.Add(48*time.Hour))
+	assert.Equal(t, selfTestFail, expired.Status)
+	assert.Contains(t, expired.Message, "expired")
+	otherCA, otherKey := newCA()
+	untrusted := certCheck(signed(otherCA, otherKey, now.Add(30*24*time.Hour)), pool, now)
+	assert.Equal(t, selfTestFail, untrusted.Status)
+	assert.Contains(t, untrusted.Message, "CA")
+	assert.Equal(t, selfTestFail, certCheck(nil, pool, now).Status)
+
+	lh := netip.MustParseAddr("10.1.0.1")
+	up := tunnelCheck(checkLighthouseName, lh, true, 40*time.Millisecond, true, nil)
+	assert.Equal(t, selfTestPass, up.Status)
+	assert.Equal(t, 40.0, up.RttMs)
+	assert.Equal(t, selfTestWarn, tunnelCheck(checkLighthouseName, lh, true, 0, false, nil).Status)
+	down := tunnelCheck(checkLighthouseName, lh, false, 0, false, &handshakeAttempt{Outcome: handshakeTimeout, Remotes: []netip.AddrPort{netip.MustParseAddrPort("192.0.2.1:4242")}})
+	assert.Equal(t, selfTestFail, down.Status)
+	assert.Contains(t, down.Message, "no answer from 192.0.2.1:4242")
+	assert.Contains(t, tunnelCheck(checkLighthouseName, lh, false, 0, false, &handshakeAttempt{Outcome: handshakeTimeout}).Message, "no address is known")
+	assert.Contains(t, tunnelCheck(checkLighthouseName, lh, false, 0, false, &handshakeAttempt{Outcome: handshakeCANotTrusted}).Message, "CA")
+
+	assert.Equal(t, selfTestFail, learnedCheck(lh, nil).Status)
+	assert.Equal(t, selfTestWarn, learnedCheck(lh, &nebula.Cache{Reported: []netip.AddrPort{netip.MustParseAddrPort("192.168.1.2:4242")}}).Status)
+	learned := learnedCheck(lh, &nebula.Cache{Learned: []netip.AddrPort{netip.MustParseAddrPort("203.0.113.9:61000")}})
+	assert.Equal(t, selfTestPass, learned.Status)
+	assert.Contains(t, learned.Message, "203.0.113.9:61000")
+
+	// The report leads with the worst status, checks in a fixed order
+	report := newSelfTestReport([]selfTestCheck{
+		{Name: checkRelaysName, Status: selfTestPass},
+		{Name: checkLighthouseName, Target: "10.1.0.9", Status: selfTestWarn},
+		{Name: checkLighthouseName, Target: "10.1.0.1", Status: selfTestPass},
+		{Name: checkListenerName, Status: selfTestPass},
+	})
+	assert.Equal(t, selfTestWarn, report.Status)
+	var order []string
+	for _, c := range report.Checks {
+		order = append(order, c.Name+" "+c.Target)
+	}
+	assert.Equal(t, []string{"udpListener ", "lighthouse 10.1.0.1", "lighthouse 10.1.0.9", "relay "}, order)
+}
@@ -0,0 +1,210 @@
+package mobileNebula
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/netip"
+	"slices"
+
+	"gopkg.in/yaml.v2"
+)
+
+// networkInfo describes the underlay network the device is on, the platform
+// hands it to RebindNetwork as JSON
+type networkInfo struct {
+	// Type is wifi, cellular, ethernet or whatever else the platform reports
+	Type       string       `json:"type"`
+	Metered    bool         `json:"metered"`
+	IPv4       bool         `json:"ipv4"`
+	IPv6       bool         `json:"ipv6"`
+	LocalAddrs []netip.Addr `json:"localAddrs"`
+	// LocalNetworks are the on link networks of the interface, on wifi they
+	// are preferred for reaching peers, see localRangesFor
+	LocalNetworks []netip.Prefix `json:"localNetworks"`
+	// DNSServers are the network's resolvers, the DNS responder forwards to
+	// them when the site names none
+	DNSServers []netip.Addr `json:"dnsServers"`
+}
+
+func parseNetworkInfo(networkJson string) (networkInfo, error) {
+	var info networkInfo
+	if err := json.Unmarshal([]byte(networkJson), &info); err != nil {
+		return info, fmt.Errorf("failed to parse network: %s", err)
+	}
+
+	for i, addr := range info.LocalAddrs {
+		info.LocalAddrs[i] = addr.Unmap()
+	}
+	slices.SortFunc(info.LocalAddrs, netip.Addr.Compare)
+	info.LocalAddrs = slices.Compact(info.LocalAddrs)
+
+	for i, network := range info.LocalNetworks {
+		info.LocalNetworks[i] = netip.PrefixFrom(network.Addr().Unmap(), network.Bits()).Masked()
+	}
+	slices.SortFunc(info.LocalNetworks, comparePrefixes)
+	info.LocalNetworks = slices.Compact(info.LocalNetworks)
+
+	for i, addr := range info.DNSServers {
+		info.DNSServers[i] = addr.Unmap()
+	}
+	return info, nil
+}
+
+func comparePrefixes(a, b netip.Prefix) int {
+	if c := a.Addr().Compare(b.Addr()); c != 0 {
+		return c
+	}
+	return a.Bits() - b.Bits()
+}
+
+// localRangesFor returns the networks to prefer for reaching peers on info. A
+// peer on the same wifi is better reached over the lan than through its public
+// addr, cellular and the like have no peers next door.
+func localRangesFor(info networkInfo) []netip.Prefix {
+	if info.Type != "wifi" {
+		return nil
+	}
+	return info.LocalNetworks
+}
+
+// editPreferredRanges takes remove, the ranges added by an earlier edit, out
+// of preferred_ranges in yamlConfig and adds add. It returns the ranges it had
+// to add, those the config already listed are left for it to own.
+func editPreferredRanges(yamlConfig string, remove, add []netip.Prefix) (string, []netip.Prefix, error) {
+	if len(remove) == 0 && len(add) == 0 {
+		return yamlConfig, nil, nil
+	}
+
+	cfg, err := yamlToJSONMap([]byte(yamlConfig))
+	if err != nil {
+		return "", nil, err
+	}
+
+	var ranges []any
+	existing := map[netip.Prefix]struct{}{}
+	current, _ := cfg["preferred_ranges"].([]any)
+	for _, r := range current {
+		if p, err := netip.ParsePrefix(fmt.Sprint(r)); err == nil {
+			if slices.Contains(remove, p.Masked()) {
+				continue
+			}
+			existing[p.Masked()] = struct{}{}
+		}
+		ranges = append(ranges, r)
+	}
+
+	var added []netip.Prefix
+	for _, p := range add {
+		if _, ok := existing[p]; !ok {
+			ranges = append(ranges, p.String())
+			added = append(added, p)
+		}
+	}
+
+	if len(ranges) == 0 {
+		delete(cfg, "preferred_ranges")
+	} else {
+		cfg["preferred_ranges"] = ranges
+	}
+
+	b, err := yaml.Marshal(cfg)
+	if err != nil {
+		return "", nil, err
+	}
+	return string(b), added, nil
+}
+
+// rebindDecision decides whether moving from prev, nil before the first report,
+// to next is worth a rebind and says why
+func rebindDecision(prev *networkInfo, next networkInfo) (bool, string) {
+	switch {
+	case prev == nil:
+		return true, "first network report"
+	case !next.IPv4 && !next.IPv6:
+		// Nothing to bind to, the report bringing connectivity back rebinds
+		return false, "no usable network"
+	case prev.Type != next.Type:
+		return true, "network type changed"
+	case prev.IPv4 != next.IPv4 || prev.IPv6 != next.IPv6:
+		return true, "address families changed"
+	case !slices.Equal(prev.LocalAddrs, next.LocalAddrs):
+		return true, "local addresses changed"
+	default:
+		// A change to metered alone doesn't move the underlay
+		return false, "nothing material changed"
+	}
+}
+
+// RebindNetwork is Rebind for platforms that can describe the network they
+// moved to, networkJson is a networkInfo. The rebind only happens when the
+// network changed in a way that can affect the underlay, platforms tend to
+// report the same network several times while roaming. On wifi the
+// localNetworks join preferred_ranges, so a peer on the same lan is reached
+// over it, moving off wifi takes them back out.
+func (n *Nebula) RebindNetwork(networkJson string) error {
+	next, err := parseNetworkInfo(networkJson)
+	if err != nil {
+		return err
+	}
+
+	n.networkLock.Lock()
+	prev := n.network
+	n.network = &next
+	n.networkLock.Unlock()
+
+	if err := n.preferLocalRanges(next); err != nil {
+		n.l.Warn("Failed to prefer the local networks", "type", next.Type, "error", err)
+	}
+
+	rebind, why := rebindDecision(prev, next)
+	if !rebind {
+		n.l.Info("Skipping rebind for network change", "decision", why, "type", next.Type, "metered", next.Metered)
+		return nil
+	}
+
+	n.l.Info("Rebinding UDP listener for network change",
+		"decision", why,
+		"type", next.Type,
+		"metered", next.Metered,
+		"ipv4", next.IPv4,
+		"ipv6", next.IPv6,
+		"localAddrs", next.LocalAddrs,
+	)
+	n.c.RebindUDPServer()
+	n.events.emit(event{Type: EventRebind, Reason: why})
+	return nil
+}
+
+// preferLocalRanges adds the ranges localRangesFor picks for info to the
+// running config's preferred_ranges, in place of those the last network added
+func (n *Nebula) preferLocalRanges(info networkInfo) error {
+	want := localRangesFor(info)
+
+	n.lifecycle.Lock()
+	defer n.lifecycle.Unlock()
+
+	if slices.Equal(want, n.localRanges) || !n.running() {
+		return nil
+	}
+
+	n.l.Info("Preferring local networks for the network change", "type", info.Type, "localNetworks", want)
+	return n.setPreferredRanges(want)
+}
+
+// setPreferredRanges swaps the ranges the last network added for want. Only
+// preferred_ranges differs from the running config, nebula's hostmap picks it
+// up and the sections that didn't change are left alone, so unlike Reload
+// there is nothing to roll back and no reload event. Callers hold lifecycle.
+func (n *Nebula) setPreferredRanges(want []netip.Prefix) error {
+	yamlConfig, added, err := editPreferredRanges(n.yamlConfig, n.addedRanges, want)
+	if err != nil {
+		return err
+	}
+
+	if err := n.config.ReloadConfigString(yamlConfig); err != nil {
+		return err
+	}
+	n.yamlConfig = yamlConfig
+	n.localRanges, n.addedRanges = want, added
+	return nil
+}
@@ -0,0 +1,365 @@
+package mobileNebula
+
+import (
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math/rand/v2"
+	"net/netip"
+	"os"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/miekg/dns"
+	"github.com/slackhq/nebula"
+	nc "github.com/slackhq/nebula/config"
+)
+
+const (
+	// lighthouseDNSTimeout bounds one query to a lighthouse, the responder
+	// waits on it before answering the OS
+	lighthouseDNSTimeout = time.Second
+	// maxNameTTL caps how long a lighthouse answer is trusted, nebula's
+	// responder hands out an hour while a host can come back with a new cert
+	// at any time
+	maxNameTTL = 5 * time.Minute
+	// negativeNameTTL is how long a name no lighthouse knows stays unknown
+	negativeNameTTL = 10 * time.Second
+)
+
+var errNameNotFound = errors.New("name not found")
+
+// lighthouseNames resolves cert names with the dns the lighthouses serve
+// when lighthouse.serve_dns is on, and caches the answers for their ttl
+type lighthouseNames struct {
+	exchange func(q *dns.Msg, server netip.AddrPort, timeout time.Duration) (*dns.Msg, error)
+
+	lock      sync.Mutex
+	endpoints []netip.AddrPort
+	cache     map[string]resolvedName
+}
+
+type resolvedName struct {
+	addrs   []netip.Addr
+	expires time.Time
+	cached  bool
+}
+
+func newLighthouseNames(exchange func(q *dns.Msg, server netip.AddrPort, timeout time.Duration) (*dns.Msg, error)) *lighthouseNames {
+	return &lighthouseNames{exchange: exchange, cache: map[string]resolvedName{}}
+}
+
+// load is a reload callback picking up the lighthouse dns endpoints, the
+// cache goes with a change
+func (ln *lighthouseNames) load(c *nc.C) {
+	endpoints := lighthouseDNSEndpoints(c)
+
+	ln.lock.Lock()
+	defer ln.lock.Unlock()
+	if !slices.Equal(endpoints, ln.endpoints) {
+		ln.endpoints = endpoints
+		clear(ln.cache)
+	}
+}
+
+// resolve returns the vpn addrs of the host holding the cert name, asking the
+// lighthouses in turn until one knows it. errNameNotFound means every
+// lighthouse that answered doesn't know the name, that is cached too.
+func (ln *lighthouseNames) resolve(name string) (resolvedName, error) {
+	key := dns.Fqdn(strings.ToLower(name))
+	if _, ok := dns.IsDomainName(key); !ok || key == "." {
+		return resolvedName{}, fmt.Errorf("%q is not a valid name", name)
+	}
+
+	now := time.Now()
+	ln.lock.Lock()
+	r, ok := ln.cache[key]
+	endpoints := ln.endpoints
+	ln.lock.Unlock()
+
+	if ok && now.Before(r.expires) {
+		r.cached = true
+		if len(r.addrs) == 0 {
+			return r, errNameNotFound
+		}
+		return r, nil
+	}
+
+	if len(endpoints) == 0 {
+		return resolvedName{}, errors.New("no lighthouse dns endpoints are configured")
+	}
+
+	var lastErr error
+	answered := false
+	for _, ep := range endpoints {
+		addrs, ttl, err := ln.query(key, ep)
+		if err != nil {
+			lastErr = fmt.Errorf("lighthouse %s: %w", ep, err)
+			continue
+		}
+		answered = true
+
+		if len(addrs) > 0 {
+			r = resolvedName{addrs: addrs, expires: now.Add(min(ttl, maxNameTTL))}
+			ln.store(key, r)
+			return r, nil
+		}
+	}
+
+	if !answered {
+		return resolvedName{}, lastErr
+	}
+
+	r = resolvedName{expires: now.Add(negativeNameTTL)}
+	ln.store(key, r)
+	return r, errNameNotFound
+}
+
+func (ln *lighthouseNames) store(key string, r resolvedName) {
+	ln.lock.Lock()
+	defer ln.lock.Unlock()
+
+	// Expired entries only go when the cache grows, names are few
+	if len(ln.cache) >= 256 {
+		for k, v := range ln.cache {
+			if time.Now().After(v.expires) {
+				delete(ln.cache, k)
+			}
+		}
+	}
+	ln.cache[key] = r
+}
+
+// query asks one lighthouse for the A and AAAA records of name, returning
+// them along with the lowest ttl among them
+func (ln *lighthouseNames) query(name string, ep netip.AddrPort) ([]netip.Addr, time.Duration, error) {
+	var addrs []netip.Addr
+	ttl := maxNameTTL
+	for _, qtype := range []uint16{dns.TypeA, dns.TypeAAAA} {
+		q := new(dns.Msg)
+		q.SetQuestion(name, qtype)
+		resp, err := ln.exchange(q, ep, lighthouseDNSTimeout)
+		if err != nil {
+			return nil, 0, err
+		}
+
+		switch resp.Rcode {
+		case dns.RcodeSuccess:
+		case dns.RcodeNameError:
+			return nil, 0, nil
+		default:
+			return nil, 0, fmt.Errorf("answered %s", dns.RcodeToString[resp.Rcode])
+		}
+
+		for _, rr := range resp.Answer {
+			ttl = min(ttl, time.Duration(rr.Header().Ttl)*time.Second)
+		}
+		addrs = append(addrs, answerAddrs(resp)...)
+	}
+	return addrs, ttl, nil
+}
+
+type resolveResult struct {
+	Name     string       `json:"name"`
+	VpnAddrs []netip.Addr `json:"vpnAddrs"`
+	// ExpiresInMs is how much longer the answer is cached
+	ExpiresInMs int64 `json:"expiresInMs"`
+	Cached      bool  `json:"cached"`
+}
+
+// ResolveName looks the cert name up with the lighthouses serving dns and
+// returns the host's vpn addrs as JSON. The queries cross the overlay, so
+// they work whatever dns the OS uses, but the lighthouses need
+// lighthouse.serve_dns and an inbound firewall rule letting us reach it.
+// Lighthouses are asked in turn, on port 53 unless
+// mobile_nebula.lighthouse_dns lists the endpoints. Answers are cached for
+// their ttl, at most 5 minutes, and a name no lighthouse knows for 10
+// seconds.
+func (n *Nebula) ResolveName(name string) (string, error) {
+	if n.c.State() != nebula.StateStarted {
+		return "", errors.New("nebula is not running")
+	}
+
+	r, err := n.names.resolve(name)
+	if errors.Is(err, errNameNotFound) {
+		return "", fmt.Errorf("no lighthouse knows %s", name)
+	}
+	if err != nil {
+		return "", err
+	}
+
+	b, err := json.Marshal(resolveResult{
+		Name:        name,
+		VpnAddrs:    r.addrs,
+		ExpiresInMs: time.Until(r.expires).Milliseconds(),
+		Cached:      r.cached,
+	})
+	if err != nil {
+		return "", err
+	}
+
+	return string(b), nil
+}
+
+// lighthouseDNSEndpoints returns where the lighthouses serve dns, from
+// mobile_nebula.lighthouse_dns or every lighthouse.hosts entry on port 53.
+// nebula doesn't tell other hosts the lighthouse.dns.port a lighthouse uses.
+func lighthouseDNSEndpoints(c *nc.C) []netip.AddrPort {
+	var endpoints []netip.AddrPort
+	for _, s := range c.GetStringSlice("mobile_nebula.lighthouse_dns", []string{}) {
+		if ap, err := netip.ParseAddrPort(s); err == nil {
+			endpoints = append(endpoints, netip.AddrPortFrom(ap.Addr().Unmap(), ap.Port()))
+		} else if addr, err := netip.ParseAddr(s); err == nil {
+			endpoints = append(endpoints, netip.AddrPortFrom(addr.Unmap(), 53))
+		}
+	}
+	if len(endpoints) > 0 {
+		return endpoints
+	}
+
+	for _, h := range c.GetStringSlice("lighthouse.hosts", []string{}) {
+		if addr, err := netip.ParseAddr(h); err == nil {
+			endpoints = append(endpoints, netip.AddrPortFrom(addr.Unmap(), 53))
+		}
+	}
+	return endpoints
+}
+
+// exchangeOverlayDNS sends q to server across the overlay and waits up to
+// timeout for the answer. The app is excluded from its own vpn, so a socket
+// can't reach a vpn addr, the query is injected as an inside packet instead
+// and the answer caught before it reaches the OS.
+func (d *tunDevice) exchangeOverlayDNS(q *dns.Msg, server netip.AddrPort, timeout time.Duration) (*dns.Msg, error) {
+	src, ok := d.localAddrFor(server.Addr())
+	if !ok {
+		return nil, errors.New("no vpn address to query from")
+	}
+	local := netip.AddrPortFrom(src, uint16(32768+rand.N(28232)))
+
+	payload, err := q.Pack()
+	if err != nil {
+		return nil, err
+	}
+
+	answers := make(chan []byte, 1)
+	remove := d.addInboundFilter(func(p []byte) bool {
+		from, to, data, ok := parseUDPPacket(p)
+		if !ok || from != server || to != local {
+			return false
+		}
+
+		select {
+		case answers <- append([]byte(nil), data...):
+		default:
+		}
+		return true
+	})
+	defer remove()
+
+	if err := d.inject(buildUDPPacket(local, server, payload)); err != nil {
+		return nil, err
+	}
+
+	timer := time.NewTimer(timeout)
+	defer timer.Stop()
+
+	for {
+		select {
+		case data := <-answers:
+			r := new(dns.Msg)
+			if err := r.Unpack(data); err != nil || r.Id != q.Id {
+				continue
+			}
+			return r, nil
+		case <-timer.C:
+			return nil, os.ErrDeadlineExceeded
+		case <-d.closed:
+			return nil, os.ErrClosed
+		}
+	}
+}
+
+// buildUDPPacket returns a complete ip packet carrying payload from src to dst
+func buildUDPPacket(src, dst netip.AddrPort, payload []byte) []byte {
+	udpLen := 8 + len(payload)
+
+	var p, udp []byte
+	var pseudo uint32
+	if src.Addr().Is4() {
+		p = make([]byte, 20+udpLen)
+		p[0] = 0x45
+		binary.BigEndian.PutUint16(p[2:4], uint16(len(p)))
+		p[8] = 64 // ttl
+		p[9] = 17 // udp
+		s, d := src.Addr().As4(), dst.Addr().As4()
+		copy(p[12:16], s[:])
+		copy(p[16:20], d[:])
+		binary.BigEndian.PutUint16(p[10:12], checksum(p[:20], 0))
+		udp = p[20:]
+		pseudo = checksumSum(p[12:20], 0)
+	} else {
+		p = make([]byte, 40+udpLen)
+		p[0] = 0x60
+		binary.BigEndian.PutUint16(p[4:6], uint16(udpLen))
+		p[6] = 17 // udp
+		p[7] = 64 // hop limit
+		s, d := src.Addr().As16(), dst.Addr().As16()
+		copy(p[8:24], s[:])
+		copy(p[24:40], d[:])
+		udp = p[40:]
+		pseudo = checksumSum(p[8:40], 0)
+	}
+
+	binary.BigEndian.PutUint16(udp[0:2], src.Port())
+	binary.BigEndian.PutUint16(udp[2:4], dst.Port())
+	binary.BigEndian.PutUint16(udp[4:6], uint16(udpLen))
+	copy(udp[8:], payload)
+
+	sum := checksum(udp, pseudo+uint32(udpLen)+17)
+	if sum == 0 {
+		// zero means no checksum in ipv4 and is invalid in ipv6
+		sum = 0xffff
+	}
+	binary.BigEndian.PutUint16(udp[6:8], sum)
+	return p
+}
+
+// parseUDPPacket returns the endpoints and payload of a udp packet that isn't
+// a fragment
+func parseUDPPacket(p []byte) (src netip.AddrPort, dst netip.AddrPort, payload []byte, ok bool) {
+	if len(p) < 1 {
+		return src, dst, nil, false
+	}
+
+	var srcAddr, dstAddr netip.Addr
+	var udp []byte
+	switch p[0] >> 4 {
+	case 4:
+		ihl := int(p[0]&0x0f) * 4
+		if len(p) < 20 || ihl < 20 || len(p) < ihl+8 || p[9] != 17 || binary.BigEndian.Uint16(p[6:8])&0x3fff != 0 {
+			return src, dst, nil, false
+		}
+		srcAddr, dstAddr = netip.AddrFrom4([4]byte(p[12:16])), netip.AddrFrom4([4]byte(p[16:20]))
+		udp = p[ihl:]
+	case 6:
+		if len(p) < 48 || p[6] != 17 {
+			return src, dst, nil, false
+		}
+		srcAddr, dstAddr = netip.AddrFrom16([16]byte(p[8:24])), netip.AddrFrom16([16]byte(p[24:40]))
+		udp = p[40:]
+	default:
+		return src, dst, nil, false
+	}
+
+	udpLen := int(binary.BigEndian.Uint16(udp[4:6]))
+	if udpLen < 8 || udpLen > len(udp) {
+		return src, dst, nil, false
+	}
+
+	src = netip.AddrPortFrom(srcAddr, binary.BigEndian.Uint16(udp[0:2]))
+	dst = netip.AddrPortFrom(dstAddr, binary.BigEndian.Uint16(udp[2:4]))
+	return src, dst, udp[8:udpLen], true
+}
@@ -0,0 +1,289 @@
+package mobileNebula
+
+import (
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math/rand/v2"
+	"net/netip"
+	"os"
+	"time"
+
+	"github.com/slackhq/nebula"
+)
+
+// maxPingCount keeps a stray call from tying the binding up for minutes
+const maxPingCount = 100
+
+// pingPayload pads each echo so a probe looks like a real, if small, packet
+var pingPayload = []byte("mobile_nebula overlay ping......")
+
+type pingProbe struct {
+	Seq   int     `json:"seq"`
+	Lost  bool    `json:"lost"`
+	RttMs float64 `json:"rttMs"`
+	// Remote is the underlay address the tunnel used when the answer came
+	// back, empty when the tunnel was relayed
+	Remote string       `json:"remote,omitempty"`
+	Relays []netip.Addr `json:"relays,omitempty"`
+}
+
+type pingResult struct {
+	VpnAddr     netip.Addr  `json:"vpnAddr"`
+	Sent        int         `json:"sent"`
+	Received    int         `json:"received"`
+	LossPercent float64     `json:"lossPercent"`
+	MinRttMs    float64     `json:"minRttMs"`
+	AvgRttMs    float64     `json:"avgRttMs"`
+	MaxRttMs    float64     `json:"maxRttMs"`
+	Probes      []pingProbe `json:"probes"`
+}
+
+// Ping sends count ICMP echo requests to vpnIp across the overlay, one at a
+// time, waiting up to timeoutMs for each answer, and returns the result as
+// JSON. The echoes go through nebula like any other inside packet, so a
+// missing tunnel is handshaked first and the first probe includes that time.
+//
+// nebula's own test packets can only be sent from inside the core, an echo
+// also proves the peer's firewall and OS pass traffic, but it does need the
+// peer to allow icmp inbound.
+func (n *Nebula) Ping(vpnIp string, count int, timeoutMs int) (string, error) {
+	addr, err := netip.ParseAddr(vpnIp)
+	if err != nil {
+		return "", err
+	}
+	addr = addr.Unmap()
+
+	if count < 1 || count > maxPingCount {
+		return "", fmt.Errorf("count must be between 1 and %d", maxPingCount)
+	}
+
+	if timeoutMs < 1 {
+		return "", errors.New("timeout must be positive")
+	}
+
+	if n.c.State() != nebula.StateStarted {
+		return "", errors.New("nebula is not running")
+	}
+
+	src, ok := n.dev.localAddrFor(addr)
+	if !ok {
+		return "", fmt.Errorf("no vpn address to ping %s from", addr)
+	}
+
+	p := newPinger(n.dev, src, addr)
+	remove := n.dev.addInboundFilter(p.filter)
+	defer remove()
+
+	res := pingResult{VpnAddr: addr, Probes: make([]pingProbe, 0, count)}
+	timeout := time.Duration(timeoutMs) * time.Millisecond
+	var total time.Duration
+
+	for seq := range count {
+		rtt, answered, err := p.probe(uint16(seq), timeout)
+		if err != nil {
+			return "", err
+		}
+
+		res.Sent++
+		probe := pingProbe{Seq: seq, Lost: !answered}
+		if answered {
+			probe.RttMs = durationMs(rtt)
+			probe.Remote, probe.Relays = n.tunnelPath(addr)
+
+			if res.Received == 0 || probe.RttMs < res.MinRttMs {
+				res.MinRttMs = probe.RttMs
+			}
+			if probe.RttMs > res.MaxRttMs {
+				res.MaxRttMs = probe.RttMs
+			}
+			total += rtt
+			res.Received++
+		}
+		res.Probes = append(res.Probes, probe)
+	}
+
+	res.LossPercent = float64(res.Sent-res.Received) * 100 / float64(res.Sent)
+	if res.Received > 0 {
+		res.AvgRttMs = durationMs(total / time.Duration(res.Received))
+	}
+
+	b, err := json.Marshal(res)
+	if err != nil {
+		return "", err
+	}
+
+	return string(b), nil
+}
+
+// tunnelPath returns the underlay remote of the tunnel to vpnAddr, or the
+// relays carrying it when it has no direct remote
+func (n *Nebula) tunnelPath(vpnAddr netip.Addr) (string, []netip.Addr) {
+	hi := n.c.GetHostInfoByVpnAddr(vpnAddr, false)
+	if hi == nil {
+		return "", nil
+	}
+
+	if hi.CurrentRemote.IsValid() {
+		return hi.CurrentRemote.String(), nil
+	}
+	return "", hi.CurrentRelaysToMe
+}
+
+func durationMs(d time.Duration) float64 {
+	return float64(d) / float64(time.Millisecond)
+}
+
+// pinger runs echo probes from src to dst through a tunDevice
+type pinger struct {
+	dev     *tunDevice
+	src     netip.Addr
+	dst     netip.Addr
+	id      uint16
+	replies chan uint16
+}
+
+func newPinger(dev *tunDevice, src, dst netip.Addr) *pinger {
+	return &pinger{
+		dev:     dev,
+		src:     src,
+		dst:     dst,
+		id:      uint16(rand.Uint32()),
+		replies: make(chan uint16, 1),
+	}
+}
+
+// filter is the inboundFilter consuming the echo replies meant for us
+func (p *pinger) filter(pkt []byte) bool {
+	src, id, seq, ok := parseEchoReply(pkt)
+	if !ok || id != p.id || src != p.dst {
+		return false
+	}
+
+	select {
+	case p.replies <- seq:
+	default:
+	}
+	return true
+}
+
+// probe sends one echo and waits for its answer, a late answer to an earlier
+// probe is ignored
+func (p *pinger) probe(seq uint16, timeout time.Duration) (time.Duration, bool, error) {
+	start := time.Now()
+	if err := p.dev.inject(buildEchoRequest(p.src, p.dst, p.id, seq)); err != nil {
+		return 0, false, err
+	}
+
+	timer := time.NewTimer(timeout)
+	defer timer.Stop()
+
+	for {
+		select {
+		case got := <-p.replies:
+			if got == seq {
+				return time.Since(start), true, nil
+			}
+		case <-timer.C:
+			return 0, false, nil
+		case <-p.dev.closed:
+			return 0, false, os.ErrClosed
+		}
+	}
+}
+
+// buildEchoRequest returns a complete ip packet carrying an ICMP or ICMPv6 echo
+// request
+func buildEchoRequest(src, dst netip.Addr, id, seq uint16) []byte {
+	icmpLen := 8 + len(pingPayload)
+
+	if src.Is4() {
+		p := make([]byte, 20+icmpLen)
+		p[0] = 0x45
+		binary.BigEndian.PutUint16(p[2:4], uint16(len(p)))
+		p[8] = 64 // ttl
+		p[9] = 1  // icmp
+		s, d := src.As4(), dst.As4()
+		copy(p[12:16], s[:])
+		copy(p[16:20], d[:])
+		binary.BigEndian.PutUint16(p[10:12], checksum(p[:20], 0))
+
+		icmp := p[20:]
+		icmp[0] = 8 // echo request
+		binary.BigEndian.PutUint16(icmp[4:6], id)
+		binary.BigEndian.PutUint16(icmp[6:8], seq)
+		copy(icmp[8:], pingPayload)
+		binary.BigEndian.PutUint16(icmp[2:4], checksum(icmp, 0))
+		return p
+	}
+
+	p := make([]byte, 40+icmpLen)
+	p[0] = 0x60
+	binary.BigEndian.PutUint16(p[4:6], uint16(icmpLen))
+	p[6] = 58 // icmpv6
+	p[7] = 64 // hop limit
+	s, d := src.As16(), dst.As16()
+	copy(p[8:24], s[:])
+	copy(p[24:40], d[:])
+
+	icmp := p[40:]
+	icmp[0] = 128 // echo request
+	binary.BigEndian.PutUint16(icmp[4:6], id)
+	binary.BigEndian.PutUint16(icmp[6:8], seq)
+	copy(icmp[8:], pingPayload)
+
+	// ICMPv6 checksums cover a pseudo header of the addresses, length and
+	// next header
+	pseudo := checksumSum(p[8:40], 0) + uint32(icmpLen) + 58
+	binary.BigEndian.PutUint16(icmp[2:4], checksum(icmp, pseudo))
+	return p
+}
+
+// parseEchoReply returns who sent an ICMP or ICMPv6 echo reply and its id and
+// sequence
+func parseEchoReply(p []byte) (src netip.Addr, id uint16, seq uint16, ok bool) {
+	if len(p) < 1 {
+		return src, 0, 0, false
+	}
+
+	var icmp []byte
+	switch p[0] >> 4 {
+	case 4:
+		ihl := int(p[0]&0x0f) * 4
+		if len(p) < 20 || ihl < 20 || len(p) < ihl+8 || p[9] != 1 || p[ihl] != 0 {
+			return src, 0, 0, false
+		}
+		src = netip.AddrFrom4([4]byte(p[12:16]))
+		icmp = p[ihl:]
+	case 6:
+		if len(p) < 48 || p[6] != 58 || p[40] != 129 {
+			return src, 0, 0, false
+		}
+		src = netip.AddrFrom16([16]byte(p[8:24]))
+		icmp = p[40:]
+	default:
+		return src, 0, 0, false
+	}
+
+	return src, binary.BigEndian.Uint16(icmp[4:6]), binary.BigEndian.Uint16(icmp[6:8]), true
+}
+
+// checksum folds the internet checksum of b on top of a partial sum
+func checksum(b []byte, initial uint32) uint16 {
+	sum := checksumSum(b, initial)
+	for sum > 0xffff {
+		sum = (sum >> 16) + (sum & 0xffff)
+	}
+	return ^uint16(sum)
+}
+
+func checksumSum(b []byte, sum uint32) uint32 {
+	for i := 0; i+1 < len(b); i += 2 {
+		sum += uint32(binary.BigEndian.Uint16(b[i : i+2]))
+	}
+	if len(b)%2 == 1 {
+		sum += uint32(b[len(b)-1]) << 8
+	}
+	return sum
+}
@@ -0,0 +1,298 @@
+package mobileNebula
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/netip"
+	"sync"
+	"time"
+
+	nc "github.com/slackhq/nebula/config"
+)
+
+const (
+	// pinQueueSize bounds the tunnels waiting to have their pinned remote applied
+	pinQueueSize = 64
+	// pinSettleDelay gives a tunnel time to land in the hostmap, nebula logs the
+	// handshake just before it completes it
+	pinSettleDelay = 200 * time.Millisecond
+)
+
+// PinRemote pins the underlay address of the peer at vpnIp to addr in the site
+// JSON configData and returns the updated site JSON for the platform to save.
+// Pins live in rawConfig under mobile_nebula.pinned_remotes, so unlike
+// SetRemoteForTunnel they outlast the tunnel, a running instance picks a
+// change up on Reload. A managed site update replaces the whole rawConfig, the
+// platform carries the pins over with KeepPinnedRemotes.
+func PinRemote(configData string, vpnIp string, addr string) (string, error) {
+	vpnAddr, err := netip.ParseAddr(vpnIp)
+	if err != nil {
+		return "", errors.New("could not parse vpnIp")
+	}
+
+	remote, err := netip.ParseAddrPort(addr)
+	if err != nil {
+		return "", errors.New("could not parse udp address")
+	}
+
+	return editPinnedRemotes(configData, func(pins map[string]any) {
+		pins[vpnAddr.Unmap().String()] = remote.String()
+	})
+}
+
+// UnpinRemote removes the pin for vpnIp from the site JSON configData and
+// returns the updated site JSON
+func UnpinRemote(configData string, vpnIp string) (string, error) {
+	vpnAddr, err := netip.ParseAddr(vpnIp)
+	if err != nil {
+		return "", errors.New("could not parse vpnIp")
+	}
+
+	return editPinnedRemotes(configData, func(pins map[string]any) {
+		delete(pins, vpnAddr.Unmap().String())
+	})
+}
+
+// ListPinnedRemotes returns the pins in the site JSON configData as a JSON
+// object of vpn ip to underlay address
+func ListPinnedRemotes(configData string) (string, error) {
+	rawConfig, err := siteRawConfig(configData)
+	if err != nil {
+		return "", err
+	}
+
+	pins := map[string]string{}
+	for vpnAddr, remote := range parsePinnedRemotes(rawConfig) {
+		pins[vpnAddr.String()] = remote.String()
+	}
+
+	b, err := json.Marshal(pins)
+	if err != nil {
+		return "", err
+	}
+
+	return string(b), nil
+}
+
+// KeepPinnedRemotes carries the pins in oldRawConfig, the rawConfig of a site
+// before a managed update, over to the updated site JSON configData and
+// returns it. A pin the update itself sets wins.
+func KeepPinnedRemotes(configData string, oldRawConfig string) (string, error) {
+	var rawConfig map[string]any
+	if err := json.Unmarshal([]byte(oldRawConfig), &rawConfig); err != nil {
+		return "", fmt.Errorf("failed to parse rawConfig: %s", err)
+	}
+
+	pins := parsePinnedRemotes(rawConfig)
+	if len(pins) == 0 {
+		return configData, nil
+	}
+
+	return editPinnedRemotes(configData, func(current map[string]any) {
+		for vpnAddr, remote := range pins {
+			if _, ok := current[vpnAddr.String()]; !ok {
+				current[vpnAddr.String()] = remote.String()
+			}
+		}
+	})
+}
+
+func siteRawConfig(configData string) (map[string]any, error) {
+	var d map[string]any
+	if err := json.Unmarshal([]byte(configData), &d); err != nil {
+		return nil, err
+	}
+
+	rawConfigStr, ok := d["rawConfig"].(string)
+	if !ok {
+		return nil, errors.New("site has no rawConfig, migrate it first")
+	}
+
+	var rawConfig map[string]any
+	if err := json.Unmarshal([]byte(rawConfigStr), &rawConfig); err != nil {
+		return nil, fmt.Errorf("failed to parse rawConfig: %s", err)
+	}
+	return rawConfig, nil
+}
+
+func editPinnedRemotes(configData string, edit func(pins map[string]any)) (string, error) {
+	var d map[string]any
+	if err := json.Unmarshal([]byte(configData), &d); err != nil {
+		return "", err
+	}
+
+	rawConfig, err := siteRawConfig(configData)
+	if err != nil {
+		return "", err
+	}
+
+	mobileNebula, ok := rawConfig["mobile_nebula"].(map[string]any)
+	if !ok {
+		mobileNebula = map[string]any{}
+		rawConfig["mobile_nebula"] = mobileNebula
+	}
+
+	pins, ok := mobileNebula["pinned_remotes"].(map[string]any)
+	if !ok {
+		pins = map[string]any{}
+	}
+	edit(pins)
+
+	if len(pins) == 0 {
+		delete(mobileNebula, "pinned_remotes")
+	} else {
+		mobileNebula["pinned_remotes"] = pins
+	}
+	if len(mobileNebula) == 0 {
+		delete(rawConfig, "mobile_nebula")
+	}
+
+	rawConfigBytes, err := json.Marshal(rawConfig)
+	if err != nil {
+		return "", err
+	}
+	d["rawConfig"] = string(rawConfigBytes)
+
+	b, err := json.Marshal(d)
+	if err != nil {
+		return "", err
+	}
+
+	return string(b), nil
+}
+
+// parsePinnedRemotes reads mobile_nebula.pinned_remotes out of a raw config,
+// entries that don't parse are skipped
+func parsePinnedRemotes(rawConfig map[string]any) map[netip.Addr]netip.AddrPort {
+	pins := map[netip.Addr]netip.AddrPort{}
+	mobileNebula, _ := rawConfig["mobile_nebula"].(map[string]any)
+	raw, _ := mobileNebula["pinned_remotes"].(map[string]any)
+	for k, v := range raw {
+		vpnAddr, err := netip.ParseAddr(k)
+		if err != nil {
+			continue
+		}
+
+		s, _ := v.(string)
+		remote, err := netip.ParseAddrPort(s)
+		if err != nil {
+			continue
+		}
+		pins[vpnAddr.Unmap()] = remote
+	}
+	return pins
+}
+
+// remotePins keeps the tunnels to pinned peers on their pinned remote. The
+// pins never reach static_host_map, that would make every pinned peer a
+// static host, they are applied with SetRemoteForTunnel whenever a tunnel to
+// a pinned peer comes up and after every reload.
+type remotePins struct {
+	l     *slog.Logger
+	queue chan netip.Addr
+
+	lock sync.Mutex
+	pins map[netip.Addr]netip.AddrPort
+	tap  *logTap
+	// unwatch is set while observe is registered with tap
+	unwatch func()
+}
+
+func newRemotePins(l *slog.Logger) *remotePins {
+	return &remotePins{l: l, queue: make(chan netip.Addr, pinQueueSize), pins: map[netip.Addr]netip.AddrPort{}}
+}
+
+// load is a reload callback picking up mobile_nebula.pinned_remotes
+func (p *remotePins) load(c *nc.C) {
+	pins := parsePinnedRemotes(map[string]any{"mobile_nebula": normalizeYamlValue(c.Get("mobile_nebula"))})
+
+	p.lock.Lock()
+	p.pins = pins
+	// Tunnels come up at info, only pay for those records while something is
+	// pinned
+	if p.tap != nil && len(pins) > 0 && p.unwatch == nil {
+		p.unwatch = p.tap.addObserverAt(p.observe, slog.LevelInfo)
+	} else if len(pins) == 0 && p.unwatch != nil {
+		p.unwatch()
+		p.unwatch = nil
+	}
+	p.lock.Unlock()
+
+	// Existing tunnels may predate the pin
+	for vpnAddr := range pins {
+		p.enqueue(vpnAddr)
+	}
+}
+
+// watch has load register observe with tap whenever there are pins
+func (p *remotePins) watch(tap *logTap) {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	p.tap = tap
+}
+
+func (p *remotePins) pinFor(vpnAddr netip.Addr) (netip.AddrPort, bool) {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	remote, ok := p.pins[vpnAddr]
+	return remote, ok
+}
+
+func (p *remotePins) enqueue(vpnAddr netip.Addr) {
+	select {
+	case p.queue <- vpnAddr:
+	default:
+	}
+}
+
+// observe is the logObserver catching tunnels coming up, the pin can't be
+// applied inline from the handshake so it is queued for run
+func (p *remotePins) observe(r slog.Record, attrs []slog.Attr) {
+	switch r.Message {
+	case "Handshake message received", "Handshake message received, but no vpnNetworks in common.":
+	default:
+		return
+	}
+
+	for _, vpnAddr := range vpnAddrsAttr(r, attrs) {
+		if _, ok := p.pinFor(vpnAddr); ok {
+			time.AfterFunc(pinSettleDelay, func() { p.enqueue(vpnAddr) })
+		}
+	}
+}
+
+// run applies queued pins with apply until ctx is done
+func (p *remotePins) run(ctx context.Context, apply func(vpnAddr netip.Addr, remote netip.AddrPort) bool) {
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case vpnAddr := <-p.queue:
+			remote, ok := p.pinFor(vpnAddr)
+			if !ok {
+				continue
+			}
+			if apply(vpnAddr, remote) {
+				p.l.Info("Applied pinned remote", "vpnAddr", vpnAddr, "remote", remote)
+			}
+		}
+	}
+}
+
+// applyPin moves the tunnel to vpnAddr onto remote, reporting whether it had
+// to, there may be no tunnel yet in which case the next handshake applies it
+func (n *Nebula) applyPin(vpnAddr netip.Addr, remote netip.AddrPort) bool {
+	// A peer forced onto a relay has no business on an underlay addr
+	if n.relays.forced(vpnAddr) {
+		return false
+	}
+
+	hi := n.c.GetHostInfoByVpnAddr(vpnAddr, false)
+	if hi == nil || hi.CurrentRemote == remote {
+		return false
+	}
+	return n.c.SetRemoteForTunnel(vpnAddr, remote) != nil
+}
@@ -0,0 +1,211 @@
+package mobileNebula
+
+import (
+	"errors"
+	"fmt"
+	"net/netip"
+	"sync"
+
+	"gopkg.in/yaml.v2"
+)
+
+const (
+	tunnelPathAuto   = "auto"
+	tunnelPathDirect = "direct"
+	tunnelPathRelay  = "relay"
+)
+
+// relayOverrides are the peers SetTunnelPath forced onto a relay. A peer is
+// kept off every underlay addr with a lighthouse.remote_allow_ranges entry
+// denying them all, nebula then only handshakes and sends through its
+// relays. Overrides last for the life of the instance, a Reload keeps them.
+type relayOverrides struct {
+	lock sync.Mutex
+	// peers maps each forced peer to the remote_allow_ranges entry the site
+	// config had for it, nil for none
+	peers map[netip.Addr]any
+}
+
+func newRelayOverrides() *relayOverrides {
+	return &relayOverrides{peers: map[netip.Addr]any{}}
+}
+
+func (r *relayOverrides) forced(vpnAddr netip.Addr) bool {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	_, ok := r.peers[vpnAddr]
+	return ok
+}
+
+// apply adds the overrides to a freshly rendered yamlConfig, commit is to be
+// called once nebula runs it
+func (r *relayOverrides) apply(yamlConfig string) (string, func(), error) {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	if len(r.peers) == 0 {
+		return yamlConfig, func() {}, nil
+	}
+
+	origs := map[netip.Addr]any{}
+	yamlConfig, err := editAllowRanges(yamlConfig, func(ranges map[string]any) {
+		for vpnAddr := range r.peers {
+			key := hostPrefix(vpnAddr)
+			origs[vpnAddr] = ranges[key]
+			ranges[key] = denyAllRemotes()
+		}
+	})
+	if err != nil {
+		return "", nil, err
+	}
+
+	return yamlConfig, func() {
+		r.lock.Lock()
+		defer r.lock.Unlock()
+		for vpnAddr, orig := range origs {
+			if _, ok := r.peers[vpnAddr]; ok {
+				r.peers[vpnAddr] = orig
+			}
+		}
+	}, nil
+}
+
+// set forces vpnAddr onto a relay in the running yamlConfig, or lifts that
+// and restores what the site config had for it. It returns the config to
+// reload and a commit to call once nebula runs it, a nil commit means there
+// is nothing to change. Callers hold Nebula.lifecycle.
+func (r *relayOverrides) set(yamlConfig string, vpnAddr netip.Addr, relay bool) (string, func(), error) {
+	r.lock.Lock()
+	orig, ok := r.peers[vpnAddr]
+	r.lock.Unlock()
+	if ok == relay {
+		return yamlConfig, nil, nil
+	}
+
+	yamlConfig, err := editAllowRanges(yamlConfig, func(ranges map[string]any) {
+		key := hostPrefix(vpnAddr)
+		if relay {
+			orig = ranges[key]
+			ranges[key] = denyAllRemotes()
+		} else if orig != nil {
+			ranges[key] = orig
+		} else {
+			delete(ranges, key)
+		}
+	})
+	if err != nil {
+		return "", nil, err
+	}
+
+	return yamlConfig, func() {
+		r.lock.Lock()
+		defer r.lock.Unlock()
+		if relay {
+			r.peers[vpnAddr] = orig
+		} else {
+			delete(r.peers, vpnAddr)
+		}
+	}, nil
+}
+
+func editAllowRanges(yamlConfig string, edit func(ranges map[string]any)) (string, error) {
+	cfg, err := yamlToJSONMap([]byte(yamlConfig))
+	if err != nil {
+		return "", err
+	}
+
+	lh, ok := cfg["lighthouse"].(map[string]any)
+	if !ok {
+		lh = map[string]any{}
+		cfg["lighthouse"] = lh
+	}
+	ranges, ok := lh["remote_allow_ranges"].(map[string]any)
+	if !ok {
+		ranges = map[string]any{}
+		lh["remote_allow_ranges"] = ranges
+	}
+
+	edit(ranges)
+	if len(ranges) == 0 {
+		delete(lh, "remote_allow_ranges")
+	}
+
+	b, err := yaml.Marshal(cfg)
+	if err != nil {
+		return "", err
+	}
+	return string(b), nil
+}
+
+func hostPrefix(addr netip.Addr) string {
+	return netip.PrefixFrom(addr, addr.BitLen()).String()
+}
+
+func denyAllRemotes() map[string]any {
+	return map[string]any{"0.0.0.0/0": false, "::/0": false}
+}
+
+// SetTunnelPath forces how we reach the peer at vpnIp, for troubleshooting.
+// path is one of:
+//   - relay: only the peer's relays are used from now on, the tunnel is
+//     rebuilt through one of them. A peer without relays becomes unreachable.
+//   - direct: lifts relay and moves the tunnel onto the first underlay addr
+//     nebula knows for the peer. A later handshake may pick a relay again.
+//   - auto: lifts relay and lets nebula choose.
+//
+// The path only covers what we send, the peer picks its own. QueryHostmap
+// reports the relay carrying a tunnel and whether relay is forced.
+func (n *Nebula) SetTunnelPath(vpnIp string, path string) error {
+	vpnAddr, err := netip.ParseAddr(vpnIp)
+	if err != nil {
+		return err
+	}
+	vpnAddr = vpnAddr.Unmap()
+
+	if path != tunnelPathAuto && path != tunnelPathDirect && path != tunnelPathRelay {
+		return fmt.Errorf("unknown tunnel path %q, expected auto, direct or relay", path)
+	}
+
+	n.lifecycle.Lock()
+	defer n.lifecycle.Unlock()
+
+	if !n.running() {
+		return errors.New("nebula is not running")
+	}
+
+	yamlConfig, commit, err := n.relays.set(n.yamlConfig, vpnAddr, path == tunnelPathRelay)
+	if err != nil {
+		return err
+	}
+	changed := commit != nil
+	if changed {
+		n.l.Info("Changing tunnel path", "vpnAddr", vpnAddr, "path", path)
+		if err := n.applyReload(yamlConfig); err != nil {
+			return err
+		}
+		commit()
+	}
+
+	switch path {
+	case tunnelPathRelay:
+		// The tunnel may well be direct, rebuild it, the handshake can only
+		// complete through a relay now
+		if changed && n.c.CloseTunnel(vpnAddr, false) {
+			n.c.CreateTunnel(vpnAddr)
+		}
+
+	case tunnelPathDirect:
+		hi := n.c.GetHostInfoByVpnAddr(vpnAddr, false)
+		if hi == nil {
+			return fmt.Errorf("no tunnel to %s", vpnAddr)
+		}
+		if hi.CurrentRemote.IsValid() {
+			return nil
+		}
+		if len(hi.RemoteAddrs) == 0 {
+			return fmt.Errorf("no underlay address is known for %s", vpnAddr)
+		}
+		n.c.SetRemoteForTunnel(vpnAddr, hi.RemoteAddrs[0])
+	}
+
+	return nil
+}
@@ -0,0 +1,252 @@
+package mobileNebula
+
+import (
+	"fmt"
+	"log/slog"
+	"net/netip"
+	"reflect"
+	"runtime"
+	"slices"
+	"sort"
+	"strings"
+	"sync"
+
+	"github.com/slackhq/nebula/cert"
+)
+
+// reloadReport describes what a Reload changed, returned to the platform as JSON
+type reloadReport struct {
+	// Applied is false when nebula was not running and the reload was skipped
+	Applied bool `json:"applied"`
+	// Changed lists the top level config sections that differ
+	Changed []string `json:"changed"`
+	// RestartRequired lists the changes nebula can't apply live, the platform
+	// has to reconnect to pick them up
+	RestartRequired []restartReason `json:"restartRequired"`
+	// Reconnect is true when RestartRequired is not empty
+	Reconnect bool `json:"reconnect"`
+}
+
+type restartReason struct {
+	Section string `json:"section"`
+	Reason  string `json:"reason"`
+}
+
+// restartRule describes a config section, or some keys in it, that nebula
+// only reads when it starts
+type restartRule struct {
+	section string
+	// keys under section that don't reload, empty when none of the section does
+	keys   []string
+	reason string
+}
+
+var restartRules = []restartRule{
+	{section: "tun", reason: "the tun interface, its mtu and routes are only configured on connect"},
+	{section: "cipher", reason: "the cipher can't be changed on a running tunnel"},
+	{section: "listen", keys: []string{"host", "port", "batch", "read_buffer", "write_buffer", "routines"}, reason: "the udp listener is only bound on connect"},
+	{section: "handshakes", reason: "handshake settings are only read on connect"},
+	{section: "routines", reason: "the packet routines are only started on connect"},
+	{section: "lighthouse", keys: []string{"am_lighthouse"}, reason: "lighthouse mode is only chosen on connect"},
+	{section: "stats", keys: []string{"message_metrics", "lighthouse_metrics"}, reason: "message and lighthouse metrics are only set up on connect"},
+	{section: "mobile_nebula", keys: []string{"dns_resolvers", "dns"}, reason: "dns resolvers are only handed to the OS on connect"},
+}
+
+// diffConfigs compares two rendered nebula YAML configs section by section
+func diffConfigs(oldYaml string, newYaml string) (*reloadReport, error) {
+	oldCfg, err := yamlToJSONMap([]byte(oldYaml))
+	if err != nil {
+		return nil, err
+	}
+
+	newCfg, err := yamlToJSONMap([]byte(newYaml))
+	if err != nil {
+		return nil, err
+	}
+
+	report := &reloadReport{Changed: []string{}, RestartRequired: []restartReason{}}
+	for section := range oldCfg {
+		if !reflect.DeepEqual(oldCfg[section], newCfg[section]) {
+			report.Changed = append(report.Changed, section)
+		}
+	}
+	for section := range newCfg {
+		if _, ok := oldCfg[section]; !ok {
+			report.Changed = append(report.Changed, section)
+		}
+	}
+	sort.Strings(report.Changed)
+
+	for _, rule := range restartRules {
+		if !slices.Contains(report.Changed, rule.section) {
+			continue
+		}
+
+		if len(rule.keys) > 0 {
+			oldSection, _ := oldCfg[rule.section].(map[string]interface{})
+			newSection, _ := newCfg[rule.section].(map[string]interface{})
+			if !slices.ContainsFunc(rule.keys, func(k string) bool {
+				return !reflect.DeepEqual(oldSection[k], newSection[k])
+			}) {
+				continue
+			}
+		}
+
+		report.RestartRequired = append(report.RestartRequired, restartReason{Section: rule.section, Reason: rule.reason})
+	}
+
+	// A new cert is fine as long as it keeps our addresses, nebula refuses one
+	// that doesn't and the OS interface carries the old ones until reconnect
+	if slices.Contains(report.Changed, "pki") && !sameCertNetworks(oldCfg, newCfg) {
+		report.RestartRequired = append(report.RestartRequired, restartReason{
+			Section: "pki",
+			Reason:  "the certificate networks changed, the tunnel addresses are only configured on connect",
+		})
+	}
+
+	report.Reconnect = len(report.RestartRequired) > 0
+	return report, nil
+}
+
+// sameCertNetworks reports whether the pki.cert of both configs carry the same
+// networks, certs that fail to parse are left for nebula to complain about
+func sameCertNetworks(oldCfg, newCfg map[string]interface{}) bool {
+	oldNetworks, ok := configCertNetworks(oldCfg)
+	if !ok {
+		return true
+	}
+
+	newNetworks, ok := configCertNetworks(newCfg)
+	if !ok {
+		return true
+	}
+
+	return slices.Equal(oldNetworks, newNetworks)
+}
+
+// configCertNetworks returns the sorted, deduplicated networks of every cert
+// in pki.cert
+func configCertNetworks(cfg map[string]interface{}) ([]netip.Prefix, bool) {
+	pki, _ := cfg["pki"].(map[string]interface{})
+	rawCert, _ := pki["cert"].(string)
+	if rawCert == "" {
+		return nil, false
+	}
+
+	var networks []netip.Prefix
+	rest := []byte(rawCert)
+	for len(strings.TrimSpace(string(rest))) > 0 {
+		var c cert.Certificate
+		var err error
+		c, rest, err = cert.UnmarshalCertificateFromPEM(rest)
+		if err != nil {
+			return nil, false
+		}
+		networks = append(networks, c.Networks()...)
+	}
+
+	slices.SortFunc(networks, comparePrefixes)
+	return slices.Compact(networks), true
+}
+
+// applyReload hands yamlConfig to nebula's reload callbacks. Those log a config
+// they can't apply instead of failing the reload, which leaves the instance
+// running some sections from the new config and some from the old, say a new
+// firewall next to a refused cert. Any of their errors logged while they run
+// puts the instance back on the last config that applied cleanly.
+func (n *Nebula) applyReload(yamlConfig string) error {
+	failures := n.reloadConfig(yamlConfig)
+	if len(failures) == 0 {
+		n.yamlConfig = yamlConfig
+		n.events.emit(event{Type: EventReload})
+		return nil
+	}
+
+	n.l.Error("Reload could not be applied, rolling back to the last good config", "errors", failures)
+	if rollbackFailures := n.reloadConfig(n.yamlConfig); len(rollbackFailures) > 0 {
+		n.l.Error("Rollback did not apply cleanly, reconnect to recover", "errors", rollbackFailures)
+	}
+
+	n.events.emit(event{Type: EventReloadFailed, Reason: failures[0]})
+	return fmt.Errorf("reload failed and was rolled back: %s", failures[0])
+}
+
+// reloadConfig runs a nebula reload and returns the errors its callbacks logged
+func (n *Nebula) reloadConfig(yamlConfig string) []string {
+	var errs reloadErrors
+	remove := n.tap.addObserverAt(errs.observe, slog.LevelError)
+	err := n.config.ReloadConfigString(yamlConfig)
+	remove()
+
+	if err != nil {
+		errs.add(err.Error())
+	}
+	return errs.list()
+}
+
+// reloadFailures are the errors the reload callbacks log when they can't apply
+// their section, nebula's and ours
+var reloadFailures = map[string]struct{}{
+	"Error while creating firewall during reload": {},
+	"Failed to reload PKI from config":            {},
+	"failed to reload tun device":                 {},
+	"failed to reload lighthouse":                 {},
+	"Failed to reload relay_manager":              {},
+	"Failed to reload stats from config":          {},
+	"Failed to reload DNS responder from config":  {},
+	"Failed to reconfigure the sshd":              {},
+	"Failed to set listen.read_buffer":            {},
+	"Failed to set listen.write_buffer":           {},
+	"Failed to set listen.so_mark":                {},
+	"Failed to reconfigure logger on reload":      {},
+	"Failed to configure the DNS responder":       {},
+}
+
+// contextualErrorLog is where the pki, tun and lighthouse reloads log the
+// errors they return with context, the message is whatever went wrong. Only
+// the reload callbacks log through it once nebula is up.
+const contextualErrorLog = "github.com/slackhq/nebula/util.(*ContextualError).Log"
+
+// reloadErrors collects the errors the reload callbacks log. Errors from the
+// rest of nebula, the packet path say, can land in the same window and are
+// left alone.
+type reloadErrors struct {
+	lock sync.Mutex
+	errs []string
+}
+
+func (e *reloadErrors) observe(r slog.Record, attrs []slog.Attr) {
+	if r.Level < slog.LevelError || !isReloadFailure(r) {
+		return
+	}
+
+	msg := r.Message
+	if v, ok := findAttr(r, attrs, "error"); ok {
+		msg += ": " + v.String()
+	}
+	e.add(msg)
+}
+
+// isReloadFailure reports whether a reload callback logged r
+func isReloadFailure(r slog.Record) bool {
+	if _, ok := reloadFailures[r.Message]; ok {
+		return true
+	}
+	if r.PC == 0 {
+		return false
+	}
+	frame, _ := runtime.CallersFrames([]uintptr{r.PC}).Next()
+	return frame.Function == contextualErrorLog
+}
+
+func (e *reloadErrors) add(msg string) {
+	e.lock.Lock()
+	defer e.lock.Unlock()
+	e.errs = append(e.errs, msg)
+}
+
+func (e *reloadErrors) list() []string {
+	e.lock.Lock()
+	defer e.lock.Unlock()
+	return slices.Clone(e.errs)
+}
@@ -0,0 +1,374 @@
+package mobileNebula
+
+import (
+	"cmp"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"net/netip"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/slackhq/nebula"
+	"github.com/slackhq/nebula/cert"
+	nc "github.com/slackhq/nebula/config"
+	"golang.org/x/sys/unix"
+)
+
+const (
+	// selfTestTimeout bounds each network check of SelfTest, a handshake
+	// retried over a lossy link takes a few seconds
+	selfTestTimeout = 5 * time.Second
+	// selfTestPingTimeout bounds the echo timing a reachable lighthouse
+	selfTestPingTimeout = 2 * time.Second
+	// selfTestPollInterval is how often SelfTest looks for a tunnel or a
+	// lighthouse answer it is waiting on
+	selfTestPollInterval = 100 * time.Millisecond
+	// certExpiryWarning is how close to expiring a cert is worth a warning
+	certExpiryWarning = 7 * 24 * time.Hour
+)
+
+// Statuses of a self test check, in order of severity
+const (
+	selfTestPass = "pass"
+	selfTestWarn = "warn"
+	selfTestFail = "fail"
+)
+
+// Self test checks, in the order they are reported
+const (
+	checkListenerName   = "udpListener"
+	checkCertName       = "certificate"
+	checkLighthouseName = "lighthouse"
+	checkLearnedName    = "lighthouseLearned"
+	checkRelaysName     = "relay"
+)
+
+var selfTestOrder = []string{checkListenerName, checkCertName, checkLighthouseName, checkLearnedName, checkRelaysName}
+
+type selfTestCheck struct {
+	Name   string `json:"name"`
+	Status string `json:"status"`
+	// Target is the lighthouse or relay the check is about
+	Target string `json:"target,omitempty"`
+	// Message explains the status in terms a user can act on
+	Message string  `json:"message"`
+	RttMs   float64 `json:"rttMs,omitempty"`
+}
+
+type selfTestReport struct {
+	// Status is the worst status of any check
+	Status string          `json:"status"`
+	Checks []selfTestCheck `json:"checks"`
+}
+
+func newSelfTestReport(checks []selfTestCheck) selfTestReport {
+	slices.SortStableFunc(checks, func(a, b selfTestCheck) int {
+		return cmp.Or(
+			cmp.Compare(slices.Index(selfTestOrder, a.Name), slices.Index(selfTestOrder, b.Name)),
+			strings.Compare(a.Target, b.Target),
+		)
+	})
+
+	report := selfTestReport{Status: selfTestPass, Checks: checks}
+	for _, c := range checks {
+		if severity(c.Status) > severity(report.Status) {
+			report.Status = c.Status
+		}
+	}
+	return report
+}
+
+func severity(status string) int {
+	return slices.Index([]string{selfTestPass, selfTestWarn, selfTestFail}, status)
+}
+
+// SelfTest checks what a working connection needs and returns a JSON report
+// with a pass, warn or fail per check and an overall status, the worst of
+// them. It checks that nebula's udp listener is bound, that our cert is valid
+// against the CA, that every lighthouse is reachable and how fast it answers,
+// that the lighthouses learned our address and that our relays are usable.
+// Missing tunnels are handshaked, SelfTest can take several seconds.
+func (n *Nebula) SelfTest() (string, error) {
+	if n.c.State() != nebula.StateStarted {
+		return "", errors.New("nebula is not running")
+	}
+
+	var lock sync.Mutex
+	var checks []selfTestCheck
+	add := func(c ...selfTestCheck) {
+		lock.Lock()
+		defer lock.Unlock()
+		checks = append(checks, c...)
+	}
+
+	lighthouses := configuredAddrs(n.config, "lighthouse.hosts")
+	amLighthouse := n.config.GetBool("lighthouse.am_lighthouse", false)
+
+	var wg sync.WaitGroup
+	wg.Go(func() {
+		add(checkListener(n.config.GetString("listen.host", "0.0.0.0"), n.config.GetInt("listen.port", 0)))
+	})
+	wg.Go(func() { add(n.checkCert()) })
+	for _, lh := range lighthouses {
+		wg.Go(func() { add(n.checkLighthouse(lh)) })
+	}
+	if !amLighthouse && len(lighthouses) > 0 {
+		wg.Go(func() { add(n.checkLearned(lighthouses)...) })
+	}
+	wg.Go(func() { add(n.checkRelays()...) })
+	wg.Wait()
+
+	if len(lighthouses) == 0 && !amLighthouse {
+		add(selfTestCheck{Name: checkLighthouseName, Status: selfTestWarn, Message: "No lighthouses are configured, only hosts listed in static_host_map can be found"})
+	}
+
+	b, err := json.Marshal(newSelfTestReport(checks))
+	if err != nil {
+		return "", err
+	}
+	return string(b), nil
+}
+
+// configuredAddrs parses the vpn addrs listed under key, entries nebula would
+// reject are skipped
+func configuredAddrs(c *nc.C, key string) []netip.Addr {
+	var addrs []netip.Addr
+	for _, s := range c.GetStringSlice(key, []string{}) {
+		if addr, err := netip.ParseAddr(s); err == nil {
+			addrs = append(addrs, addr.Unmap())
+		}
+	}
+	return addrs
+}
+
+// checkListener binds nebula's listen addr without SO_REUSEPORT, which only
+// fails while nebula holds it. A random port can't be checked this way.
+func checkListener(host string, port int) selfTestCheck {
+	check := selfTestCheck{Name: checkListenerName}
+	if port == 0 {
+		check.Status, check.Message = selfTestPass, "Nebula listens on a random UDP port"
+		return check
+	}
+
+	addr := net.JoinHostPort(strings.Trim(host, "[]"), strconv.Itoa(port))
+	pc, err := net.ListenPacket("udp", addr)
+	switch {
+	case errors.Is(err, unix.EADDRINUSE):
+		check.Status, check.Message = selfTestPass, fmt.Sprintf("Nebula is listening on UDP %s", addr)
+	case err == nil:
+		_ = pc.Close()
+		check.Status, check.Message = selfTestFail, fmt.Sprintf("Nothing is listening on UDP %s, reconnect to bind it again", addr)
+	default:
+		check.Status, check.Message = selfTestWarn, fmt.Sprintf("Could not check UDP %s: %s", addr, err)
+	}
+	return check
+}
+
+// checkCert verifies the cert nebula runs with against the CA in the config
+func (n *Nebula) checkCert() selfTestCheck {
+	var c cert.Certificate
+	if networks := n.dev.Networks(); len(networks) > 0 {
+		c = n.c.GetCertByVpnIp(networks[0].Addr())
+	}
+	pool, err := cert.NewCAPoolFromPEM([]byte(n.config.GetString("pki.ca", "")))
+	if err != nil {
+		return selfTestCheck{Name: checkCertName, Status: selfTestFail, Message: fmt.Sprintf("The site's CA can't be read: %s", err)}
+	}
+	return certCheck(c, pool, time.Now())
+}
+
+func certCheck(c cert.Certificate, pool *cert.CAPool, now time.Time) selfTestCheck {
+	check := selfTestCheck{Name: checkCertName, Status: selfTestFail}
+	if c == nil {
+		check.Message = "Nebula is running without a certificate"
+		return check
+	}
+
+	if _, err := pool.VerifyCertificate(now, c); err != nil {
+		switch {
+		case errors.Is(err, cert.ErrExpired):
+			check.Message = fmt.Sprintf("The certificate expired on %s, it needs to be renewed", c.NotAfter().Format(time.DateOnly))
+		case errors.Is(err, cert.ErrRootExpired):
+			check.Message = "The site's CA has expired, every certificate it signed is invalid"
+		case errors.Is(err, cert.ErrCaNotFound):
+			check.Message = "The certificate was not signed by the site's CA"
+		case errors.Is(err, cert.ErrBlockListed):
+			check.Message = "The certificate is on the site's blocklist"
+		default:
+			check.Message = fmt.Sprintf("The certificate is not valid: %s", err)
+		}
+		return check
+	}
+
+	expires := c.NotAfter()
+	if ca, err := pool.GetCAForCert(c); err == nil && ca.Certificate.NotAfter().Before(expires) {
+		expires = ca.Certificate.NotAfter()
+	}
+
+	check.Status, check.Message = selfTestPass, fmt.Sprintf("The certificate is valid until %s", expires.Format(time.DateOnly))
+	if expires.Sub(now) < certExpiryWarning {
+		check.Status = selfTestWarn
+		check.Message = fmt.Sprintf("The certificate expires on %s, it needs to be renewed soon", expires.Format(time.DateOnly))
+	}
+	return check
+}
+
+// awaitTunnel returns the tunnel to vpnAddr, handshaking one if there is none
+// and waiting up to timeout for it
+func (n *Nebula) awaitTunnel(vpnAddr netip.Addr, timeout time.Duration) *nebula.ControlHostInfo {
+	if hi := n.c.GetHostInfoByVpnAddr(vpnAddr, false); hi != nil {
+		return hi
+	}
+
+	n.c.CreateTunnel(vpnAddr)
+	deadline := time.Now().Add(timeout)
+	for time.Now().Before(deadline) {
+		time.Sleep(selfTestPollInterval)
+		if hi := n.c.GetHostInfoByVpnAddr(vpnAddr, false); hi != nil {
+			return hi
+		}
+	}
+	return nil
+}
+
+// checkLighthouse brings up the tunnel to a lighthouse and times an echo
+// through it
+func (n *Nebula) checkLighthouse(lh netip.Addr) selfTestCheck {
+	hi := n.awaitTunnel(lh, selfTestTimeout)
+	if hi == nil {
+		return tunnelCheck(checkLighthouseName, lh, false, 0, false, n.handshakes.latest(lh))
+	}
+
+	var rtt time.Duration
+	answered := false
+	if src, ok := n.dev.localAddrFor(lh); ok {
+		p := newPinger(n.dev, src, lh)
+		remove := n.dev.addInboundFilter(p.filter)
+		rtt, answered, _ = p.probe(0, selfTestPingTimeout)
+		remove()
+	}
+	return tunnelCheck(checkLighthouseName, lh, true, rtt, answered, nil)
+}
+
+// tunnelCheck reports on the tunnel to a lighthouse or relay, explaining a
+// failed one with the last handshake attempt
+func tunnelCheck(name string, vpnAddr netip.Addr, up bool, rtt time.Duration, answered bool, last *handshakeAttempt) selfTestCheck {
+	check := selfTestCheck{Name: name, Target: vpnAddr.String()}
+	switch {
+	case up && answered:
+		check.Status, check.Message, check.RttMs = selfTestPass, fmt.Sprintf("Reachable, answered in %.0fms", durationMs(rtt)), durationMs(rtt)
+	case up:
+		check.Status, check.Message = selfTestWarn, "Connected, but it did not answer a ping, it may be down or its firewall drops ICMP"
+	default:
+		check.Status, check.Message = selfTestFail, "Not reachable, "+handshakeFailure(last)
+	}
+	return check
+}
+
+// handshakeFailure explains why a handshake got nowhere
+func handshakeFailure(last *handshakeAttempt) string {
+	if last == nil {
+		return "no handshake was attempted"
+	}
+
+	var tried []string
+	for _, r := range last.Remotes {
+		tried = append(tried, r.String())
+	}
+	for _, r := range last.Relays {
+		tried = append(tried, r.String()+" (relay)")
+	}
+
+	switch last.Outcome {
+	case handshakeBlocklisted:
+		return "its certificate is on the site's blocklist"
+	case handshakeCANotTrusted:
+		return "its certificate was signed by a CA this site doesn't trust"
+	case handshakeCertRejected:
+		return "its certificate was rejected: " + last.Error
+	case handshakeFailed:
+		return "the handshake failed: " + last.Error
+	}
+
+	if len(tried) == 0 {
+		return "no address is known for it, check static_host_map and that this network allows DNS"
+	}
+	return fmt.Sprintf("no answer from %s, this network may block UDP", strings.Join(tried, ", "))
+}
+
+// checkLearned asks the lighthouses about ourselves, each answers with the
+// addresses it will hand our peers
+func (n *Nebula) checkLearned(lighthouses []netip.Addr) []selfTestCheck {
+	self := n.dev.Networks()[0].Addr()
+
+	var cache nebula.CacheMap
+	deadline := time.Now().Add(selfTestTimeout)
+	for {
+		if cm := n.c.QueryLighthouse(self); cm != nil {
+			cache = *cm
+		}
+		if time.Now().After(deadline) || slices.IndexFunc(lighthouses, func(lh netip.Addr) bool { return cache[lh.String()] == nil }) < 0 {
+			break
+		}
+		time.Sleep(selfTestPollInterval)
+	}
+
+	checks := make([]selfTestCheck, 0, len(lighthouses))
+	for _, lh := range lighthouses {
+		checks = append(checks, learnedCheck(lh, cache[lh.String()]))
+	}
+	return checks
+}
+
+func learnedCheck(lh netip.Addr, c *nebula.Cache) selfTestCheck {
+	check := selfTestCheck{Name: checkLearnedName, Target: lh.String()}
+	switch {
+	case c == nil || len(c.Learned)+len(c.Reported) == 0:
+		check.Status, check.Message = selfTestFail, "The lighthouse doesn't know our address, other hosts can't find this device"
+	case len(c.Learned) == 0:
+		check.Status, check.Message = selfTestWarn, fmt.Sprintf("The lighthouse only knows our local addresses %s, hosts outside this network may not reach us", joinAddrPorts(c.Reported))
+	default:
+		check.Status, check.Message = selfTestPass, fmt.Sprintf("The lighthouse sees us at %s", joinAddrPorts(c.Learned))
+	}
+	return check
+}
+
+func joinAddrPorts(addrs []netip.AddrPort) string {
+	s := make([]string, 0, len(addrs))
+	for _, a := range addrs {
+		s = append(s, a.String())
+	}
+	return strings.Join(s, ", ")
+}
+
+// checkRelays reports whether the relays we told peers to reach us through
+// are reachable
+func (n *Nebula) checkRelays() []selfTestCheck {
+	if !n.config.GetBool("relay.use_relays", true) {
+		return []selfTestCheck{{Name: checkRelaysName, Status: selfTestPass, Message: "Relays are turned off for this site"}}
+	}
+
+	relays := configuredAddrs(n.config, "relay.relays")
+	if len(relays) == 0 {
+		return []selfTestCheck{{Name: checkRelaysName, Status: selfTestPass, Message: "No relays are configured for this device"}}
+	}
+
+	checks := make([]selfTestCheck, len(relays))
+	var wg sync.WaitGroup
+	for i, relay := range relays {
+		wg.Go(func() {
+			if n.awaitTunnel(relay, selfTestTimeout) == nil {
+				checks[i] = tunnelCheck(checkRelaysName, relay, false, 0, false, n.handshakes.latest(relay))
+				return
+			}
+			checks[i] = selfTestCheck{Name: checkRelaysName, Target: relay.String(), Status: selfTestPass, Message: "Connected, peers that can't reach us directly can use it"}
+		})
+	}
+	wg.Wait()
+	return checks
+}
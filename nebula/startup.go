@@ -0,0 +1,226 @@
+package mobileNebula
+
+import (
+	"encoding/json"
+	"log/slog"
+	"net/netip"
+	"slices"
+	"sync"
+	"time"
+
+	nc "github.com/slackhq/nebula/config"
+)
+
+const (
+	phaseRenderConfig = "renderConfig"
+	phaseConfigLoad   = "configLoad"
+	phaseLogging      = "logging"
+	phasePKI          = "pki"
+	phaseFirewall     = "firewall"
+	phaseTunDevice    = "tunDevice"
+	// phaseUDPBind runs from the tun device to the end of nebula.Main, it
+	// covers resolving listen.host, binding the listeners and the hostmap and
+	// lighthouse setup that follows
+	phaseUDPBind  = "udpBind"
+	phaseActivate = "activate"
+	// phaseLighthouse runs from Start to the first handshake completing with
+	// a lighthouse
+	phaseLighthouse = "firstLighthouseHandshake"
+)
+
+// startupTrace times the phases of a connect, from NewNebula to the first
+// lighthouse handshake. Phases inside nebula.Main aren't reachable from here,
+// their edges come from what nebula logs as it goes.
+type startupTrace struct {
+	lock   sync.Mutex
+	begin  time.Time
+	phases []startupPhase
+
+	// Edges of the phases inside nebula.Main
+	firewallBegin time.Time
+	firewallEnd   time.Time
+	deviceBegin   time.Time
+	deviceEnd     time.Time
+
+	// lighthouses are the vpn addrs a handshake ends phaseLighthouse with,
+	// handshakeBegin is zero once it did
+	lighthouses    map[netip.Addr]struct{}
+	handshakeBegin time.Time
+	handshakeDone  chan struct{}
+}
+
+type startupPhase struct {
+	Name string `json:"name"`
+	// StartMs is when the phase began, relative to NewNebula
+	StartMs    int64 `json:"startMs"`
+	DurationMs int64 `json:"durationMs"`
+}
+
+type startupReport struct {
+	Phases []startupPhase `json:"phases"`
+	// Pending lists the phases still running, only the lighthouse handshake
+	// can be
+	Pending []string `json:"pending"`
+}
+
+func newStartupTrace(begin time.Time) *startupTrace {
+	return &startupTrace{begin: begin, handshakeDone: make(chan struct{})}
+}
+
+// add records a phase that ran from start until end, a phase recorded twice
+// grows by the second run
+func (t *startupTrace) add(name string, start, end time.Time) {
+	if start.IsZero() || end.Before(start) {
+		return
+	}
+
+	t.lock.Lock()
+	defer t.lock.Unlock()
+
+	d := end.Sub(start).Milliseconds()
+	for i := range t.phases {
+		if t.phases[i].Name == name {
+			t.phases[i].DurationMs += d
+			return
+		}
+	}
+	t.phases = append(t.phases, startupPhase{Name: name, StartMs: start.Sub(t.begin).Milliseconds(), DurationMs: d})
+}
+
+// since records a phase that started at start and just ended
+func (t *startupTrace) since(name string, start time.Time) {
+	t.add(name, start, time.Now())
+}
+
+// observeMain is a logObserver for the length of nebula.Main. The firewall is
+// built right after the pki, one log per rule then a summary.
+func (t *startupTrace) observeMain(r slog.Record, _ []slog.Attr) {
+	switch r.Message {
+	case "Firewall rule added":
+		t.lock.Lock()
+		if t.firewallBegin.IsZero() {
+			t.firewallBegin = r.Time
+		}
+		t.lock.Unlock()
+
+	case "Firewall started":
+		t.lock.Lock()
+		if t.firewallBegin.IsZero() {
+			t.firewallBegin = r.Time
+		}
+		t.firewallEnd = r.Time
+		t.lock.Unlock()
+	}
+}
+
+func (t *startupTrace) deviceCreated(start time.Time) {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+	t.deviceBegin = start
+	t.deviceEnd = time.Now()
+}
+
+// mainReturned splits the nebula.Main run from start to end into phases, a
+// failed run only has the phases it got through
+func (t *startupTrace) mainReturned(start, end time.Time) {
+	t.lock.Lock()
+	fwBegin, fwEnd, devBegin, devEnd := t.firewallBegin, t.firewallEnd, t.deviceBegin, t.deviceEnd
+	t.lock.Unlock()
+
+	if fwBegin.IsZero() {
+		// The pki failed to load, or the firewall did
+		t.add(phasePKI, start, end)
+		return
+	}
+	t.add(phasePKI, start, fwBegin)
+	t.add(phaseFirewall, fwBegin, fwEnd)
+	t.add(phaseTunDevice, devBegin, devEnd)
+	t.add(phaseUDPBind, devEnd, end)
+}
+
+// awaitLighthouse starts phaseLighthouse, it ends with the first handshake
+// with one of the lighthouse.hosts in c. A lighthouse or a host without any
+// has no such phase.
+func (t *startupTrace) awaitLighthouse(c *nc.C) bool {
+	lighthouses := map[netip.Addr]struct{}{}
+	if !c.GetBool("lighthouse.am_lighthouse", false) {
+		for _, h := range c.GetStringSlice("lighthouse.hosts", []string{}) {
+			if addr, err := netip.ParseAddr(h); err == nil {
+				lighthouses[addr] = struct{}{}
+			}
+		}
+	}
+
+	t.lock.Lock()
+	defer t.lock.Unlock()
+	if len(lighthouses) == 0 {
+		return false
+	}
+	t.lighthouses = lighthouses
+	t.handshakeBegin = time.Now()
+	return true
+}
+
+// observeHandshakes is a logObserver ending phaseLighthouse
+func (t *startupTrace) observeHandshakes(r slog.Record, attrs []slog.Attr) {
+	if r.Message != "Handshake message received" {
+		return
+	}
+
+	t.lock.Lock()
+	begin := t.handshakeBegin
+	lighthouse := false
+	for _, addr := range vpnAddrsAttr(r, attrs) {
+		if _, ok := t.lighthouses[addr]; ok {
+			lighthouse = true
+		}
+	}
+	if begin.IsZero() || !lighthouse {
+		t.lock.Unlock()
+		return
+	}
+	t.handshakeBegin = time.Time{}
+	close(t.handshakeDone)
+	t.lock.Unlock()
+
+	t.add(phaseLighthouse, begin, r.Time)
+}
+
+func (t *startupTrace) report() startupReport {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+
+	report := startupReport{Phases: slices.Clone(t.phases), Pending: []string{}}
+	if report.Phases == nil {
+		report.Phases = []startupPhase{}
+	}
+	if !t.handshakeBegin.IsZero() {
+		report.Pending = append(report.Pending, phaseLighthouse)
+	}
+	return report
+}
+
+// log writes the phases recorded so far to l, one attr per phase
+func (t *startupTrace) log(l *slog.Logger, msg string) {
+	report := t.report()
+	args := make([]any, 0, len(report.Phases)+1)
+	for _, p := range report.Phases {
+		args = append(args, slog.Duration(p.Name, time.Duration(p.DurationMs)*time.Millisecond))
+	}
+	if len(report.Pending) > 0 {
+		args = append(args, "pending", report.Pending)
+	}
+	l.Info(msg, args...)
+}
+
+// StartupTrace returns a JSON report of how long each phase of the connect
+// took, from NewNebula to the first lighthouse handshake, which is listed as
+// pending until it completes. The phases are logged too, once Start returns
+// and again once a lighthouse answers.
+func (n *Nebula) StartupTrace() (string, error) {
+	b, err := json.Marshal(n.trace.report())
+	if err != nil {
+		return "", err
+	}
+	return string(b), nil
+}
@@ -0,0 +1,255 @@
+package mobileNebula
+
+import (
+	"cmp"
+	"encoding/json"
+	"log/slog"
+	"net/netip"
+	"slices"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/rcrowley/go-metrics"
+)
+
+// maxTrafficPeers bounds the per peer counters, traffic with a peer that
+// doesn't fit only counts in the totals
+const maxTrafficPeers = 1024
+
+// trafficStats counts the inside traffic crossing the tun device per peer.
+// Outgoing packets are counted as the tun hands them to nebula, before its
+// firewall or a missing tunnel can drop them, so they are offered and not sent.
+type trafficStats struct {
+	peers  sync.Map // netip.Addr -> *peerTraffic
+	npeers atomic.Int64
+	total  peerTraffic
+}
+
+type peerTraffic struct {
+	offeredBytes   atomic.Uint64
+	offeredPackets atomic.Uint64
+	rxBytes        atomic.Uint64
+	rxPackets      atomic.Uint64
+	drops          atomic.Uint64
+	lastTraffic    atomic.Int64 // unix nanoseconds
+}
+
+func newTrafficStats() *trafficStats {
+	return &trafficStats{}
+}
+
+// peer returns the counters for addr, nil once maxTrafficPeers other peers
+// hold all the room
+func (s *trafficStats) peer(addr netip.Addr) *peerTraffic {
+	if p, ok := s.peers.Load(addr); ok {
+		return p.(*peerTraffic)
+	}
+
+	if s.npeers.Add(1) > maxTrafficPeers {
+		s.npeers.Add(-1)
+		return nil
+	}
+
+	p, loaded := s.peers.LoadOrStore(addr, &peerTraffic{})
+	if loaded {
+		s.npeers.Add(-1)
+	}
+	return p.(*peerTraffic)
+}
+
+// offered and received take the time from the caller, the device reads the
+// clock once per packet for everything it tracks. An invalid addr is traffic
+// no peer carries, it only counts in the totals.
+func (s *trafficStats) offered(addr netip.Addr, n int, now time.Time) {
+	ns := now.UnixNano()
+	if addr.IsValid() {
+		if p := s.peer(addr); p != nil {
+			p.addOffered(n, ns)
+		}
+	}
+	s.total.addOffered(n, ns)
+}
+
+func (s *trafficStats) received(addr netip.Addr, n int, now time.Time) {
+	ns := now.UnixNano()
+	if addr.IsValid() {
+		if p := s.peer(addr); p != nil {
+			p.addRx(n, ns)
+		}
+	}
+	s.total.addRx(n, ns)
+}
+
+// observe is the logObserver attributing firewall drops to the peer. nebula
+// only logs a drop at debug, and with the tunnel's hostinfo only for these two,
+// so it is registered to see debug records whatever the configured level.
+func (s *trafficStats) observe(r slog.Record, attrs []slog.Attr) {
+	switch r.Message {
+	case "dropping outbound packet", "dropping inbound packet":
+	default:
+		return
+	}
+
+	if vpnAddrs := vpnAddrsAttr(r, attrs); len(vpnAddrs) > 0 {
+		if p := s.peer(vpnAddrs[0]); p != nil {
+			p.drops.Add(1)
+		}
+	}
+}
+
+func (p *peerTraffic) addOffered(n int, now int64) {
+	p.offeredBytes.Add(uint64(n))
+	p.offeredPackets.Add(1)
+	p.lastTraffic.Store(now)
+}
+
+func (p *peerTraffic) addRx(n int, now int64) {
+	p.rxBytes.Add(uint64(n))
+	p.rxPackets.Add(1)
+	p.lastTraffic.Store(now)
+}
+
+// recentPeers returns the peers that saw traffic within window, most recently
+// active first
+func (s *trafficStats) recentPeers(window time.Duration) []netip.Addr {
+	type recent struct {
+		addr netip.Addr
+		last int64
+	}
+
+	cutoff := time.Now().Add(-window).UnixNano()
+	var peers []recent
+	s.peers.Range(func(k, v any) bool {
+		if last := v.(*peerTraffic).lastTraffic.Load(); last >= cutoff {
+			peers = append(peers, recent{addr: k.(netip.Addr), last: last})
+		}
+		return true
+	})
+
+	slices.SortFunc(peers, func(a, b recent) int {
+		return cmp.Compare(b.last, a.last)
+	})
+
+	addrs := make([]netip.Addr, 0, len(peers))
+	for _, p := range peers {
+		addrs = append(addrs, p.addr)
+	}
+	return addrs
+}
+
+type trafficCounters struct {
+	// OfferedBytes and OfferedPackets count what was handed to nebula for the
+	// peer, including what nebula then dropped
+	OfferedBytes   uint64 `json:"offeredBytes"`
+	OfferedPackets uint64 `json:"offeredPackets"`
+	RxBytes        uint64 `json:"rxBytes"`
+	RxPackets      uint64 `json:"rxPackets"`
+	// SinceLastTrafficMs is -1 when there has been no traffic at all
+	SinceLastTrafficMs int64 `json:"sinceLastTrafficMs"`
+}
+
+func (p *peerTraffic) counters(now time.Time) trafficCounters {
+	c := trafficCounters{
+		OfferedBytes:       p.offeredBytes.Load(),
+		OfferedPackets:     p.offeredPackets.Load(),
+		RxBytes:            p.rxBytes.Load(),
+		RxPackets:          p.rxPackets.Load(),
+		SinceLastTrafficMs: -1,
+	}
+
+	if last := p.lastTraffic.Load(); last > 0 {
+		c.SinceLastTrafficMs = now.Sub(time.Unix(0, last)).Milliseconds()
+	}
+	return c
+}
+
+type peerStats struct {
+	VpnAddr  netip.Addr `json:"vpnAddr"`
+	CertName string     `json:"certName"`
+	// Tunnel is true while there is an established tunnel to the peer
+	Tunnel bool `json:"tunnel"`
+	// Drops counts the packets the firewall dropped to or from the peer
+	Drops uint64 `json:"drops"`
+	trafficCounters
+}
+
+type totalStats struct {
+	trafficCounters
+	Drops dropCounters `json:"drops"`
+}
+
+// dropCounters are nebula's own drop counters, they count every drop whatever
+// the log level. nebula's metrics registry is process wide, so on Android where the app
+// process outlives a connect they count since the process started.
+type dropCounters struct {
+	FirewallIncoming uint64 `json:"firewallIncoming"`
+	FirewallOutgoing uint64 `json:"firewallOutgoing"`
+	CachedPackets    uint64 `json:"cachedPackets"`
+	Lost             uint64 `json:"lost"`
+}
+
+type tunnelStats struct {
+	Peers  []peerStats `json:"peers"`
+	Totals totalStats  `json:"totals"`
+}
+
+// TunnelStats returns a JSON snapshot of the inside traffic exchanged with every
+// peer since the tunnel started, along with totals for the whole instance.
+// Counts are of the unencrypted packets crossing the tun device, traffic to an
+// unsafe route is attributed to the peer routing it. Outgoing traffic is
+// counted as offered to nebula, see trafficCounters.
+func (n *Nebula) TunnelStats() (string, error) {
+	now := time.Now()
+	stats := tunnelStats{
+		Peers: []peerStats{},
+		Totals: totalStats{
+			trafficCounters: n.dev.traffic.total.counters(now),
+			Drops:           readDropCounters(),
+		},
+	}
+
+	n.dev.traffic.peers.Range(func(k, v any) bool {
+		addr := k.(netip.Addr)
+		pt := v.(*peerTraffic)
+		ps := peerStats{VpnAddr: addr, Drops: pt.drops.Load(), trafficCounters: pt.counters(now)}
+		if c := n.c.GetCertByVpnIp(addr); c != nil {
+			ps.CertName = c.Name()
+			ps.Tunnel = true
+		}
+		stats.Peers = append(stats.Peers, ps)
+		return true
+	})
+
+	slices.SortFunc(stats.Peers, func(a, b peerStats) int {
+		return a.VpnAddr.Compare(b.VpnAddr)
+	})
+
+	b, err := json.Marshal(stats)
+	if err != nil {
+		return "", err
+	}
+
+	return string(b), nil
+}
+
+func readDropCounters() dropCounters {
+	return dropCounters{
+		FirewallIncoming: sumCounters("firewall.incoming.dropped.local_addr", "firewall.incoming.dropped.remote_addr", "firewall.incoming.dropped.no_rule"),
+		FirewallOutgoing: sumCounters("firewall.outgoing.dropped.local_addr", "firewall.outgoing.dropped.remote_addr", "firewall.outgoing.dropped.no_rule"),
+		CachedPackets:    sumCounters("hostinfo.cached_packets.dropped"),
+		Lost:             sumCounters("network.packets.lost"),
+	}
+}
+
+// sumCounters adds up the named counters from nebula's metrics registry, a
+// counter nebula has not registered yet counts as zero
+func sumCounters(names ...string) uint64 {
+	var sum uint64
+	for _, name := range names {
+		if c, ok := metrics.DefaultRegistry.Get(name).(metrics.Counter); ok {
+			sum += uint64(c.Count())
+		}
+	}
+	return sum
+}